@@ -0,0 +1,146 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"errors"
+	"math"
+)
+
+// Adaptive sets the builder to choose, for each stored block sized chunk of
+// the data passed to AddCompressedData, whichever of the compressed and stored
+// encodings of the chunk is smaller, so that data that does not compress, such
+// as random identifiers or base64 encoded images, is not expanded by the
+// compressor.
+//
+// Each chunk is compressed into a temporary buffer and flushed, which costs a
+// few bytes, and is emitted as is or replaced with stored blocks. The
+// compressor keeps its history either way, as the decompressed data is the
+// same. A chunk that is clearly incompressible, judged by the entropy of a
+// sample of its bytes, is stored without being compressed.
+//
+// Adaptive cannot be used with IndexEvery.
+func (b *builder) Adaptive() {
+	if !b.canSetOption() {
+		return
+	}
+
+	if b.index != nil {
+		b.err = errors.New("gzipbuilder: adaptive mode cannot be used with an index")
+		return
+	}
+
+	b.adaptBuf = new(bytes.Buffer)
+}
+
+// addAdaptive adds data, which has already been counted, in adaptive mode.
+// The data is split into chunks of at most storedBlockLen bytes, so that the
+// temporary buffer stays small and the size limit is checked as it is added.
+func (b *builder) addAdaptive(data []byte) {
+	for len(data) > 0 && b.err == nil {
+		n := len(data)
+		if n > storedBlockLen {
+			n = storedBlockLen
+		}
+
+		b.addAdaptiveChunk(data[:n])
+		data = data[n:]
+	}
+}
+
+// addAdaptiveChunk adds a single chunk of data in adaptive mode.
+func (b *builder) addAdaptiveChunk(data []byte) {
+	if incompressible(data) {
+		// The compressor must not see data that it did not compress, or
+		// its references would no longer match the output.
+		b.last = flushed
+		b.writeStored(data)
+		return
+	}
+
+	if b.fw == nil {
+		b.fw = flateWriterGet(b.adaptBuf, b.level)
+	} else if b.last != compressed {
+		b.fw.Reset(b.adaptBuf)
+	}
+	b.last = compressed
+
+	b.adaptBuf.Reset()
+	if _, b.err = b.fw.Write(data); b.err != nil {
+		return
+	}
+	if b.err = b.fw.Flush(); b.err != nil {
+		return
+	}
+	b.compressedFlushed = true
+
+	if b.adaptBuf.Len() <= storedLen(len(data)) {
+		if b.reserve(int64(b.adaptBuf.Len())) {
+			_, b.err = b.w.Write(b.adaptBuf.Bytes())
+		}
+		return
+	}
+
+	b.writeStored(data)
+}
+
+// writeStored writes data as stored blocks.
+func (b *builder) writeStored(data []byte) {
+	for len(data) > storedBlockLen && b.err == nil {
+		b.zeroWrite(data[:storedBlockLen])
+		data = data[storedBlockLen:]
+	}
+
+	if b.err == nil {
+		b.zeroWrite(data)
+	}
+}
+
+// storedLen returns the length of n bytes of data written as stored blocks.
+func storedLen(n int) int {
+	blocks := (n + storedBlockLen - 1) / storedBlockLen
+	return n + blocks*storedBlockHeaderLen
+}
+
+// incompressible reports whether data is clearly incompressible, by estimating
+// the entropy of its bytes from a sample of it. Data that is too short for the
+// estimate to be reliable is never judged incompressible.
+func incompressible(data []byte) bool {
+	const (
+		minLen   = 4 << 10
+		chunks   = 16
+		chunkLen = 1 << 10
+
+		// Random bytes have an entropy close to 8 bits per byte, while
+		// base64 encoded data has at most 6.
+		threshold = 7.9
+	)
+
+	if len(data) < minLen {
+		return false
+	}
+
+	var counts [256]int
+	n := 0
+	step := len(data) / chunks
+	for i := 0; i < chunks; i++ {
+		chunk := data[i*step:]
+		if len(chunk) > chunkLen {
+			chunk = chunk[:chunkLen]
+		}
+
+		for _, c := range chunk {
+			counts[c]++
+		}
+		n += len(chunk)
+	}
+
+	var entropy float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(n)
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	return entropy > threshold
+}
@@ -0,0 +1,128 @@
+package gzipbuilder
+
+import (
+	"encoding/base64"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomBytes(n int) []byte {
+	p := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(p)
+	return p
+}
+
+func TestBuilderAdaptive(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+	random := randomBytes(100 << 10)
+	encoded := []byte(base64.StdEncoding.EncodeToString(random[:30<<10]))
+
+	segments := [][]byte{
+		doc[:10<<10],
+		random,
+		doc[10<<10 : 20<<10],
+		encoded,
+		[]byte("x"),
+		random[:100],
+		doc[:10<<10],
+	}
+
+	for level := HuffmanOnly; level <= BestCompression; level++ {
+		var expect []byte
+
+		b := NewBuilder(level)
+		b.Adaptive()
+		for i, seg := range segments {
+			b.AddCompressedData(seg)
+			expect = append(expect, seg...)
+
+			if i == 3 {
+				b.AddUncompressedData([]byte("uncompressed"))
+				expect = append(expect, "uncompressed"...)
+			}
+		}
+
+		out, err := b.Bytes()
+		require.NoError(t, err, "level %d", level)
+		assert.Equal(t, string(expect), decompressBytes(t, out), "level %d", level)
+
+		debugLogf(t, "level %d: %d bytes", level, len(out))
+	}
+}
+
+func TestBuilderAdaptiveRandom(t *testing.T) {
+	for _, n := range []int{100, 10 << 10, 200 << 10} {
+		random := randomBytes(n)
+
+		b := NewBuilder(BestCompression)
+		b.Adaptive()
+		b.AddCompressedData(random)
+		out := b.BytesOrPanic()
+
+		assert.Equal(t, string(random), decompressBytes(t, out))
+		assert.True(t, len(out) <= gzipHeaderLen+storedLen(n)+13,
+			"%d bytes of random data should not be expanded beyond stored blocks: got %d bytes", n, len(out))
+	}
+}
+
+func TestBuilderAdaptiveOptions(t *testing.T) {
+	b := NewBuilder(DefaultCompression)
+	b.Adaptive()
+	b.IndexEvery(1 << 10)
+	assert.EqualError(t, b.Err(), "gzipbuilder: adaptive mode cannot be used with an index")
+
+	b = NewBuilder(DefaultCompression)
+	b.IndexEvery(1 << 10)
+	b.Adaptive()
+	assert.EqualError(t, b.Err(), "gzipbuilder: adaptive mode cannot be used with an index")
+
+	b = NewBuilder(DefaultCompression)
+	b.AddCompressedData([]byte("hello"))
+	b.Adaptive()
+	assert.EqualError(t, b.Err(), "gzipbuilder: setting options must be done before writing")
+
+	b = NewBuilder(DefaultCompression)
+	b.Adaptive()
+	b.Budget(100)
+	assert.True(t, b.TryAddCompressedData([]byte("hello, ")))
+	assert.False(t, b.TryAddCompressedData(randomBytes(1000)))
+	assert.True(t, b.TryAddCompressedData([]byte("world")))
+	assert.Equal(t, "hello, world", decompressBytes(t, b.BytesOrPanic()))
+}
+
+func TestBuilderAdaptiveChunks(t *testing.T) {
+	doc := spliceTestDocument(200 << 10)
+	random := randomBytes(200 << 10)
+
+	data := append(append(append([]byte{}, doc[:100<<10]...), random...), doc[100<<10:]...)
+
+	b := NewBuilder(DefaultCompression)
+	b.Adaptive()
+	b.AddCompressedData(data)
+	out := b.BytesOrPanic()
+	assert.Equal(t, string(data), decompressBytes(t, out))
+
+	const limit = 64 << 10
+	encoded := []byte(base64.StdEncoding.EncodeToString(randomBytes(4 << 20)))
+
+	b = NewBuilder(DefaultCompression)
+	b.Adaptive()
+	b.MaxSize(limit)
+	b.AddCompressedData(encoded)
+	assert.Equal(t, &SizeLimitError{limit}, b.Err())
+	assert.True(t, b.adaptBuf.Cap() <= 4*storedBlockLen,
+		"adaptive buffer should hold a single chunk: got %d bytes", b.adaptBuf.Cap())
+}
+
+func TestIncompressible(t *testing.T) {
+	random := randomBytes(64 << 10)
+
+	assert.True(t, incompressible(random), "random")
+	assert.False(t, incompressible(random[:1<<10]), "short random")
+	assert.False(t, incompressible([]byte(base64.StdEncoding.EncodeToString(random))), "base64")
+	assert.False(t, incompressible(spliceTestDocument(64<<10)), "text")
+	assert.False(t, incompressible(make([]byte, 64<<10)), "zeros")
+}
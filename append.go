@@ -0,0 +1,182 @@
+package gzipbuilder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// NewAppendWriter returns a Writer that appends to the existing GZIP file f,
+// which must hold a single GZIP member. Data added to the Writer continues
+// that member, rather than starting a new one, as zlib's gzappend example
+// does.
+//
+// The file is decoded to find its final block, but is not recompressed. The
+// final block flag is cleared in place, the running checksum and size are
+// restored from the trailer and the Writer overwrites the trailer. Close must
+// be called to write the new trailer; until then the file is not a valid GZIP
+// file.
+func NewAppendWriter(f io.ReadWriteSeeker, level int) (*Writer, error) {
+	if err := validCompressionLevel(level); err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(f, 32<<10)
+	hdrLen, err := readGzipHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	in := newReaderInflater(nil, br)
+
+	var final inflateBlock
+	for !in.final {
+		// Only the window is needed to continue decoding.
+		in.trim(in.pos())
+
+		if final, err = in.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check the trailer and that nothing follows it.
+	off := int64(hdrLen) + (final.endBit+7)/8
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var trailer [8 + 1]byte
+	switch n, err := io.ReadFull(f, trailer[:]); {
+	case n == 8 && err == io.ErrUnexpectedEOF:
+	case n > 8:
+		return nil, errors.New("gzipbuilder: trailing data after GZIP member")
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return nil, io.ErrUnexpectedEOF
+	default:
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(trailer[:4]) != in.crc ||
+		binary.LittleEndian.Uint32(trailer[4:8]) != uint32(in.pos()) {
+		return nil, errors.New("gzipbuilder: checksum or size mismatch")
+	}
+
+	// Clear the final block flag.
+	startOff := int64(hdrLen) + final.startBit/8
+	if err := updateByteAt(f, startOff, func(c byte) byte {
+		return c &^ (1 << uint(final.startBit%8))
+	}); err != nil {
+		return nil, err
+	}
+
+	// If the final block ends mid-byte, end the stream with an empty
+	// stored block to reach a byte boundary.
+	endOff := int64(hdrLen) + final.endBit/8
+	if nbits := uint(final.endBit % 8); nbits > 0 {
+		bw := &bitWriter{w: f}
+		if err := updateByteAt(f, endOff, func(c byte) byte {
+			bw.writeBits(uint64(c)&(1<<nbits-1), nbits)
+			bw.alignStored()
+			return bw.buf[0]
+		}); err != nil {
+			return nil, err
+		}
+
+		bw.buf = bw.buf[1:]
+		if err := bw.flush(); err != nil {
+			return nil, err
+		}
+	} else if _, err := f.Seek(endOff, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	w := NewWriter(f, level)
+	w.last = flushed
+	w.size = uint64(in.pos())
+	w.crc = in.crc
+	return w, nil
+}
+
+// readGzipHeader reads the GZIP header from r and returns its length. Unlike
+// gzipHeaderSize, the header is read as it is parsed, so the FEXTRA, FNAME and
+// FCOMMENT fields may be of any length.
+func readGzipHeader(r *bufio.Reader) (int, error) {
+	var hdr [gzipHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, noEOF(err)
+	}
+	if hdr[0] != 0x1f || hdr[1] != 0x8b || hdr[2] != 8 {
+		return 0, errors.New("gzipbuilder: invalid GZIP header")
+	}
+
+	skip := func(n int) error {
+		if _, err := r.Discard(n); err != nil {
+			return noEOF(err)
+		}
+
+		return nil
+	}
+
+	flags, n := hdr[3], gzipHeaderLen
+	if flags&flagExtra != 0 {
+		var xlen [2]byte
+		if _, err := io.ReadFull(r, xlen[:]); err != nil {
+			return 0, noEOF(err)
+		}
+
+		extra := int(binary.LittleEndian.Uint16(xlen[:]))
+		if err := skip(extra); err != nil {
+			return 0, err
+		}
+		n += 2 + extra
+	}
+	for _, flag := range []byte{flagName, flagComment} {
+		if flags&flag == 0 {
+			continue
+		}
+
+		for {
+			field, err := r.ReadSlice(0)
+			n += len(field)
+			if err == nil {
+				break
+			}
+			if err != bufio.ErrBufferFull {
+				return 0, noEOF(err)
+			}
+		}
+	}
+	if flags&flagHdrCrc != 0 {
+		if err := skip(2); err != nil {
+			return 0, err
+		}
+		n += 2
+	}
+
+	return n, nil
+}
+
+// updateByteAt replaces the byte at off with the result of fn, and leaves f
+// positioned after it.
+func updateByteAt(f io.ReadWriteSeeker, off int64, fn func(byte) byte) error {
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+
+	var b [1]byte
+	if _, err := io.ReadFull(f, b[:]); err != nil {
+		return err
+	}
+	b[0] = fn(b[0])
+
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err := f.Write(b[:])
+	return err
+}
@@ -0,0 +1,173 @@
+package gzipbuilder
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAppendWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gzipbuilder")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	doc := spliceTestDocument(100 << 10)
+
+	for _, initial := range [][]byte{
+		gzipBytes(t, doc, DefaultCompression),
+		gzipBytes(t, nil, BestSpeed),
+		gzipBytes(t, []byte("a"), HuffmanOnly),
+		gzipBytes(t, doc, NoCompression),
+		NewBuilder(BestCompression).BytesOrPanic(),
+	} {
+		name := filepath.Join(dir, "log.gz")
+		require.NoError(t, ioutil.WriteFile(name, initial, 0644))
+
+		expect := decompressBytes(t, initial)
+
+		for i := 0; i < 3; i++ {
+			f, err := os.OpenFile(name, os.O_RDWR, 0)
+			require.NoError(t, err)
+
+			w, err := NewAppendWriter(f, DefaultCompression)
+			require.NoError(t, err, "NewAppendWriter failed")
+
+			w.AddCompressedData([]byte("compressed record\n"))
+			w.AddUncompressedData([]byte("uncompressed record\n"))
+			require.NoError(t, w.Close(), "Close failed")
+			require.NoError(t, f.Close())
+
+			expect += "compressed record\nuncompressed record\n"
+
+			gz, err := ioutil.ReadFile(name)
+			require.NoError(t, err)
+
+			debugLogf(t, "%d:%x", len(gz), gz)
+
+			assert.Equal(t, expect, decompressBytes(t, gz))
+		}
+	}
+}
+
+func TestNewAppendWriterLongHeader(t *testing.T) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, DefaultCompression)
+	require.NoError(t, err)
+	zw.Extra = bytes.Repeat([]byte("x"), 60<<10)
+	zw.Name = "log.txt"
+	zw.Comment = "a comment"
+	zw.Write([]byte("hello, "))
+	require.NoError(t, zw.Close())
+
+	f := &fileBuffer{data: buf.Bytes()}
+	w, err := NewAppendWriter(f, DefaultCompression)
+	require.NoError(t, err, "NewAppendWriter failed")
+
+	w.AddCompressedData([]byte("world"))
+	require.NoError(t, w.Close(), "Close failed")
+
+	zr, err := gzip.NewReader(bytes.NewReader(f.data))
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", string(out))
+	assert.Equal(t, zw.Name, zr.Name)
+}
+
+func TestReadGzipHeader(t *testing.T) {
+	long := bytes.Repeat([]byte("n"), 100<<10)
+
+	hdr := []byte{0x1f, 0x8b, 8, flagExtra | flagName | flagComment | flagHdrCrc, 0, 0, 0, 0, 0, 0xff, 3, 0, 'a', 'b', 'c'}
+	hdr = append(hdr, long...)
+	hdr = append(hdr, 0)
+	hdr = append(hdr, "comment\x00"...)
+	hdr = append(hdr, 0, 0)
+
+	expect, err := gzipHeaderSize(hdr)
+	require.NoError(t, err)
+
+	n, err := readGzipHeader(bufio.NewReaderSize(bytes.NewReader(append(hdr, "data"...)), 16))
+	require.NoError(t, err)
+	assert.Equal(t, expect, n)
+
+	for i := 0; i < len(hdr); i += 1 + i/8 {
+		_, err := readGzipHeader(bufio.NewReaderSize(bytes.NewReader(hdr[:i]), 16))
+		assert.Equal(t, io.ErrUnexpectedEOF, err, "truncated to %d bytes", i)
+	}
+}
+
+// fileBuffer is an in-memory io.ReadWriteSeeker.
+type fileBuffer struct {
+	data []byte
+	off  int
+}
+
+func (f *fileBuffer) Read(p []byte) (int, error) {
+	if f.off >= len(f.data) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data[f.off:])
+	f.off += n
+	return n, nil
+}
+
+func (f *fileBuffer) Write(p []byte) (int, error) {
+	if end := f.off + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+
+	n := copy(f.data[f.off:], p)
+	f.off += n
+	return n, nil
+}
+
+func (f *fileBuffer) Seek(off int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		f.off = int(off)
+	case io.SeekCurrent:
+		f.off += int(off)
+	case io.SeekEnd:
+		f.off = len(f.data) + int(off)
+	}
+
+	return int64(f.off), nil
+}
+
+type memFile struct{ *bytes.Reader }
+
+func (memFile) Write(p []byte) (int, error) { panic("unexpected write") }
+
+func TestNewAppendWriterErrors(t *testing.T) {
+	member := gzipBytes(t, []byte("hello, world"), DefaultCompression)
+
+	bad := append([]byte(nil), member...)
+	bad[len(bad)-5] ^= 0xff
+
+	for _, tc := range []struct {
+		file []byte
+		err  string
+	}{
+		{nil, "unexpected EOF"},
+		{member[:len(member)-1], "unexpected EOF"},
+		{member[:len(member)-10], "unexpected EOF"},
+		{append(member[:len(member):len(member)], member...), "gzipbuilder: trailing data after GZIP member"},
+		{bad, "gzipbuilder: checksum or size mismatch"},
+		{member[3:], "gzipbuilder: invalid GZIP header"},
+	} {
+		_, err := NewAppendWriter(memFile{bytes.NewReader(tc.file)}, DefaultCompression)
+		assert.EqualError(t, err, tc.err)
+	}
+
+	_, err := NewAppendWriter(memFile{bytes.NewReader(member)}, 42)
+	assert.Error(t, err, "invalid compression level")
+}
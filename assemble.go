@@ -0,0 +1,256 @@
+package gzipbuilder
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+// A Token is a literal byte or a back-reference in a block added with
+// AddFixedBlock or AddDynamicBlock.
+type Token struct {
+	// Literal is the byte of a literal, which has a Length of zero.
+	Literal byte
+
+	// Length and Distance describe a back-reference to the Length bytes
+	// that begin Distance bytes before it. Length must be between 3 and
+	// 258 and Distance between 1 and 32768.
+	Length, Distance int
+}
+
+var (
+	errInvalidToken = errors.New("gzipbuilder: invalid back-reference")
+	errTokenDist    = errors.New("gzipbuilder: back-reference distance beyond the available window")
+	errTokenCode    = errors.New("gzipbuilder: token has no Huffman code")
+	errCodeLengths  = errors.New("gzipbuilder: invalid Huffman code lengths")
+)
+
+// AddStoredBlock adds data to the builder as one or more stored blocks.
+//
+// AddStoredBlock, AddFixedBlock and AddDynamicBlock add DEFLATE blocks as they
+// are given, for specialised encoders. Blocks added with AddFixedBlock and
+// AddDynamicBlock may refer back up to 32KiB into the data of the blocks added
+// by these methods since other data was last added or the builder was rolled
+// back. Once any such block has been added, they may also refer back into
+// compressed data immediately before them. They can never refer back to data
+// added with AddUncompressedData, but the data of the blocks themselves must
+// not be secret.
+//
+// Each call leaves the stream byte aligned, with the shortest run of empty
+// blocks where needed.
+func (b *builder) AddStoredBlock(data []byte) {
+	if !b.startBlock() || len(data) == 0 || !b.reserve(int64(storedLen(len(data)))) {
+		return
+	}
+	start := len(b.window)
+	b.window = append(b.window, data...)
+	b.indexBlock(start)
+
+	bw := &bitWriter{w: b.w}
+	for p := data; len(p) > 0; {
+		chunk := p
+		if len(chunk) > storedBlockLen {
+			chunk = chunk[:storedBlockLen]
+		}
+		p = p[len(chunk):]
+
+		bw.storedBlock(chunk)
+	}
+
+	b.endBlock(bw, start)
+}
+
+// AddFixedBlock adds a block holding tokens, coded with the fixed Huffman
+// codes. See AddStoredBlock for the tokens that are allowed.
+func (b *builder) AddFixedBlock(tokens []Token) {
+	if !b.startBlock() {
+		return
+	}
+	start := len(b.window)
+	toks := b.expandTokens(tokens, nil, nil)
+	if b.err != nil {
+		return
+	}
+	b.indexBlock(start)
+
+	bw := &bitWriter{w: b.w}
+	bw.writeBits(1<<1, 3)
+	writeTokens(bw, toks, fixedLitCode, fixedDistCode)
+	bw.alignShort()
+
+	b.endBlock(bw, start)
+}
+
+// AddDynamicBlock adds a block holding tokens, coded with the Huffman codes of
+// the given code lengths. litLens holds the lengths of the literal and length
+// codes, at most 286 with a non-zero length for the end of block code 256,
+// and distLens those of at most 30 distance codes. Both codes must be
+// complete, unless they have a single code, and every token must have a code.
+// See AddStoredBlock for the tokens that are allowed.
+func (b *builder) AddDynamicBlock(litLens, distLens []uint8, tokens []Token) {
+	if !b.startBlock() {
+		return
+	}
+	if len(litLens) > maxLitCodes || len(distLens) > maxDistCodes {
+		b.err = errCodeLengths
+		return
+	}
+
+	var lits [maxLitCodes]uint8
+	var dists [maxDistCodes]uint8
+	copy(lits[:], litLens)
+	copy(dists[:], distLens)
+	if lits[endBlockSym] == 0 || !validCodeLengths(lits[:]) || !validCodeLengths(dists[:]) {
+		b.err = errCodeLengths
+		return
+	}
+
+	start := len(b.window)
+	toks := b.expandTokens(tokens, lits[:], dists[:])
+	if b.err != nil {
+		return
+	}
+	b.indexBlock(start)
+
+	var lcodes [maxLitCodes]hcode
+	var dcodes [maxDistCodes]hcode
+	assignCodes(lcodes[:], lits[:])
+	assignCodes(dcodes[:], dists[:])
+
+	bw := &bitWriter{w: b.w}
+	bw.writeBits(2<<1, 3)
+	newDynamicHeader(lits[:], dists[:]).write(bw)
+	writeTokens(bw, toks, lcodes[:], dcodes[:])
+	bw.alignShort()
+
+	b.endBlock(bw, start)
+}
+
+// validCodeLengths reports whether lens are the code lengths of a complete
+// Huffman code, or of a single code of length 1, as a decoder requires. An
+// incomplete code is otherwise rejected by compress/flate and zlib.
+func validCodeLengths(lens []uint8) bool {
+	var h huffman
+	for _, l := range lens {
+		if l > maxCodeBits {
+			return false
+		}
+	}
+
+	left := h.init(lens)
+	return left == 0 || left > 0 && h.count[1] == 1 && len(lens)-int(h.count[0]) == 1
+}
+
+// startBlock prepares the builder for a block added by AddStoredBlock,
+// AddFixedBlock or AddDynamicBlock.
+func (b *builder) startBlock() bool {
+	if b.last == start {
+		b.writeHeader()
+	}
+	if !b.canWrite() || !b.flushCompressed() {
+		return false
+	}
+
+	switch b.last {
+	case assembled:
+	case compressed:
+		// The compressed data is already visible to an attacker, so it
+		// may be referred back to as well. It was recorded in window by
+		// recordCompressed if recordWindow was already set, otherwise
+		// window is empty.
+		b.last = assembled
+	default:
+		b.window = b.window[:0]
+		b.last = assembled
+	}
+	b.recordWindow = true
+
+	b.trimWindow()
+	return true
+}
+
+// recordCompressed appends the end of data, which is about to be compressed,
+// to window, so that blocks added after it may refer back to it. A run of
+// compressed data refers back to nothing before it, so window is first reset
+// if the run begins with data. Nothing is recorded until a block has been
+// added by startBlock, so that compression does not pay for it otherwise.
+func (b *builder) recordCompressed(data []byte) {
+	if !b.recordWindow {
+		return
+	}
+	if b.last != compressed {
+		b.window = b.window[:0]
+	}
+	if len(data) > windowSize {
+		data = data[len(data)-windowSize:]
+	}
+
+	b.window = append(b.window, data...)
+	b.trimWindow()
+}
+
+// trimWindow discards the data of window that can no longer be referred back
+// to, once it is long enough to be worth doing so.
+func (b *builder) trimWindow() {
+	if len(b.window) > 2*windowSize {
+		n := copy(b.window, b.window[len(b.window)-windowSize:])
+		b.window = b.window[:n]
+	}
+}
+
+// expandTokens checks tokens, appends the data they hold to window and returns
+// them as a block's tokens. If litLens and distLens are non-nil, each token
+// must have a code in them.
+func (b *builder) expandTokens(tokens []Token, litLens, distLens []uint8) []token {
+	toks := make([]token, len(tokens))
+	for i, t := range tokens {
+		if t.Length == 0 {
+			if litLens != nil && litLens[t.Literal] == 0 {
+				b.err = errTokenCode
+				return nil
+			}
+
+			toks[i] = literal(t.Literal)
+			b.window = append(b.window, t.Literal)
+			continue
+		}
+
+		switch {
+		case t.Length < minMatch || t.Length > maxMatch || t.Distance < 1 || t.Distance > windowSize:
+			b.err = errInvalidToken
+			return nil
+		case t.Distance > len(b.window):
+			b.err = errTokenDist
+			return nil
+		case litLens != nil && (litLens[257+lengthCode(t.Length)] == 0 || distLens[distCode(t.Distance)] == 0):
+			b.err = errTokenCode
+			return nil
+		}
+
+		toks[i] = match(t.Length, t.Distance)
+
+		// The reference may overlap the data it adds, so it is copied a
+		// byte at a time.
+		for n := 0; n < t.Length; n++ {
+			b.window = append(b.window, b.window[len(b.window)-t.Distance])
+		}
+	}
+
+	return toks
+}
+
+// endBlock writes the block held by bw and accounts for its data, which begins
+// at start in window.
+func (b *builder) endBlock(bw *bitWriter, start int) {
+	if b.err = bw.flush(); b.err != nil {
+		return
+	}
+
+	data := b.window[start:]
+	if !b.rawDeflate {
+		b.size += uint64(len(data))
+		b.crc = crc32.Update(b.crc, crc32.IEEETable, data)
+	}
+	if b.uncompressedDigest != nil {
+		b.uncompressedDigest.Write(data)
+	}
+}
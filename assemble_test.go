@@ -0,0 +1,279 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func literalTokens(s string) []Token {
+	tokens := make([]Token, len(s))
+	for i := range tokens {
+		tokens[i].Literal = s[i]
+	}
+	return tokens
+}
+
+// testCodeLengths returns the code lengths of a dynamic block with codes for
+// the literals a and b, the end of block, a back-reference of length 3 and a
+// distance of 1.
+func testCodeLengths() (litLens, distLens []uint8) {
+	litLens = make([]uint8, 258)
+	litLens['a'], litLens['b'], litLens[endBlockSym], litLens[257] = 2, 2, 2, 2
+	return litLens, []uint8{1}
+}
+
+func TestAssembledBlocks(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+	litLens, distLens := testCodeLengths()
+
+	add := func(b *builder) {
+		b.AddStoredBlock(doc[:80<<10])
+		b.AddFixedBlock(append(literalTokens("hello"),
+			Token{Length: 258, Distance: 5},
+			Token{Length: 100, Distance: 32 << 10},
+		))
+		b.AddDynamicBlock(litLens, distLens, append(literalTokens("ab"),
+			Token{Length: 3, Distance: 1},
+			Token{Literal: 'a'},
+		))
+		b.AddCompressedData([]byte(" compressed "))
+		b.AddFixedBlock(append(literalTokens("fixed"), Token{Length: 11, Distance: 17}))
+		b.AddUncompressedData([]byte(" uncompressed "))
+		b.AddStoredBlock([]byte("stored"))
+	}
+
+	hello := bytes.Repeat([]byte("hello"), 53)[:263]
+	expect := string(doc[:80<<10]) + string(hello) + string(doc[48<<10+263:][:100]) +
+		"abbbba compressed fixed compressed uncompressed stored"
+
+	for _, useWriter := range []bool{false, true} {
+		h := sha256.New()
+
+		var out []byte
+		if useWriter {
+			var buf bytes.Buffer
+			w := NewWriter(&buf, DefaultCompression)
+			w.UncompressedDigest(h)
+			add(&w.builder)
+			require.NoError(t, w.Close())
+			out = buf.Bytes()
+		} else {
+			b := NewBuilder(DefaultCompression)
+			b.UncompressedDigest(h)
+			add(&b.builder)
+			out = b.BytesOrPanic()
+		}
+
+		assert.Equal(t, expect, decompressBytes(t, out), "writer=%t", useWriter)
+
+		sum := sha256.Sum256([]byte(expect))
+		assert.Equal(t, sum[:], h.Sum(nil), "writer=%t", useWriter)
+	}
+}
+
+func TestAssembledBlocksRawDeflate(t *testing.T) {
+	b := NewBuilder(DefaultCompression)
+	b.RawDeflate()
+	b.AddStoredBlock([]byte("hello"))
+	b.AddFixedBlock([]Token{{Length: 10, Distance: 5}})
+
+	assert.Equal(t, "hellohellohello", decompressFlateBytes(t, b.BytesOrPanic()))
+}
+
+func TestAssembledBlocksIndex(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+
+	b := NewBuilder(DefaultCompression)
+	b.IndexEvery(8 << 10)
+
+	var expect []byte
+	for i := 0; i < 100; i++ {
+		p := doc[i<<10 : (i+1)<<10]
+		expect = append(expect, p...)
+		b.AddStoredBlock(p)
+
+		expect = append(expect, expect[len(expect)-1000:][:258]...)
+		b.AddFixedBlock([]Token{{Length: 258, Distance: 1000}})
+	}
+	out := b.BytesOrPanic()
+
+	require.Equal(t, string(expect), decompressBytes(t, out))
+	assert.True(t, len(b.Index().Points) > 10)
+
+	r := NewIndexedReader(bytes.NewReader(out), b.Index())
+	for off := int64(0); off+100 <= int64(len(expect)); off += 5 << 10 {
+		p := make([]byte, 100)
+		_, err := r.ReadAt(p, off)
+		require.NoError(t, err)
+		assert.Equal(t, expect[off:off+100], p, "at offset %d", off)
+	}
+}
+
+func TestAssembledBlocksCheckpoint(t *testing.T) {
+	b := NewBuilder(DefaultCompression)
+	b.AddStoredBlock([]byte("hello"))
+	cp := b.Checkpoint()
+	b.AddFixedBlock(literalTokens(" world"))
+	b.Rollback(cp)
+	b.AddFixedBlock(literalTokens(" there"))
+	assert.Equal(t, "hello there", decompressBytes(t, b.BytesOrPanic()))
+
+	b = NewBuilder(DefaultCompression)
+	b.AddStoredBlock([]byte("hello"))
+	cp = b.Checkpoint()
+	b.Rollback(cp)
+	b.AddFixedBlock([]Token{{Length: 5, Distance: 5}})
+	assert.Equal(t, errTokenDist, b.Err(), "rollback should reset the window")
+}
+
+func TestAssembledBlocksSingleCode(t *testing.T) {
+	// A code with a single symbol must have length 1, and a block without
+	// back-references may have no distance codes at all.
+	lens := make([]uint8, endBlockSym+1)
+	lens[endBlockSym] = 1
+
+	b := NewBuilder(DefaultCompression)
+	b.AddStoredBlock([]byte("abc"))
+	b.AddDynamicBlock(lens, nil, nil)
+	b.AddDynamicBlock(lens, []uint8{0, 0}, nil)
+
+	litLens, _ := testCodeLengths()
+	b.AddDynamicBlock(litLens, []uint8{1}, []Token{{Literal: 'a'}, {Length: 3, Distance: 1}})
+	b.AddDynamicBlock(litLens, []uint8{0, 1}, []Token{{Length: 3, Distance: 2}})
+	require.NoError(t, b.Err())
+
+	assert.Equal(t, "abcaaaaaaa", decompressBytes(t, b.BytesOrPanic()))
+}
+
+func TestAssembledBlocksErrors(t *testing.T) {
+	litLens, distLens := testCodeLengths()
+
+	tests := map[string]struct {
+		add func(b *Builder)
+		err error
+	}{
+		"short back-reference": {
+			func(b *Builder) { b.AddFixedBlock([]Token{{Literal: 'a'}, {Length: 2, Distance: 1}}) },
+			errInvalidToken,
+		},
+		"long back-reference": {
+			func(b *Builder) { b.AddFixedBlock([]Token{{Literal: 'a'}, {Length: 259, Distance: 1}}) },
+			errInvalidToken,
+		},
+		"zero distance": {
+			func(b *Builder) { b.AddFixedBlock([]Token{{Literal: 'a'}, {Length: 3}}) },
+			errInvalidToken,
+		},
+		"far distance": {
+			func(b *Builder) {
+				b.AddStoredBlock(make([]byte, 64<<10))
+				b.AddFixedBlock([]Token{{Length: 3, Distance: 32<<10 + 1}})
+			},
+			errInvalidToken,
+		},
+		"before start": {
+			func(b *Builder) { b.AddFixedBlock([]Token{{Literal: 'a'}, {Length: 3, Distance: 2}}) },
+			errTokenDist,
+		},
+		"compressed first": {
+			func(b *Builder) {
+				b.AddCompressedData([]byte("abc"))
+				b.AddFixedBlock([]Token{{Length: 3, Distance: 3}})
+			},
+			errTokenDist,
+		},
+		"uncompressed": {
+			func(b *Builder) {
+				b.AddStoredBlock([]byte("abc"))
+				b.AddUncompressedData([]byte("secret"))
+				b.AddFixedBlock([]Token{{Length: 3, Distance: 3}})
+			},
+			errTokenDist,
+		},
+		"precompressed": {
+			func(b *Builder) {
+				b.AddPrecompressedData(MustPrecompressedData(PrecompressData([]byte("abc"), DefaultCompression)))
+				b.AddFixedBlock([]Token{{Length: 3, Distance: 3}})
+			},
+			errTokenDist,
+		},
+		"no literal code": {
+			func(b *Builder) { b.AddDynamicBlock(litLens, distLens, literalTokens("abc")) },
+			errTokenCode,
+		},
+		"no length code": {
+			func(b *Builder) {
+				b.AddDynamicBlock(litLens, distLens, append(literalTokens("a"), Token{Length: 4, Distance: 1}))
+			},
+			errTokenCode,
+		},
+		"no distance code": {
+			func(b *Builder) {
+				b.AddDynamicBlock(litLens, distLens, append(literalTokens("ab"), Token{Length: 3, Distance: 2}))
+			},
+			errTokenCode,
+		},
+		"no end of block": {
+			func(b *Builder) {
+				lens := append([]uint8(nil), litLens...)
+				lens[endBlockSym], lens['c'] = 0, 2
+				b.AddDynamicBlock(lens, distLens, nil)
+			},
+			errCodeLengths,
+		},
+		"incomplete": {
+			func(b *Builder) {
+				lens := append([]uint8(nil), litLens...)
+				lens['a'] = 3
+				b.AddDynamicBlock(lens, distLens, nil)
+			},
+			errCodeLengths,
+		},
+		"over-subscribed": {
+			func(b *Builder) {
+				lens := append([]uint8(nil), litLens...)
+				lens['c'] = 2
+				b.AddDynamicBlock(lens, distLens, nil)
+			},
+			errCodeLengths,
+		},
+		"single long code": {
+			func(b *Builder) {
+				lens := make([]uint8, endBlockSym+1)
+				lens[endBlockSym] = 5
+				b.AddDynamicBlock(lens, nil, nil)
+			},
+			errCodeLengths,
+		},
+		"single long distance": {
+			func(b *Builder) { b.AddDynamicBlock(litLens, []uint8{0, 3}, nil) },
+			errCodeLengths,
+		},
+		"incomplete distances": {
+			func(b *Builder) { b.AddDynamicBlock(litLens, []uint8{2, 2}, nil) },
+			errCodeLengths,
+		},
+		"long code": {
+			func(b *Builder) {
+				lens := append([]uint8(nil), litLens...)
+				lens['a'] = 16
+				b.AddDynamicBlock(lens, distLens, nil)
+			},
+			errCodeLengths,
+		},
+		"too many lengths": {
+			func(b *Builder) { b.AddDynamicBlock(make([]uint8, 287), distLens, nil) },
+			errCodeLengths,
+		},
+	}
+
+	for name, test := range tests {
+		b := NewBuilder(DefaultCompression)
+		test.add(b)
+		assert.Equal(t, test.err, b.Err(), name)
+	}
+}
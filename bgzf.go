@@ -0,0 +1,292 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+const (
+	// bgzfMaxBlockSize is the maximum size of a BGZF block, including the
+	// GZIP header and trailer.
+	bgzfMaxBlockSize = 1 << 16
+
+	// bgzfMaxUncompressed is the maximum amount of data held by a block.
+	// This matches htslib and keeps virtual offsets within a block below
+	// 1<<16.
+	bgzfMaxUncompressed = 0xff00
+
+	// bgzfMaxCompressed is the maximum size of the compressed data of a
+	// block, leaving room for the header and its BC extra field, the empty
+	// final block and the trailer.
+	bgzfMaxCompressed = bgzfMaxBlockSize - (gzipHeaderLen + 2 + 6) - 5 - 8
+)
+
+// bgzfExtra is the BC subfield that holds the size of the block minus one,
+// which is filled in once the block is complete.
+var bgzfExtra = [...]byte{'B', 'C', 2, 0, 0, 0}
+
+// bgzfEOF is the empty block that marks the end of a BGZF file.
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0xff, 0x06, 0x00, 0x42, 0x43, 0x02, 0x00,
+	0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+}
+
+// compressBound returns an upper bound on the size of n bytes of data after
+// compression and flushing. It allows for compress/flate choosing to Huffman
+// encode incompressible data where that is slightly larger than storing it.
+func compressBound(n int) int {
+	if n == 0 {
+		return 0
+	}
+
+	return n + n>>4 + 5*(n>>14) + 32
+}
+
+// A BGZFWriter writes the blocked GZIP format used by BAM, VCF and other
+// bioinformatics formats that need random access. The output is a series of
+// independent GZIP members, each at most 64KiB long and holding a BC extra
+// field with the size of the member, followed by an empty end of file block.
+//
+// Data is split across blocks as needed, except for precompressed data, which
+// must fit within a single block.
+type BGZFWriter struct {
+	w     io.Writer
+	level int
+
+	buf bytes.Buffer
+	b   *Builder
+
+	// off is the offset of the current block in the output.
+	off uint64
+
+	// ulen is the amount of data in the current block. clen and run
+	// bound the size of the compressed data of the block, where run is the
+	// length of the trailing run of compressed data.
+	ulen int
+	clen int
+	run  int
+
+	closed bool
+
+	err error
+}
+
+// NewBGZFWriter creates a BGZFWriter using the given compression level. Data
+// is written to w.
+func NewBGZFWriter(w io.Writer, level int) *BGZFWriter {
+	return &BGZFWriter{
+		w:     w,
+		level: level,
+
+		err: validCompressionLevel(level),
+	}
+}
+
+// VirtualOffset returns the BGZF virtual file offset of the next byte to be
+// added. This is the offset of the block in the file shifted left by 16, with
+// the offset within the block's data in the lower 16 bits.
+func (w *BGZFWriter) VirtualOffset() uint64 {
+	return w.off<<16 | uint64(w.ulen)
+}
+
+func (w *BGZFWriter) canWrite() bool {
+	if w.closed && w.err == nil {
+		w.err = errors.New("gzipbuilder: cannot add data to BGZFWriter after close")
+	}
+
+	return w.err == nil
+}
+
+func (w *BGZFWriter) block() *Builder {
+	if w.b == nil {
+		w.buf.Reset()
+		w.b = &Builder{newBuilder(&w.buf, w.level)}
+		w.b.extra = bgzfExtra[:]
+	}
+
+	return w.b
+}
+
+// endRun accounts for the compressed run ending.
+func (w *BGZFWriter) endRun() {
+	w.clen += compressBound(w.run)
+	w.run = 0
+}
+
+// AddCompressedData compresses data and adds it to the BGZFWriter.
+//
+// Note: AddCompressedData is vulnerable to exploits such as BREACH when used
+// with secret data.
+func (w *BGZFWriter) AddCompressedData(data []byte) {
+	if !w.canWrite() {
+		return
+	}
+
+	for len(data) > 0 && w.err == nil {
+		max := bgzfMaxUncompressed - w.ulen
+		if max > len(data) {
+			max = len(data)
+		}
+
+		n := sort.Search(max+1, func(n int) bool {
+			return w.clen+compressBound(w.run+n) > bgzfMaxCompressed
+		}) - 1
+		if n <= 0 {
+			w.Flush()
+			continue
+		}
+
+		w.block().AddCompressedData(data[:n])
+		w.err = w.b.Err()
+		w.ulen += n
+		w.run += n
+		data = data[n:]
+
+		if w.ulen == bgzfMaxUncompressed {
+			w.Flush()
+		}
+	}
+}
+
+// AddUncompressedData adds data to the BGZFWriter without compressing it.
+//
+// Note: AddUncompressedData should be used to add secret data to the stream,
+// such as authentication cookies, as it is immune to exploits such as BREACH.
+func (w *BGZFWriter) AddUncompressedData(data []byte) {
+	if !w.canWrite() {
+		return
+	}
+	w.endRun()
+
+	for len(data) > 0 && w.err == nil {
+		// Each addition costs at most a stored block header.
+		n := bgzfMaxCompressed - w.clen - 5
+		if max := bgzfMaxUncompressed - w.ulen; n > max {
+			n = max
+		}
+		if n > len(data) {
+			n = len(data)
+		}
+		if n <= 0 {
+			w.Flush()
+			continue
+		}
+
+		w.block().AddUncompressedData(data[:n])
+		w.err = w.b.Err()
+		w.ulen += n
+		w.clen += n + 5
+		data = data[n:]
+
+		if w.ulen == bgzfMaxUncompressed {
+			w.Flush()
+		}
+	}
+}
+
+// AddPrecompressedData adds data that was precompressed to the BGZFWriter.
+//
+// The PrecompressedData must have been created with the same compression level
+// as the BGZFWriter and must fit within a single block, that is it must hold
+// at most 65280 bytes and compress to less than 64KiB. If it does not fit in
+// the current block, a new block is started.
+func (w *BGZFWriter) AddPrecompressedData(data *PrecompressedData) {
+	if !w.canWrite() {
+		return
+	}
+
+	n := len(data.bytes)
+	if data.src != nil {
+		n = int(data.src.Size())
+	}
+	if data.final {
+		w.err = errFinalData
+		return
+	}
+	if data.prefix != nil {
+		w.err = errSuffixData
+		return
+	}
+	if data.size > bgzfMaxUncompressed || n > bgzfMaxCompressed {
+		w.err = errors.New("gzipbuilder: precompressed data too large for BGZF block")
+		return
+	}
+
+	w.endRun()
+	if w.ulen+int(data.size) > bgzfMaxUncompressed || w.clen+n > bgzfMaxCompressed {
+		w.Flush()
+	}
+
+	w.block().AddPrecompressedData(data)
+	if w.err = w.b.Err(); w.err != nil {
+		return
+	}
+	w.ulen += int(data.size)
+	w.clen += n
+
+	if w.ulen == bgzfMaxUncompressed {
+		w.Flush()
+	}
+}
+
+// Write implements io.Writer by calling AddCompressedData.
+func (w *BGZFWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.AddCompressedData(p)
+	return len(p), w.err
+}
+
+// Flush ends the current block, if it holds any data, and writes it to the
+// underlying io.Writer. Data added after Flush begins a new block, so that
+// it can be read without decompressing what came before.
+func (w *BGZFWriter) Flush() error {
+	if w.err != nil || w.b == nil {
+		return w.err
+	}
+
+	b := w.b
+	w.b = nil
+	if w.ulen == 0 {
+		return nil
+	}
+
+	p, err := b.Bytes()
+	if err != nil {
+		w.err = err
+		return err
+	}
+	if len(p) > bgzfMaxBlockSize {
+		w.err = errors.New("gzipbuilder: BGZF block too large")
+		return w.err
+	}
+
+	binary.LittleEndian.PutUint16(p[gzipHeaderLen+2+4:], uint16(len(p)-1))
+	if _, w.err = w.w.Write(p); w.err != nil {
+		return w.err
+	}
+
+	w.off += uint64(len(p))
+	w.ulen, w.clen, w.run = 0, 0, 0
+	return nil
+}
+
+// Close flushes any unwritten data to the underlying io.Writer and writes the
+// end of file block. It returns an error if one has occurred during building.
+// It does not close the underlying io.Writer.
+func (w *BGZFWriter) Close() error {
+	if w.closed || w.Flush() != nil {
+		return w.err
+	}
+	w.closed = true
+
+	_, w.err = w.w.Write(bgzfEOF)
+	return w.err
+}
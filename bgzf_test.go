@@ -0,0 +1,150 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readBGZFBlock returns the data of the BGZF block at off and the offset of
+// the next block.
+func readBGZFBlock(t *testing.T, p []byte, off uint64) ([]byte, uint64) {
+	t.Helper()
+
+	blk := p[off:]
+	require.True(t, len(blk) >= 18, "truncated block at %d", off)
+	require.Equal(t, []byte{0x1f, 0x8b, 0x08, 0x04}, blk[:4], "invalid header at %d", off)
+	require.Equal(t, []byte{6, 0, 'B', 'C', 2, 0}, blk[10:16], "invalid extra field at %d", off)
+
+	size := int(binary.LittleEndian.Uint16(blk[16:])) + 1
+	require.True(t, len(blk) >= size, "truncated block at %d", off)
+
+	zr, err := gzip.NewReader(bytes.NewReader(blk[:size]))
+	require.NoError(t, err)
+	zr.Multistream(false)
+
+	data, err := ioutil.ReadAll(zr)
+	require.NoError(t, err, "invalid block at %d", off)
+	return data, off + uint64(size)
+}
+
+func TestBGZFWriter(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	random := make([]byte, 100<<10)
+	r.Read(random)
+
+	precomp, err := PrecompressData([]byte("precompressed record\n"), DefaultCompression)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := NewBGZFWriter(&buf, DefaultCompression)
+
+	var (
+		expect  []byte
+		records [][]byte
+		offsets []uint64
+	)
+	for i := 0; i < 2000; i++ {
+		offsets = append(offsets, w.VirtualOffset())
+
+		var rec []byte
+		switch i % 5 {
+		case 0:
+			rec = []byte(fmt.Sprintf("compressed record %d\n", i))
+			w.AddCompressedData(rec)
+		case 1:
+			rec = []byte(fmt.Sprintf("uncompressed record %d\n", i))
+			w.AddUncompressedData(rec)
+		case 2:
+			rec = []byte("precompressed record\n")
+			w.AddPrecompressedData(precomp)
+		case 3:
+			rec = random[:r.Intn(len(random))]
+			_, err := w.Write(rec)
+			require.NoError(t, err)
+		case 4:
+			rec = bytes.Repeat([]byte{'x'}, r.Intn(100<<10))
+			w.AddUncompressedData(rec)
+		}
+
+		records = append(records, rec)
+		expect = append(expect, rec...)
+	}
+	require.NoError(t, w.Close(), "Close failed")
+	require.NoError(t, w.Close(), "second Close failed")
+
+	out := buf.Bytes()
+	assert.Equal(t, bgzfEOF, out[len(out)-len(bgzfEOF):], "missing EOF block")
+	assert.Equal(t, string(expect), decompressBytes(t, out))
+
+	// Every block is independent.
+	blocks := make(map[uint64][]byte)
+	for off := uint64(0); off < uint64(len(out)); {
+		data, next := readBGZFBlock(t, out, off)
+		assert.True(t, len(data) <= bgzfMaxUncompressed, "block at %d too large", off)
+		assert.True(t, next-off <= bgzfMaxBlockSize, "block at %d too large", off)
+
+		blocks[off] = data
+		off = next
+	}
+
+	// Each virtual offset points to the start of its record.
+	for i, voff := range offsets {
+		data, ok := blocks[voff>>16]
+		require.True(t, ok, "record %d: no block at %d", i, voff>>16)
+
+		data = data[voff&0xffff:]
+		if len(data) > len(records[i]) {
+			data = data[:len(records[i])]
+		}
+		require.Equal(t, records[i][:len(data)], data, "record %d", i)
+	}
+
+	w.AddCompressedData([]byte("x"))
+	assert.EqualError(t, w.Close(), "gzipbuilder: cannot add data to BGZFWriter after close")
+}
+
+func TestBGZFWriterFlush(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewBGZFWriter(&buf, BestSpeed)
+	w.AddCompressedData([]byte("hello"))
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Flush())
+
+	assert.Equal(t, uint64(buf.Len())<<16, w.VirtualOffset())
+
+	w.AddCompressedData([]byte("world"))
+	require.NoError(t, w.Close())
+
+	data, next := readBGZFBlock(t, buf.Bytes(), 0)
+	assert.Equal(t, "hello", string(data))
+	data, _ = readBGZFBlock(t, buf.Bytes(), next)
+	assert.Equal(t, "world", string(data))
+}
+
+func TestBGZFWriterErrors(t *testing.T) {
+	large, err := PrecompressData(make([]byte, bgzfMaxUncompressed+1), DefaultCompression)
+	require.NoError(t, err)
+
+	w := NewBGZFWriter(ioutil.Discard, DefaultCompression)
+	w.AddPrecompressedData(large)
+	assert.EqualError(t, w.Close(), "gzipbuilder: precompressed data too large for BGZF block")
+
+	small, err := PrecompressData([]byte("x"), BestSpeed)
+	require.NoError(t, err)
+
+	w = NewBGZFWriter(ioutil.Discard, DefaultCompression)
+	w.AddPrecompressedData(small)
+	assert.EqualError(t, w.Close(), "gzipbuilder: compression level mismatch")
+
+	w = NewBGZFWriter(ioutil.Discard, 42)
+	assert.Error(t, w.Close(), "invalid compression level")
+}
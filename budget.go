@@ -0,0 +1,185 @@
+package gzipbuilder
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A SizeLimitError is the error that occurs when the output of a builder
+// exceeds the limit set with MaxSize.
+type SizeLimitError struct {
+	Limit int64
+}
+
+func (e *SizeLimitError) Error() string {
+	return fmt.Sprintf("gzipbuilder: output exceeds size limit of %d bytes", e.Limit)
+}
+
+// MaxSize sets the maximum size of the output of the builder. Once the output
+// would exceed n bytes, building fails with a *SizeLimitError, so that a
+// runaway response fails rather than exhausting memory.
+//
+// Stored and pre-compressed data is checked before it is written, so it never
+// takes the output past n. Compressed data is checked as it is compressed, so
+// the output may exceed n by at most one compressed block before building
+// fails.
+func (b *builder) MaxSize(n int64) {
+	if !b.canSetOption() {
+		return
+	}
+
+	switch {
+	case n <= 0:
+		b.err = errors.New("gzipbuilder: size limit must be positive")
+	case !b.canTrackOffset():
+		b.err = errors.New("gzipbuilder: size limit not supported")
+	default:
+		b.maxSize = n
+	}
+}
+
+func (b *builder) checkSize() {
+	if b.maxSize > 0 && b.err == nil && b.offset() > b.maxSize {
+		b.err = &SizeLimitError{b.maxSize}
+	}
+}
+
+// reserve reports whether n more bytes of output fit within the size limit,
+// if any. If they do not, building fails with a *SizeLimitError.
+func (b *builder) reserve(n int64) bool {
+	if b.maxSize > 0 && b.err == nil && b.offset()+n > b.maxSize {
+		b.err = &SizeLimitError{b.maxSize}
+	}
+
+	return b.err == nil
+}
+
+// sizeCheckChunk is the amount of data compressed between checks of the size
+// limit.
+const sizeCheckChunk = 16 << 10
+
+// compress writes data to the compressor. If a size limit is set, data is
+// written in chunks and the limit is checked after each, so that a single
+// large call cannot grow the output without bound.
+func (b *builder) compress(data []byte) {
+	if b.maxSize == 0 {
+		_, b.err = b.fw.Write(data)
+		return
+	}
+
+	for len(data) > 0 && b.err == nil {
+		n := len(data)
+		if n > sizeCheckChunk {
+			n = sizeCheckChunk
+		}
+
+		if _, b.err = b.fw.Write(data[:n]); b.err == nil {
+			b.checkSize()
+		}
+		data = data[n:]
+	}
+}
+
+// endLen returns the number of bytes that ending the stream adds, including
+// the header if it has not yet been written, once the compressor has been
+// flushed.
+func (b *builder) endLen() int64 {
+	footer := int64(len(closeFooter))
+	if b.last == final {
+		footer = 0
+	}
+	if b.rawDeflate {
+		return footer
+	}
+
+	n := footer + 8
+	if b.last == start {
+		n += gzipHeaderLen
+		if b.extra != nil {
+			n += 2 + int64(len(b.extra))
+		}
+	}
+
+	return n
+}
+
+// Budget sets the size, in bytes, that the complete GZIP output must fit
+// within when data is added with the TryAdd methods. Data added with the
+// other methods is not limited by the budget, but does count towards it.
+//
+// A budget of ~14KiB allows the compressed output to be sent within the
+// initial congestion window of a TCP connection.
+func (b *Builder) Budget(n int64) {
+	if !b.canSetOption() {
+		return
+	}
+
+	if n <= 0 {
+		b.err = errors.New("gzipbuilder: budget must be positive")
+		return
+	}
+
+	b.budget = n
+}
+
+// Remaining returns the number of bytes of the budget that remain once the
+// stream is ended. It is negative if the budget has been exceeded and is zero
+// if no budget was set. It is exact after a TryAdd method, but does not count
+// data held by the compressor after AddCompressedData.
+func (b *Builder) Remaining() int64 {
+	if b.budget == 0 {
+		return 0
+	}
+
+	return b.budget - b.offset() - b.endLen()
+}
+
+// tryAdd calls add and reports whether the output fits within the budget. If
+// it does not, the data is removed again with Rollback, leaving the output
+// valid.
+//
+// The compressor is flushed after add so that the size of the output is
+// exact. This costs a few bytes, but the compressor keeps its history.
+func (b *Builder) tryAdd(add func()) bool {
+	cp := b.Checkpoint()
+	if b.err != nil {
+		return false
+	}
+
+	add()
+	if b.last == compressed && !b.compressedFlushed && b.err == nil {
+		b.err = b.fw.Flush()
+		b.compressedFlushed = true
+	}
+	if b.err != nil {
+		return false
+	}
+
+	if b.budget == 0 || b.Remaining() >= 0 {
+		return true
+	}
+
+	b.Rollback(cp)
+	return false
+}
+
+// TryAddCompressedData is like AddCompressedData, but only adds data if the
+// output fits within the budget. It reports whether data was added.
+//
+// Note: TryAddCompressedData is vulnerable to exploits such as BREACH when
+// used with secret data.
+func (b *Builder) TryAddCompressedData(data []byte) bool {
+	return b.tryAdd(func() { b.AddCompressedData(data) })
+}
+
+// TryAddUncompressedData is like AddUncompressedData, but only adds data if
+// the output fits within the budget. It reports whether data was added.
+func (b *Builder) TryAddUncompressedData(data []byte) bool {
+	return b.tryAdd(func() { b.AddUncompressedData(data) })
+}
+
+// TryAddPrecompressedData is like AddPrecompressedData, but only adds data if
+// the output fits within the budget. It reports whether data was added.
+func (b *Builder) TryAddPrecompressedData(data *PrecompressedData) bool {
+	return b.tryAdd(func() { b.AddPrecompressedData(data) })
+}
@@ -0,0 +1,146 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuilderBudget(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+
+	for _, budget := range []int64{100, 1000, 14 << 10, 50 << 10} {
+		b := NewBuilder(DefaultCompression)
+		b.Budget(budget)
+		assert.Equal(t, budget-gzipHeaderLen-13, b.Remaining())
+
+		var expect []byte
+		for i, off := 0, 0; off < len(doc); i++ {
+			n := 100 + i*37%2000
+			if off+n > len(doc) {
+				n = len(doc) - off
+			}
+			seg := doc[off : off+n]
+			off += n
+
+			var added bool
+			switch i % 3 {
+			case 0:
+				added = b.TryAddCompressedData(seg)
+			case 1:
+				added = b.TryAddUncompressedData(seg)
+			case 2:
+				added = b.TryAddPrecompressedData(MustPrecompressedData(PrecompressData(seg, DefaultCompression)))
+			}
+			require.NoError(t, b.Err())
+
+			if added {
+				expect = append(expect, seg...)
+			}
+			assert.True(t, b.Remaining() >= 0, "budget=%d", budget)
+		}
+
+		remaining := b.Remaining()
+		out := b.BytesOrPanic()
+		assert.Equal(t, budget-remaining, int64(len(out)), "budget=%d: Remaining is exact", budget)
+		assert.Equal(t, string(expect), decompressBytes(t, out), "budget=%d", budget)
+
+		debugLogf(t, "budget=%d: %d bytes of content in %d bytes", budget, len(expect), len(out))
+	}
+}
+
+func TestBuilderBudgetReject(t *testing.T) {
+	b := NewBuilder(DefaultCompression)
+	b.Budget(100)
+
+	assert.True(t, b.TryAddCompressedData([]byte("hello, ")))
+	assert.False(t, b.TryAddUncompressedData(bytes.Repeat([]byte("x"), 100)))
+	assert.True(t, b.TryAddCompressedData([]byte("world")))
+	assert.False(t, b.TryAddCompressedData(spliceTestDocument(10<<10)))
+
+	out := b.BytesOrPanic()
+	assert.True(t, len(out) <= 100)
+	assert.Equal(t, "hello, world", decompressBytes(t, out))
+}
+
+func TestBuilderBudgetErrors(t *testing.T) {
+	b := NewBuilder(DefaultCompression)
+	b.Budget(0)
+	assert.EqualError(t, b.Err(), "gzipbuilder: budget must be positive")
+
+	b = NewBuilder(DefaultCompression)
+	assert.Equal(t, int64(0), b.Remaining())
+	assert.True(t, b.TryAddCompressedData([]byte("no budget")))
+
+	assert.False(t, b.TryAddPrecompressedData(MustPrecompressedData(PrecompressData([]byte("a"), BestSpeed))))
+	assert.EqualError(t, b.Err(), "gzipbuilder: compression level mismatch")
+}
+
+func TestBuilderMaxSize(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+
+	b := NewBuilder(DefaultCompression)
+	b.MaxSize(1 << 10)
+	for i := 0; i < 10 && b.Err() == nil; i++ {
+		b.AddUncompressedData(doc[:200])
+	}
+
+	_, err := b.Bytes()
+	require.Error(t, err)
+	assert.Equal(t, &SizeLimitError{1 << 10}, err)
+	assert.EqualError(t, err, "gzipbuilder: output exceeds size limit of 1024 bytes")
+
+	w := NewWriter(ioutil.Discard, DefaultCompression)
+	w.MaxSize(1 << 10)
+	w.AddUncompressedData(doc)
+	assert.IsType(t, &SizeLimitError{}, w.Close())
+
+	b = NewBuilder(DefaultCompression)
+	b.MaxSize(1 << 10)
+	b.AddCompressedData([]byte("hello"))
+	assert.NoError(t, b.Err())
+	assert.Equal(t, "hello", decompressBytes(t, b.BytesOrPanic()))
+
+	b = NewBuilder(DefaultCompression)
+	b.MaxSize(0)
+	assert.EqualError(t, b.Err(), "gzipbuilder: size limit must be positive")
+}
+
+func TestBuilderMaxSizeSingleCall(t *testing.T) {
+	const limit = 64 << 10
+	data := randomBytes(4 << 20)
+	pd := MustPrecompressedData(PrecompressData(data, DefaultCompression))
+
+	for _, tc := range []struct {
+		name string
+		add  func(b *Builder)
+		over int
+	}{
+		{"uncompressed", func(b *Builder) { b.AddUncompressedData(data) }, 0},
+		{"precompressed", func(b *Builder) { b.AddPrecompressedData(pd) }, 0},
+		{"stored block", func(b *Builder) { b.AddStoredBlock(data) }, 0},
+		{"compressed", func(b *Builder) { b.AddCompressedData(data) }, 2 * sizeCheckChunk},
+		{"adaptive", func(b *Builder) {
+			b.Adaptive()
+			b.AddCompressedData(data)
+		}, 0},
+	} {
+		b := NewBuilder(DefaultCompression)
+		b.MaxSize(limit)
+		tc.add(b)
+
+		assert.Equal(t, &SizeLimitError{limit}, b.Err(), tc.name)
+		assert.True(t, b.w.(*bytes.Buffer).Len() <= limit+tc.over,
+			"%s: buffered %d bytes", tc.name, b.w.(*bytes.Buffer).Len())
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, DefaultCompression)
+	w.MaxSize(limit)
+	w.AddUncompressedData(data)
+	assert.IsType(t, &SizeLimitError{}, w.Close())
+	assert.True(t, buf.Len() <= limit, "wrote %d bytes", buf.Len())
+}
@@ -2,7 +2,8 @@
 //
 // The compression level taken throughout this package can be
 // DefaultCompression, NoCompression, HuffmanOnly or any integer value between
-// BestSpeed and BestCompression inclusive.
+// BestSpeed and BestCompression inclusive. Where data is only precompressed, it
+// can also be ExhaustiveCompression.
 package gzipbuilder
 
 import (
@@ -12,6 +13,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
 	"sync"
@@ -19,6 +21,9 @@ import (
 
 const packUncompressedData = true
 
+// gzipHeaderLen is the length of the GZIP header written by writeHeader.
+const gzipHeaderLen = 10
+
 var (
 	// closeFooter is a zero-length type 0 block, w/ final block flag.
 	closeFooter = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
@@ -27,6 +32,8 @@ var (
 
 	flateWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
 
+	encoderPools [BestCompression - HuffmanOnly + 1]sync.Pool
+
 	bufioWriterPool = &sync.Pool{
 		New: func() interface{} {
 			return bufio.NewWriterSize(nil, 1024)
@@ -52,6 +59,48 @@ func flateWriterPut(fw *flate.Writer, level int) {
 	flateWriterPool(level).Put(fw)
 }
 
+func encoderPool(level int) *sync.Pool {
+	return &encoderPools[level-HuffmanOnly]
+}
+
+func encoderGet(w io.Writer, level int) *encoder {
+	if fw, ok := encoderPool(level).Get().(*encoder); ok {
+		fw.Reset(w)
+		return fw
+	}
+
+	fw, _ := newEncoder(w, level)
+	return fw
+}
+
+func encoderPut(fw *encoder, level int) {
+	encoderPool(level).Put(fw)
+}
+
+// A deflater compresses the data written to it into a DEFLATE stream. It is
+// implemented by flate.Writer and by encoder.
+type deflater interface {
+	io.Writer
+	Flush() error
+	Close() error
+	Reset(w io.Writer)
+}
+
+// newDeflater returns a flate.Writer, except at ExhaustiveCompression which
+// only encoder supports.
+func newDeflater(w io.Writer, level int) (deflater, error) {
+	if level == ExhaustiveCompression {
+		return newEncoder(w, level)
+	}
+
+	fw, err := flate.NewWriter(w, level)
+	if err != nil {
+		return nil, err
+	}
+
+	return fw, nil
+}
+
 // These constants are copied from the flate package, so that code that imports
 // this package does not also have to import "compress/flate".
 const (
@@ -79,6 +128,9 @@ const (
 	precompressed
 	compressed
 	uncompressed
+	assembled
+	flushed
+	final
 	finished
 )
 
@@ -89,13 +141,65 @@ type builder struct {
 
 	rawDeflate bool
 
+	// noHeader omits the GZIP header and trailer like rawDeflate, but the
+	// size and checksum are still tracked for formats that store them
+	// elsewhere.
+	noHeader bool
+
+	// extra, if non-nil, is written as the FEXTRA field of the header.
+	extra []byte
+
+	// compressedDigest and uncompressedDigest, if non-nil, receive the
+	// compressed output and the uncompressed content respectively.
+	compressedDigest   hash.Hash
+	uncompressedDigest hash.Hash
+
+	// fr decompresses precompressed data for uncompressedDigest.
+	fr io.ReadCloser
+
+	// index, if non-nil, builds an Index as data is added.
+	index *indexer
+
+	// adaptBuf, if non-nil, holds the compressed data of each chunk added
+	// by AddCompressedData in adaptive mode.
+	adaptBuf *bytes.Buffer
+
+	// maxSize, if non-zero, is the maximum size of the output. budget, if
+	// non-zero, is the size of the output that the TryAdd methods of a
+	// Builder must fit within.
+	maxSize int64
+	budget  int64
+
 	uncompLen       uint16
 	uncompHeaderIdx int
 
+	// window holds the data of the blocks added since last was set to
+	// assembled, or of the current run of compressed data, which later
+	// blocks may refer back to. It may hold more than windowSize bytes.
+	window []byte
+
+	// recordWindow is set once a block has been added by startBlock, after
+	// which compressed data is also recorded in window. Until then, no
+	// block has needed it.
+	recordWindow bool
+
+	// prevSize and prevCRC are the size and CRC-32 of the last
+	// PrecompressedData or DEFLATE stream added, if last is precompressed.
+	prevSize uint64
+	prevCRC  uint32
+
 	w  io.Writer
 	fw *flate.Writer
 
-	size uint32
+	// compressedFlushed is true if fw has been flushed since data was last
+	// written to it.
+	compressedFlushed bool
+
+	// written is the number of bytes a Writer has written to the
+	// underlying io.Writer.
+	written int64
+
+	size uint64
 	crc  uint32
 
 	err error
@@ -137,15 +241,72 @@ func (b *builder) RawDeflate() {
 	b.rawDeflate = true
 }
 
+// CompressedDigest sets the builder to write the compressed output, including
+// the GZIP header and trailer, to h as it is written. The digest is complete
+// once Bytes or Close has been called.
+//
+// This is useful for content-addressed stores that identify a blob by the
+// SHA-256 of its compressed form.
+func (b *builder) CompressedDigest(h hash.Hash) {
+	if !b.canSetOption() {
+		return
+	}
+
+	if !b.canTrackOffset() {
+		b.err = errors.New("gzipbuilder: compressed digest not supported")
+		return
+	}
+
+	b.compressedDigest = h
+}
+
+// UncompressedDigest sets the builder to write the uncompressed content to h
+// as it is added.
+//
+// A digest cannot be derived from the digests of its parts, so
+// PrecompressedData and DEFLATE streams added to the builder are decompressed
+// to be written to h. This is much cheaper than compressing them, but is not
+// free.
+func (b *builder) UncompressedDigest(h hash.Hash) {
+	if !b.canSetOption() {
+		return
+	}
+
+	b.uncompressedDigest = h
+}
+
+// digestDeflate decompresses the DEFLATE data read from r, which need not end
+// with a final block, and writes it to uncompressedDigest. dict is the data
+// that it refers back to, if any.
+func (b *builder) digestDeflate(r io.Reader, dict []byte) {
+	if b.uncompressedDigest == nil || b.err != nil {
+		return
+	}
+
+	r = io.MultiReader(r, bytes.NewReader(closeFooter))
+	if b.fr == nil {
+		b.fr = flate.NewReaderDict(r, dict)
+	} else if b.err = b.fr.(flate.Resetter).Reset(r, dict); b.err != nil {
+		return
+	}
+
+	_, b.err = io.Copy(b.uncompressedDigest, b.fr)
+}
+
 // Err returns an error if one has occurred during building.
 func (b *builder) Err() error {
 	return b.err
 }
 
 func (b *builder) canWrite() bool {
-	if b.last == finished && b.err == nil {
+	switch {
+	case b.err != nil:
+	case b.last == finished:
 		b.err = errors.New("gzipbuilder: cannot add data to builder after footer written")
+	case b.last == final:
+		b.err = errors.New("gzipbuilder: cannot add data to builder after final block")
 	}
+	b.checkSize()
 
 	return b.err == nil
 }
@@ -156,7 +317,7 @@ func (b *builder) writeHeader() {
 	}
 	b.last = header
 
-	if b.rawDeflate {
+	if b.rawDeflate || b.noHeader {
 		return
 	}
 
@@ -165,7 +326,7 @@ func (b *builder) writeHeader() {
 		gzipID2     = 0x8b
 		gzipDeflate = 8
 	)
-	*b.scratch = [10]byte{
+	*b.scratch = [gzipHeaderLen]byte{
 		0: gzipID1, 1: gzipID2, 2: gzipDeflate,
 		9: 255, // unknown OS
 	}
@@ -177,13 +338,31 @@ func (b *builder) writeHeader() {
 		b.scratch[8] = 4
 	}
 
-	_, b.err = b.w.Write(b.scratch[:])
+	if b.extra == nil {
+		_, b.err = b.w.Write(b.scratch[:])
+		return
+	}
+
+	const gzipFlagExtra = 1 << 2
+	b.scratch[3] = gzipFlagExtra
+	if _, b.err = b.w.Write(b.scratch[:]); b.err != nil {
+		return
+	}
+
+	binary.LittleEndian.PutUint16(b.scratch[:2], uint16(len(b.extra)))
+	if _, b.err = b.w.Write(b.scratch[:2]); b.err != nil {
+		return
+	}
+
+	_, b.err = b.w.Write(b.extra)
 }
 
 // AddPrecompressedData adds data that was precompressed to the builder.
 //
 // The PrecompressedData must have been created with the same compression level
-// as the builder.
+// as the builder. If it ends with a final block, as returned by FinalData, no
+// more data may be added to the builder. If it was returned by a fork that
+// holds only its suffix, it must directly follow the data it continues.
 func (b *builder) AddPrecompressedData(data *PrecompressedData) {
 	if b.last == start {
 		b.writeHeader()
@@ -195,19 +374,62 @@ func (b *builder) AddPrecompressedData(data *PrecompressedData) {
 		b.err = errors.New("gzipbuilder: compression level mismatch")
 		return
 	}
+	if p := data.prefix; p != nil && (b.last != precompressed || b.prevSize != p.size || b.prevCRC != p.crc) {
+		b.err = errors.New("gzipbuilder: PrecompressedData does not follow the data it continues")
+		return
+	}
 	// Check for an empty write after the compression level, this way we
 	// always surface a mismatch error regardless of the size.
 	if data.size == 0 || !b.flushCompressed() {
 		return
 	}
+
+	n := int64(len(data.bytes))
+	if data.src != nil {
+		n = data.src.Size()
+	}
+	if !b.reserve(n) {
+		return
+	}
+
 	b.last = precompressed
+	b.prevSize, b.prevCRC = data.size, data.crc
+
+	var dict []byte
+	if data.prefix != nil {
+		dict = data.prefix.window
+		b.indexSkip(int64(data.size))
+	} else {
+		b.indexReset(int64(data.size))
+	}
 
 	if !b.rawDeflate {
-		b.size += uint32(data.size)
+		b.size += data.size
 		b.crc = combineCRC32(crc32Mat, b.crc, data.crc, data.size)
 	}
 
-	_, b.err = b.w.Write(data.bytes)
+	if data.src != nil {
+		b.digestDeflate(io.NewSectionReader(data.src, 0, data.src.Size()), dict)
+		if b.err != nil {
+			return
+		}
+
+		var n int64
+		n, b.err = io.Copy(b.w, io.NewSectionReader(data.src, 0, data.src.Size()))
+		if b.err == nil && n != data.src.Size() {
+			b.err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	b.digestDeflate(bytes.NewReader(data.bytes), dict)
+	if b.err != nil {
+		return
+	}
+
+	if _, b.err = b.w.Write(data.bytes); b.err == nil && data.final {
+		b.last = final
+	}
 }
 
 // AddCompressedData compresses data and adds it to the builder.
@@ -222,6 +444,23 @@ func (b *builder) AddCompressedData(data []byte) {
 		return
 	}
 
+	if !b.rawDeflate {
+		b.size += uint64(len(data))
+		b.crc = crc32.Update(b.crc, crc32.IEEETable, data)
+	}
+	if b.uncompressedDigest != nil {
+		b.uncompressedDigest.Write(data)
+	}
+	b.recordCompressed(data)
+
+	if b.adaptBuf != nil {
+		b.addAdaptive(data)
+		return
+	}
+
+	if b.last != compressed {
+		b.indexReset(0)
+	}
 	if b.fw == nil {
 		b.fw = flateWriterGet(b.w, b.level)
 	} else if b.last != compressed {
@@ -229,16 +468,17 @@ func (b *builder) AddCompressedData(data []byte) {
 	}
 	b.last = compressed
 
-	if !b.rawDeflate {
-		b.size += uint32(len(data))
-		b.crc = crc32.Update(b.crc, crc32.IEEETable, data)
+	b.compressedFlushed = false
+	if b.index != nil {
+		b.writeCompressedIndexed(data)
+		return
 	}
 
-	_, b.err = b.fw.Write(data)
+	b.compress(data)
 }
 
 func (b *builder) flushCompressed() bool {
-	if b.last == compressed {
+	if b.last == compressed && !b.compressedFlushed {
 		b.err = b.fw.Flush()
 	}
 
@@ -258,9 +498,16 @@ func (b *builder) AddUncompressedData(data []byte) {
 	}
 
 	if !b.rawDeflate {
-		b.size += uint32(len(data))
+		b.size += uint64(len(data))
 		b.crc = crc32.Update(b.crc, crc32.IEEETable, data)
 	}
+	if b.uncompressedDigest != nil {
+		b.uncompressedDigest.Write(data)
+	}
+	if b.indexReset(int64(len(data))) {
+		// The index point must begin a new stored block.
+		b.last = flushed
+	}
 
 	if packUncompressedData && b.last == uncompressed {
 		data = b.packUncompressed(data)
@@ -289,6 +536,10 @@ func (b *builder) AddUncompressedData(data []byte) {
 }
 
 func (b *builder) zeroWrite(p []byte) {
+	if !b.reserve(int64(5 + len(p))) {
+		return
+	}
+
 	b.scratch[0] = 0
 	binary.LittleEndian.PutUint16(b.scratch[1:], uint16(len(p)))
 	binary.LittleEndian.PutUint16(b.scratch[3:], ^uint16(len(p)))
@@ -311,6 +562,9 @@ func (b *builder) packUncompressed(data []byte) []byte {
 	if int(remaining) > len(data) {
 		remaining = uint16(len(data))
 	}
+	if !b.reserve(int64(remaining)) {
+		return nil
+	}
 	b.uncompLen += remaining
 
 	hdr := buf.Bytes()[b.uncompHeaderIdx : b.uncompHeaderIdx+5]
@@ -356,9 +610,17 @@ func (b *builder) UncompressedWriter() io.Writer {
 }
 
 func (b *builder) finish() {
+	if b.last == compressed && b.compressedFlushed {
+		// The stream is already on a byte boundary, so there is no need
+		// to close the compressor.
+		b.last = flushed
+	}
+
 	switch b.last {
 	case finished:
 		return
+	case final:
+		// The final block was written by the caller.
 	case compressed:
 		if b.err == nil {
 			b.err = b.fw.Close()
@@ -373,12 +635,22 @@ func (b *builder) finish() {
 	}
 	b.last = finished
 
-	if !b.rawDeflate && b.err == nil {
+	if !b.rawDeflate && !b.noHeader && b.err == nil {
 		binary.LittleEndian.PutUint32(b.scratch[:4], b.crc)
-		binary.LittleEndian.PutUint32(b.scratch[4:], b.size)
+		binary.LittleEndian.PutUint32(b.scratch[4:], uint32(b.size))
 		_, b.err = b.w.Write(b.scratch[:8])
 	}
 
+	if b.index != nil {
+		b.index.idx.Size = b.index.pos
+	}
+	b.checkSize()
+
+	// A Writer's output is written to compressedDigest by digestWriter.
+	if buf, ok := b.w.(*bytes.Buffer); ok && b.compressedDigest != nil && b.err == nil {
+		b.compressedDigest.Write(buf.Bytes())
+	}
+
 	if b.fw != nil {
 		flateWriterPut(b.fw, b.level)
 		b.fw = nil
@@ -417,6 +689,56 @@ func (b *Builder) BytesOrPanic() []byte {
 	return b.w.(*bytes.Buffer).Bytes()
 }
 
+// Precompressed returns a PrecompressedData containing the data added to the
+// builder so far. Rather than writing the GZIP footer, the DEFLATE stream is
+// flushed and the GZIP header and trailer are omitted. The result can be
+// passed to another Builder or Writer that uses the same compression level.
+//
+// It is safe to call Precompressed multiple times. Data may be added to the
+// builder after Precompressed and Bytes may still be called to produce a
+// complete GZIP stream. The returned data is a copy, so it remains valid even
+// if the builder is later rolled back.
+//
+// Precompressed leaves the builder as it was, except that, like Checkpoint, it
+// flushes the compressor if compressed data has been added since it was last
+// flushed. This costs a few bytes, but the compressor keeps its history.
+//
+// Precompressed returns an error if RawDeflate was called, as the CRC-32 and
+// size are not tracked, or if Bytes or BytesOrPanic has already been called.
+func (b *Builder) Precompressed() (*PrecompressedData, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.rawDeflate {
+		return nil, errors.New("gzipbuilder: cannot convert raw DEFLATE builder to PrecompressedData")
+	}
+	if b.last == finished {
+		return nil, errors.New("gzipbuilder: cannot convert builder to PrecompressedData after footer written")
+	}
+	if b.last == final {
+		return nil, errors.New("gzipbuilder: cannot convert builder to PrecompressedData after final block")
+	}
+
+	if b.last == start {
+		b.writeHeader()
+	}
+	if !b.flushCompressed() {
+		return nil, b.err
+	}
+	if b.last == compressed {
+		b.compressedFlushed = true
+	}
+
+	return &PrecompressedData{
+		level: b.level,
+
+		// The data is copied as Rollback may overwrite the buffer.
+		bytes: append([]byte(nil), b.w.(*bytes.Buffer).Bytes()[gzipHeaderLen:]...),
+		size:  b.size,
+		crc:   b.crc,
+	}, nil
+}
+
 // A Writer incrementally builds a compressed GZIP stream. It supports
 // interleaving compressed, pre-compressed or uncompressed data into the
 // output.
@@ -426,8 +748,26 @@ type Writer struct{ builder }
 // written to w.
 func NewWriter(w io.Writer, level int) *Writer {
 	bw := bufioWriterPool.Get().(*bufio.Writer)
-	bw.Reset(w)
-	return &Writer{newBuilder(bw, level)}
+	b := &Writer{newBuilder(bw, level)}
+	bw.Reset(digestWriter{&b.builder, w})
+	return b
+}
+
+// digestWriter writes to w and to the builder's compressedDigest, if any,
+// counting the bytes written.
+type digestWriter struct {
+	b *builder
+	w io.Writer
+}
+
+func (w digestWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.b.written += int64(n)
+	if h := w.b.compressedDigest; h != nil {
+		h.Write(p[:n])
+	}
+
+	return n, err
 }
 
 // Close closes the Writer by flushing any unwritten data to the underlying
@@ -457,15 +797,176 @@ type PrecompressedData struct {
 	bytes []byte
 	size  uint64
 	crc   uint32
+
+	// src, if non-nil, holds the compressed data instead of bytes.
+	src *io.SectionReader
+
+	// final is true if the compressed data ends with a final block.
+	final bool
+
+	// prefix, if non-nil, describes the data that the compressed data
+	// continues and refers back to.
+	prefix *precompressedPrefix
 }
 
-// PrecompressData compresses data at the given compression level.
+// precompressedPrefix describes the data written to a PrecompressedWriter
+// before it was forked with only its suffix.
+type precompressedPrefix struct {
+	size uint64
+	crc  uint32
+
+	// window holds the end of the prefix that the suffix may refer back
+	// to, at most windowSize bytes.
+	window []byte
+}
+
+var (
+	errFinalData  = errors.New("gzipbuilder: final PrecompressedData not supported")
+	errSuffixData = errors.New("gzipbuilder: PrecompressedData from a suffix fork not supported")
+)
+
+// PrecompressData compresses data at the given compression level, which may
+// also be ExhaustiveCompression.
 func PrecompressData(data []byte, level int) (*PrecompressedData, error) {
 	w := NewPrecompressedWriter(level)
 	w.Write(data)
 	return w.Data()
 }
 
+// NewPrecompressedData creates a PrecompressedData from its raw parts. data
+// must be a DEFLATE stream, as returned by WriteTo, that is flushed to a byte
+// boundary and does not contain a final block. crc and size are the CRC-32
+// and length of the uncompressed data and level is the compression level the
+// data was compressed at.
+//
+// The data is decompressed to validate the inputs, which is considerably
+// cheaper than compressing it again. data is not copied and must not be
+// modified after NewPrecompressedData returns.
+func NewPrecompressedData(data []byte, crc uint32, size uint64, level int) (*PrecompressedData, error) {
+	if err := validCompressionLevel(level); err != nil {
+		return nil, err
+	}
+
+	r := &validateReader{data: data}
+	fr := flate.NewReader(r)
+	h := crc32.NewIEEE()
+	n, err := io.Copy(h, fr)
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		return nil, errors.New("gzipbuilder: truncated DEFLATE stream")
+	case err != nil:
+		return nil, err
+	case len(r.data) != 0 || len(r.footer) != 0:
+		return nil, errors.New("gzipbuilder: DEFLATE stream contains final block")
+	case uint64(n) != size || h.Sum32() != crc:
+		return nil, errors.New("gzipbuilder: checksum or size mismatch")
+	}
+
+	return &PrecompressedData{
+		level: level,
+
+		bytes: data,
+		size:  size,
+		crc:   crc,
+	}, nil
+}
+
+// validateReader is an io.ByteReader that returns data followed by
+// closeFooter. As it implements io.ByteReader, flate will not read beyond the
+// end of the DEFLATE stream.
+type validateReader struct {
+	data   []byte
+	footer []byte
+	init   bool
+}
+
+func (r *validateReader) ReadByte() (byte, error) {
+	if !r.init {
+		r.footer, r.init = closeFooter, true
+	}
+
+	switch {
+	case len(r.data) != 0:
+		c := r.data[0]
+		r.data = r.data[1:]
+		return c, nil
+	case len(r.footer) != 0:
+		c := r.footer[0]
+		r.footer = r.footer[1:]
+		return c, nil
+	default:
+		return 0, io.EOF
+	}
+}
+
+func (r *validateReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	p[0] = c
+	return 1, nil
+}
+
+// UncheckedPrecompressedData is like NewPrecompressedData, but does not
+// validate its inputs. It is intended for generated code, such as that of the
+// gzipembed command, where data was produced by WriteTo and validating it
+// would mean decompressing it during package initialization. Invalid inputs
+// produce corrupt output when the PrecompressedData is added to a Builder or
+// Writer.
+func UncheckedPrecompressedData(data []byte, crc uint32, size uint64, level int) *PrecompressedData {
+	return &PrecompressedData{
+		level: level,
+
+		bytes: data,
+		size:  size,
+		crc:   crc,
+	}
+}
+
+// MustPrecompressedData is a helper that wraps a call to a function returning
+// (*PrecompressedData, error) and panics if the error is non-nil. It is
+// intended for use in variable initializations such as
+//
+//	var d = gzipbuilder.MustPrecompressedData(gzipbuilder.NewPrecompressedData(...))
+func MustPrecompressedData(d *PrecompressedData, err error) *PrecompressedData {
+	if err != nil {
+		panic(err)
+	}
+
+	return d
+}
+
+// Level returns the compression level the data was compressed at.
+func (d *PrecompressedData) Level() int { return d.level }
+
+// Size returns the length of the uncompressed data.
+func (d *PrecompressedData) Size() uint64 { return d.size }
+
+// CRC32 returns the IEEE CRC-32 checksum of the uncompressed data.
+func (d *PrecompressedData) CRC32() uint32 { return d.crc }
+
+// Final reports whether the compressed data ends with a final block, as
+// returned by FinalData.
+func (d *PrecompressedData) Final() bool { return d.final }
+
+// WriteTo writes the compressed DEFLATE data to w. Unless Final reports true,
+// the written data can be passed to NewPrecompressedData along with the
+// results of CRC32, Size and Level.
+func (d *PrecompressedData) WriteTo(w io.Writer) (int64, error) {
+	if d.src != nil {
+		return io.Copy(w, io.NewSectionReader(d.src, 0, d.src.Size()))
+	}
+
+	n, err := w.Write(d.bytes)
+	return int64(n), err
+}
+
 // PrecompressedWriter is an io.Writer that allows incrementally percompressing
 // data. Writes to a PrecompressedWriter are compressed and returned by Data.
 //
@@ -475,25 +976,37 @@ type PrecompressedWriter struct {
 	level int
 
 	buf *bytes.Buffer
-	fw  *flate.Writer
+	fw  deflater
 
 	size uint64
 	crc  uint32
 
 	lastFlush bool
 
+	// scanned is the length of buf when it was last flushed and end is the
+	// bit offset in buf at which the last block before then ends.
+	scanned int
+	end     int64
+
+	// final, if non-nil, was returned by FinalData.
+	final *PrecompressedData
+
+	// prefix, if non-nil, describes the data written before the writer
+	// was forked with only its suffix.
+	prefix *precompressedPrefix
+
 	err error
 }
 
 // NewPrecompressedWriter creates a PrecompressedWriter using the given
-// compression level.
+// compression level, which may also be ExhaustiveCompression.
 func NewPrecompressedWriter(level int) *PrecompressedWriter {
 	w := &PrecompressedWriter{
-		level: level,
+		level: dataLevel(level),
 
 		buf: new(bytes.Buffer),
 	}
-	w.fw, w.err = flate.NewWriter(w.buf, level)
+	w.fw, w.err = newDeflater(w.buf, level)
 	return w
 }
 
@@ -537,11 +1050,16 @@ func (w *PrecompressedWriter) Write(p []byte) (int, error) {
 // written to the writer. It will return any error that has occurred during
 // writing.
 //
+// The compressed data is flushed to a byte boundary. Rather than ending with
+// the empty stored block of a sync flush, it ends with the shortest run of
+// empty blocks that leaves it byte aligned. This saves up to five bytes for
+// each fragment, which matters where many small fragments are joined.
+//
 // It is safe to call Data multiple times. Write may be called again after
 // Data to continue writing more data.
 func (w *PrecompressedWriter) Data() (*PrecompressedData, error) {
 	if w.err == nil && !w.lastFlush {
-		w.err = w.fw.Flush()
+		w.err = w.flush()
 		w.lastFlush = true
 	}
 	if w.err != nil {
@@ -554,5 +1072,321 @@ func (w *PrecompressedWriter) Data() (*PrecompressedData, error) {
 		bytes: w.buf.Bytes(),
 		size:  w.size,
 		crc:   w.crc,
+
+		prefix: w.prefix,
+	}, nil
+}
+
+// Fork returns a new PrecompressedWriter with the same compressor state, CRC-32
+// and size as w. w and the fork can then be written to independently, so that
+// the common prefix of several streams is only compressed once.
+//
+// If suffix is false, Data on the fork returns the full stream, including what
+// was written to w before the fork. If suffix is true, w is first flushed as by
+// Data and Data on the fork returns only what is written to the fork after it.
+// That data refers back to the prefix, so when added to a Builder or Writer it
+// must directly follow the data returned by Data on w at the fork, or other
+// data with the same content.
+//
+// The first fork of w flushes it, as by Data, which costs a few bytes. w and
+// its forks are then compressed by this package's own encoder, which can be
+// cloned, rather than by compress/flate.
+//
+// Any error that has occurred on w is returned by the fork.
+func (w *PrecompressedWriter) Fork(suffix bool) *PrecompressedWriter {
+	if suffix {
+		w.Data()
+	}
+	if w.err == nil {
+		w.err = w.cloneable()
+	}
+	if w.err != nil {
+		return &PrecompressedWriter{level: w.level, err: w.err}
+	}
+
+	e := w.fw.(*encoder)
+	if !suffix {
+		f := *w
+		f.buf = bytes.NewBuffer(append([]byte(nil), w.buf.Bytes()...))
+		f.fw = e.Clone(f.buf)
+		return &f
+	}
+
+	f := &PrecompressedWriter{
+		level: w.level,
+
+		buf: new(bytes.Buffer),
+
+		lastFlush: true,
+
+		prefix: &precompressedPrefix{
+			size: w.size,
+			crc:  w.crc,
+
+			window: e.history(),
+		},
+	}
+	fe := e.Clone(f.buf)
+
+	// The fork's buffer begins at the block boundary where w stopped, so
+	// bit offsets in it begin there too.
+	fe.written = 0
+	f.fw = fe
+	return f
+}
+
+// cloneable replaces a flate.Writer, which cannot be cloned, with an encoder
+// that continues the stream. w is first flushed as by Data, and the encoder
+// is given the history recovered by decoding what w has compressed so far.
+// This is only done once, the first time w is forked.
+func (w *PrecompressedWriter) cloneable() error {
+	if _, ok := w.fw.(*encoder); ok {
+		return nil
+	}
+
+	if _, err := w.Data(); err != nil {
+		return err
+	}
+
+	// Only a suffix fork, which is always an encoder, refers back to data
+	// before buf.
+	window, err := deflateHistory(w.buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	e, err := newEncoder(w.buf, w.level)
+	if err != nil {
+		return err
+	}
+	e.SetWindow(window)
+	e.written = int64(w.buf.Len())
+
+	w.fw = e
+	return nil
+}
+
+// flush ends the current block and aligns the compressor to a byte boundary
+// with the shortest run of empty blocks, recording where they start.
+func (w *PrecompressedWriter) flush() error {
+	if e, ok := w.fw.(*encoder); ok {
+		if err := e.EndBlock(); err != nil {
+			return err
+		}
+
+		w.end = e.BitPos()
+		return e.Align()
+	}
+
+	// A flate.Writer can only sync flush, so the empty stored block that
+	// it ends with is replaced.
+	if err := w.fw.Flush(); err != nil {
+		return err
+	}
+
+	p := w.buf.Bytes()
+	start, err := syncFlushStart(p[w.scanned:])
+	if err != nil {
+		return err
+	}
+	w.end = int64(w.scanned)*8 + start
+
+	bw := new(bitWriter)
+	bw.copyBits(p, w.end&^7, w.end)
+	bw.alignShort()
+
+	// The compressor is byte aligned after a flush, so it continues after
+	// the replacement as it would have after the stored block.
+	w.buf.Truncate(int(w.end / 8))
+	w.buf.Write(bw.buf)
+	w.scanned = w.buf.Len()
+	return nil
+}
+
+// FinalData is like Data, but the returned PrecompressedData ends with a final
+// block. As the last data added to a Builder or Writer, it needs no footer
+// before the GZIP trailer. No more data may be added to the Builder or Writer
+// after it.
+//
+// No more data may be written after FinalData and Data will return an error.
+// It is safe to call FinalData multiple times.
+func (w *PrecompressedWriter) FinalData() (*PrecompressedData, error) {
+	if w.final != nil {
+		return w.final, nil
+	}
+
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	var p []byte
+	if w.lastFlush {
+		// The stream as it is was returned by Data, so the final block
+		// is added to a copy, in place of the blocks that align it.
+		p = w.buf.Bytes()
+		n := int(w.end / 8)
+
+		bw := new(bitWriter)
+		bw.copyBits(p, w.end&^7, w.end)
+		bw.emptyFixedBlock(true)
+		if bw.nbits > 0 {
+			bw.writeBits(0, 8-bw.nbits)
+		}
+
+		p = append(p[:n:n], bw.buf...)
+	} else {
+		if err := w.fw.Close(); err != nil {
+			w.err = err
+			return nil, err
+		}
+
+		p = w.buf.Bytes()
+	}
+
+	w.final = &PrecompressedData{
+		level: w.level,
+
+		bytes: p,
+		size:  w.size,
+		crc:   w.crc,
+
+		final:  true,
+		prefix: w.prefix,
+	}
+	w.err = errors.New("gzipbuilder: PrecompressedWriter finished by FinalData")
+	return w.final, nil
+}
+
+// PrecompressedStreamWriter is an io.Writer that allows incrementally
+// precompressing data. Unlike PrecompressedWriter, the compressed data is
+// written to an underlying io.Writer, such as a file, rather than being held
+// in memory.
+//
+// The PrecompressedData returned from Data refers to the compressed data by
+// position and can be passed to a Builder to avoid re-compressing static data.
+//
+// Except at ExhaustiveCompression, the compressed data ends with the 5 byte
+// marker of a sync flush rather than the shorter aligned ending of
+// PrecompressedWriter. compress/flate does not report the bit position that
+// its last block ends at, and the marker has already been written to the
+// underlying io.Writer by the time it could be replaced. The few bytes matter
+// little for the large files a PrecompressedStreamWriter is meant for.
+type PrecompressedStreamWriter struct {
+	level int
+
+	cw countWriter
+	fw deflater
+
+	size uint64
+	crc  uint32
+
+	lastFlush bool
+
+	err error
+}
+
+// countWriter is an io.Writer that counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// NewPrecompressedStreamWriter creates a PrecompressedStreamWriter using the
+// given compression level, which may also be ExhaustiveCompression. Compressed
+// data is written to w.
+func NewPrecompressedStreamWriter(w io.Writer, level int) *PrecompressedStreamWriter {
+	sw := &PrecompressedStreamWriter{
+		level: dataLevel(level),
+
+		cw: countWriter{w: w},
+	}
+	sw.fw, sw.err = newDeflater(&sw.cw, level)
+	return sw
+}
+
+// Reset discards the PrecompressedStreamWriter's state and makes it equivalent
+// to the result of NewPrecompressedStreamWriter, but writing to w instead. This
+// permits reusing a PrecompressedStreamWriter rather than allocating a new
+// one.
+func (w *PrecompressedStreamWriter) Reset(dst io.Writer) {
+	if w.fw == nil {
+		// The compression level was invalid, w.err contains the error.
+		return
+	}
+
+	*w = PrecompressedStreamWriter{
+		level: w.level,
+
+		cw: countWriter{w: dst},
+		fw: w.fw,
+	}
+	w.fw.Reset(&w.cw)
+}
+
+// Write writes a compressed form of p to the underlying io.Writer.
+//
+// It will return any error that has occurred during writing.
+func (w *PrecompressedStreamWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.lastFlush = false
+
+	w.size += uint64(len(p))
+	w.crc = crc32.Update(w.crc, crc32.IEEETable, p)
+
+	n, err := w.fw.Write(p)
+	w.err = err
+	return n, err
+}
+
+// Len flushes any pending compressed data and returns the number of bytes
+// written to the underlying io.Writer. It will return any error that has
+// occurred during writing.
+func (w *PrecompressedStreamWriter) Len() (int64, error) {
+	if w.err == nil && !w.lastFlush {
+		if e, ok := w.fw.(*encoder); ok {
+			w.err = e.Align()
+		} else {
+			w.err = w.fw.Flush()
+		}
+		w.lastFlush = true
+	}
+
+	return w.cw.n, w.err
+}
+
+// Data returns a PrecompressedData struct that refers to the compressed data
+// written to the underlying io.Writer. r must return the bytes that were
+// written to the underlying io.Writer, starting at offset off. If the
+// underlying io.Writer is buffered, it must be flushed before the
+// PrecompressedData is used. It will return any error that has occurred during
+// writing.
+//
+// The compressed data is read from r each time the PrecompressedData is
+// added to a Builder or Writer, it is never loaded into memory all at once.
+//
+// It is safe to call Data multiple times. Write may be called again after
+// Data to continue writing more data.
+func (w *PrecompressedStreamWriter) Data(r io.ReaderAt, off int64) (*PrecompressedData, error) {
+	n, err := w.Len()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PrecompressedData{
+		level: w.level,
+
+		size: w.size,
+		crc:  w.crc,
+
+		src: io.NewSectionReader(r, off, n),
 	}, nil
 }
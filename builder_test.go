@@ -1,13 +1,18 @@
 package gzipbuilder
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"crypto/sha256"
 	"errors"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"os"
 	"strconv"
 	"strings"
 	"testing"
@@ -806,9 +811,10 @@ func TestPrecompressedWriterMultipleData(t *testing.T) {
 
 	assert.NotEqual(t, data1.bytes, data3.bytes, "does not differ after Write")
 
-	syncFlushFooter := []byte{0x00, 0x00, 0x00, 0xff, 0xff}
-	assert.True(t, bytes.HasSuffix(data3.bytes, syncFlushFooter),
-		"missing Z_SYNC_FLUSH")
+	_, err = NewPrecompressedData(data3.bytes, data3.crc, data3.size, data3.level)
+	assert.NoError(t, err, "not flushed to a byte boundary")
+	assert.True(t, bytes.HasPrefix(data3.bytes, data1.bytes),
+		"data returned by earlier Data call was modified")
 
 	b := NewBuilder(DefaultCompression)
 	b.AddPrecompressedData(data3)
@@ -841,6 +847,278 @@ func TestPrecompressDataEmpty(t *testing.T) {
 	assert.Equal(t, "", decompressFlateBytes(t, bb))
 }
 
+func TestBuilderPrecompressed(t *testing.T) {
+	d, err := PrecompressData([]byte("world"), DefaultCompression)
+	require.NoError(t, err, "failed to precompress data")
+
+	for _, tc := range []struct {
+		name string
+		fn   func(*Builder)
+	}{
+		{"empty", func(*Builder) {}},
+		{"AddPrecompressedData", func(b *Builder) { b.AddPrecompressedData(d) }},
+		{"AddUncompressedData", func(b *Builder) { b.AddUncompressedData([]byte("world")) }},
+		{"AddCompressedData", func(b *Builder) { b.AddCompressedData([]byte("world")) }},
+		{"mixed", func(b *Builder) {
+			b.AddCompressedData([]byte("wo"))
+			b.AddUncompressedData([]byte("r"))
+			b.AddPrecompressedData(d)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inner := NewBuilder(DefaultCompression)
+			tc.fn(inner)
+
+			pd, err := inner.Precompressed()
+			require.NoError(t, err, "Precompressed returned error")
+
+			pd2, err := inner.Precompressed()
+			require.NoError(t, err, "Precompressed returned error")
+			assert.Equal(t, pd, pd2, "differs after second Precompressed call")
+
+			expect := decompressBytes(t, inner.BytesOrPanic())
+
+			b := NewBuilder(DefaultCompression)
+			b.AddUncompressedData([]byte("hello "))
+			b.AddPrecompressedData(pd)
+			b.AddCompressedData([]byte(" "))
+			b.AddPrecompressedData(pd)
+
+			bb, err := b.Bytes()
+			require.NoError(t, err, "Bytes returned error")
+			assert.NoError(t, b.Err(), "Err returned error")
+
+			debugLogf(t, "%d:%x", len(bb), bb)
+
+			assert.Equal(t, "hello "+expect+" "+expect, decompressBytes(t, bb))
+		})
+	}
+}
+
+func TestBuilderPrecompressedContinue(t *testing.T) {
+	b := NewBuilder(DefaultCompression)
+	b.AddUncompressedData([]byte("hello "))
+
+	d, err := b.Precompressed()
+	require.NoError(t, err, "Precompressed returned error")
+	data := append([]byte(nil), d.bytes...)
+
+	b.AddUncompressedData([]byte("world"))
+
+	bb, err := b.Bytes()
+	require.NoError(t, err, "Bytes returned error")
+
+	assert.Equal(t, data, d.bytes, "PrecompressedData modified by later write")
+	assert.Equal(t, "hello world", decompressBytes(t, bb))
+}
+
+func TestBuilderPrecompressedUnchanged(t *testing.T) {
+	doc := spliceTestDocument(10 << 10)
+
+	build := func(inspect func(b *Builder)) []byte {
+		b := NewBuilder(DefaultCompression)
+		b.AddCompressedData(doc[:5<<10])
+		inspect(b)
+		b.AddCompressedData(doc[5<<10:])
+		b.AddUncompressedData([]byte("hello "))
+		inspect(b)
+		b.AddUncompressedData([]byte("world"))
+		return b.BytesOrPanic()
+	}
+
+	flushed := build(func(b *Builder) { b.Checkpoint() })
+	inspected := build(func(b *Builder) {
+		_, err := b.Precompressed()
+		require.NoError(t, err, "Precompressed returned error")
+	})
+
+	assert.Equal(t, flushed, inspected,
+		"Precompressed should only flush the compressor")
+	assert.Equal(t, string(doc)+"hello world", decompressBytes(t, inspected))
+}
+
+func TestBuilderPrecompressedErrors(t *testing.T) {
+	b := NewBuilder(DefaultCompression)
+	b.RawDeflate()
+
+	d, err := b.Precompressed()
+	assert.EqualError(t, err, "gzipbuilder: cannot convert raw DEFLATE builder to PrecompressedData")
+	assert.Nil(t, d, "expected nil *PrecompressedData")
+
+	b = NewBuilder(DefaultCompression)
+	b.BytesOrPanic()
+
+	d, err = b.Precompressed()
+	assert.EqualError(t, err, "gzipbuilder: cannot convert builder to PrecompressedData after footer written")
+	assert.Nil(t, d, "expected nil *PrecompressedData")
+
+	b = NewBuilder(-100)
+
+	d, err = b.Precompressed()
+	assert.EqualError(t, err, "flate: invalid compression level -100: want value in range [-2, 9]")
+	assert.Nil(t, d, "expected nil *PrecompressedData")
+}
+
+func TestPrecompressedStreamWriter(t *testing.T) {
+	f, err := ioutil.TempFile("", "gzipbuilder")
+	require.NoError(t, err, "creating temporary file")
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := NewPrecompressedStreamWriter(f, DefaultCompression)
+	io.WriteString(w, "hello ")
+
+	d1, err := w.Data(f, 0)
+	require.NoError(t, err, "PrecompressedStreamWriter.Data failed")
+
+	off, err := w.Len()
+	require.NoError(t, err, "PrecompressedStreamWriter.Len failed")
+
+	w.Reset(f)
+	io.WriteString(w, "world")
+
+	d2, err := w.Data(f, off)
+	require.NoError(t, err, "PrecompressedStreamWriter.Data failed")
+
+	b := NewBuilder(DefaultCompression)
+	b.AddPrecompressedData(d1)
+	b.AddPrecompressedData(d2)
+	b.AddPrecompressedData(d1)
+
+	bb, err := b.Bytes()
+	require.NoError(t, err, "Bytes returned error")
+
+	debugLogf(t, "%d:%x", len(bb), bb)
+
+	assert.Equal(t, "hello worldhello ", decompressBytes(t, bb))
+
+	var buf bytes.Buffer
+	bw := NewWriter(&buf, DefaultCompression)
+	bw.AddPrecompressedData(d2)
+	bw.AddPrecompressedData(d1)
+	require.NoError(t, bw.Close(), "Close returned error")
+
+	assert.Equal(t, "worldhello ", decompressBytes(t, buf.Bytes()))
+}
+
+func TestPrecompressedStreamWriterEqual(t *testing.T) {
+	data := bytes.Repeat([]byte("hello world "), 1<<12)
+
+	d1, err := PrecompressData(data, DefaultCompression)
+	require.NoError(t, err, "failed to precompress data")
+
+	var buf bytes.Buffer
+	w := NewPrecompressedStreamWriter(&buf, DefaultCompression)
+	w.Write(data)
+
+	d2, err := w.Data(bytes.NewReader(buf.Bytes()), 0)
+	require.NoError(t, err, "PrecompressedStreamWriter.Data failed")
+
+	// The PrecompressedWriter replaces the empty stored block of the sync
+	// flush, but the data before it is the same.
+	end, err := syncFlushStart(buf.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, buf.Bytes()[:end/8], d1.bytes[:end/8])
+	assert.True(t, len(d1.bytes) < len(buf.Bytes()))
+
+	assert.Equal(t, d1.size, d2.size)
+	assert.Equal(t, d1.crc, d2.crc)
+}
+
+func TestPrecompressedStreamWriterLength(t *testing.T) {
+	data := bytes.Repeat([]byte("hello world "), 100)
+
+	for level := HuffmanOnly; level <= ExhaustiveCompression; level++ {
+		d1, err := PrecompressData(data, level)
+		require.NoError(t, err, "level %d", level)
+
+		var buf bytes.Buffer
+		w := NewPrecompressedStreamWriter(&buf, level)
+		w.Write(data)
+		n, err := w.Len()
+		require.NoError(t, err, "level %d", level)
+
+		if level == ExhaustiveCompression {
+			// Both writers use the encoder, which ends the data with
+			// the same short aligned blocks.
+			assert.Equal(t, d1.bytes, buf.Bytes(), "level %d", level)
+			continue
+		}
+
+		// The sync flush marker is never shorter, and at most 5 bytes
+		// longer, than the shortest aligned ending.
+		assert.True(t, n >= int64(len(d1.bytes)) && n <= int64(len(d1.bytes))+5,
+			"level %d: %d bytes, PrecompressedWriter %d bytes", level, n, len(d1.bytes))
+	}
+}
+
+func TestPrecompressedStreamWriterReadError(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPrecompressedStreamWriter(&buf, DefaultCompression)
+	io.WriteString(w, "hello world")
+
+	d, err := w.Data(bytes.NewReader(nil), 0)
+	require.NoError(t, err, "PrecompressedStreamWriter.Data failed")
+
+	testBuilderError(t, io.ErrUnexpectedEOF.Error(), func(b *Builder) { b.AddPrecompressedData(d) })
+}
+
+func TestNewPrecompressedData(t *testing.T) {
+	d, err := PrecompressData([]byte("hello world"), DefaultCompression)
+	require.NoError(t, err, "failed to precompress data")
+
+	var buf bytes.Buffer
+	_, err = d.WriteTo(&buf)
+	require.NoError(t, err, "WriteTo failed")
+
+	d2, err := NewPrecompressedData(buf.Bytes(), d.CRC32(), d.Size(), d.Level())
+	require.NoError(t, err, "NewPrecompressedData failed")
+	assert.Equal(t, d, d2)
+
+	d3, err := NewPrecompressedData(nil, 0, 0, DefaultCompression)
+	require.NoError(t, err, "NewPrecompressedData failed")
+	assert.Zero(t, d3.Size())
+
+	var full bytes.Buffer
+	fw, _ := flate.NewWriter(&full, DefaultCompression)
+	io.WriteString(fw, "hello world")
+	fw.Close()
+
+	for _, tc := range []struct {
+		name  string
+		data  []byte
+		crc   uint32
+		size  uint64
+		level int
+		err   string
+	}{
+		{"level", buf.Bytes(), d.crc, d.size, -100, "flate: invalid compression level -100: want value in range [-2, 9]"},
+		{"crc", buf.Bytes(), d.crc + 1, d.size, DefaultCompression, "gzipbuilder: checksum or size mismatch"},
+		{"size", buf.Bytes(), d.crc, d.size + 1, DefaultCompression, "gzipbuilder: checksum or size mismatch"},
+		{"final", full.Bytes(), d.crc, d.size, DefaultCompression, "gzipbuilder: DEFLATE stream contains final block"},
+		{"truncated", buf.Bytes()[:buf.Len()-6], d.crc, d.size, DefaultCompression, "gzipbuilder: truncated DEFLATE stream"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := NewPrecompressedData(tc.data, tc.crc, tc.size, tc.level)
+			assert.EqualError(t, err, tc.err)
+			assert.Nil(t, d, "expected nil *PrecompressedData")
+		})
+	}
+
+	assert.Panics(t, func() { MustPrecompressedData(NewPrecompressedData(nil, 1, 0, DefaultCompression)) })
+}
+
+func TestUncheckedPrecompressedData(t *testing.T) {
+	d, err := PrecompressData([]byte("hello world"), BestSpeed)
+	require.NoError(t, err, "failed to precompress data")
+
+	var buf bytes.Buffer
+	_, err = d.WriteTo(&buf)
+	require.NoError(t, err, "WriteTo failed")
+
+	assert.Equal(t, d, UncheckedPrecompressedData(buf.Bytes(), d.CRC32(), d.Size(), d.Level()))
+}
+
 var errErrorWriter = errors.New("once error")
 
 type errorWriter struct {
@@ -857,3 +1135,401 @@ func (w *errorWriter) Write(p []byte) (int, error) {
 
 	return len(p), nil
 }
+
+func TestBuilderDigest(t *testing.T) {
+	d, err := PrecompressData([]byte(" precompressed"), DefaultCompression)
+	require.NoError(t, err, "failed to precompress data")
+
+	const expect = "hello precompressed world secret stream"
+
+	for _, useWriter := range []bool{false, true} {
+		compressed, uncompressed := sha256.New(), sha256.New()
+
+		var (
+			buf    bytes.Buffer
+			b      *builder
+			finish func() []byte
+		)
+		if useWriter {
+			w := NewWriter(&buf, DefaultCompression)
+			b, finish = &w.builder, func() []byte {
+				require.NoError(t, w.Close())
+				return buf.Bytes()
+			}
+		} else {
+			bb := NewBuilder(DefaultCompression)
+			b, finish = &bb.builder, bb.BytesOrPanic
+		}
+
+		b.CompressedDigest(compressed)
+		b.UncompressedDigest(uncompressed)
+
+		b.AddCompressedData([]byte("hello"))
+		b.AddPrecompressedData(d)
+		b.AddCompressedData([]byte(" world"))
+		b.AddUncompressedData([]byte(" secret"))
+		b.AddDeflateStream(deflateBytes(t, []byte(" stream"), BestSpeed))
+		out := finish()
+
+		assert.Equal(t, expect, decompressBytes(t, out), "writer=%t", useWriter)
+
+		expectCompressed := sha256.Sum256(out)
+		assert.Equal(t, expectCompressed[:], compressed.Sum(nil),
+			"compressed digest, writer=%t", useWriter)
+
+		expectUncompressed := sha256.Sum256([]byte(expect))
+		assert.Equal(t, expectUncompressed[:], uncompressed.Sum(nil),
+			"uncompressed digest, writer=%t", useWriter)
+	}
+}
+
+func TestBuilderDigestErrors(t *testing.T) {
+	b := NewBuilder(DefaultCompression)
+	b.AddCompressedData([]byte("hello"))
+	b.CompressedDigest(sha256.New())
+	assert.EqualError(t, b.Err(), "gzipbuilder: setting options must be done before writing")
+
+	b = NewBuilder(DefaultCompression)
+	b.AddCompressedData([]byte("hello"))
+	b.UncompressedDigest(sha256.New())
+	assert.EqualError(t, b.Err(), "gzipbuilder: setting options must be done before writing")
+}
+
+func TestPrecompressedWriterShortFlush(t *testing.T) {
+	words := strings.Fields("a an the hello world <li> </li> <a href=\"/\"> gzipbuilder fragment of a page")
+
+	for level := HuffmanOnly; level <= BestCompression; level++ {
+		var short, sync int
+		var expect []byte
+
+		b := NewBuilder(level)
+		for i := 0; i < 200; i++ {
+			frag := []byte(strings.Join(words[:1+i%len(words)], " "))
+			expect = append(expect, frag...)
+
+			d, err := PrecompressData(frag, level)
+			require.NoError(t, err)
+			b.AddPrecompressedData(d)
+
+			_, err = NewPrecompressedData(d.bytes, d.crc, d.size, d.level)
+			require.NoError(t, err, "not flushed to a byte boundary")
+
+			var buf bytes.Buffer
+			fw, _ := flate.NewWriter(&buf, level)
+			fw.Write(frag)
+			fw.Flush()
+
+			assert.True(t, len(d.bytes) <= buf.Len(), "level %d: %q", level, frag)
+			short += len(d.bytes)
+			sync += buf.Len()
+		}
+
+		assert.Equal(t, string(expect), decompressBytes(t, b.BytesOrPanic()), "level %d", level)
+		assert.True(t, short < sync, "level %d", level)
+
+		debugLogf(t, "level %d: %d bytes of fragments, %d bytes with sync flushes", level, short, sync)
+	}
+}
+
+func TestPrecompressedWriterFinalData(t *testing.T) {
+	for level := HuffmanOnly; level <= BestCompression; level++ {
+		w := NewPrecompressedWriter(level)
+		io.WriteString(w, "hello world")
+		d, err := w.FinalData()
+		require.NoError(t, err)
+		assert.True(t, d.Final())
+
+		d2, err := w.FinalData()
+		require.NoError(t, err)
+		assert.Equal(t, d, d2, "FinalData is not idempotent")
+
+		_, err = w.Write([]byte("more"))
+		assert.EqualError(t, err, "gzipbuilder: PrecompressedWriter finished by FinalData")
+		_, err = w.Data()
+		assert.EqualError(t, err, "gzipbuilder: PrecompressedWriter finished by FinalData")
+
+		nonFinal, err := PrecompressData([]byte("hello world"), level)
+		require.NoError(t, err)
+		assert.False(t, nonFinal.Final())
+
+		b := NewBuilder(level)
+		b.AddUncompressedData([]byte("> "))
+		b.AddPrecompressedData(d)
+		out := b.BytesOrPanic()
+		assert.Equal(t, "> hello world", decompressBytes(t, out), "level %d", level)
+
+		b = NewBuilder(level)
+		b.AddUncompressedData([]byte("> "))
+		b.AddPrecompressedData(nonFinal)
+		assert.True(t, len(out) < len(b.BytesOrPanic()), "level %d", level)
+
+		b = NewBuilder(level)
+		b.RawDeflate()
+		b.AddPrecompressedData(d)
+		assert.Equal(t, "hello world", decompressFlateBytes(t, b.BytesOrPanic()), "level %d", level)
+
+		var buf bytes.Buffer
+		zw := NewWriter(&buf, level)
+		zw.AddPrecompressedData(nonFinal)
+		zw.AddPrecompressedData(d)
+		require.NoError(t, zw.Close())
+		assert.Equal(t, "hello worldhello world", decompressBytes(t, buf.Bytes()), "level %d", level)
+
+		b = NewBuilder(level)
+		b.AddPrecompressedData(d)
+		b.AddCompressedData([]byte("more"))
+		assert.EqualError(t, b.Err(), "gzipbuilder: cannot add data to builder after final block")
+
+		b = NewBuilder(level)
+		b.AddPrecompressedData(d)
+		_, err = b.Precompressed()
+		assert.EqualError(t, err, "gzipbuilder: cannot convert builder to PrecompressedData after final block")
+	}
+}
+
+func TestPrecompressedWriterFinalDataShared(t *testing.T) {
+	w := NewPrecompressedWriter(DefaultCompression)
+	io.WriteString(w, "hello ")
+	d1, err := w.Data()
+	require.NoError(t, err)
+
+	io.WriteString(w, "world")
+	d2, err := w.Data()
+	require.NoError(t, err)
+	data := append([]byte(nil), d2.bytes...)
+
+	d3, err := w.FinalData()
+	require.NoError(t, err)
+	assert.Equal(t, data, d2.bytes, "PrecompressedData modified by FinalData")
+
+	b := NewBuilder(DefaultCompression)
+	b.AddPrecompressedData(d1)
+	b.AddPrecompressedData(d2)
+	b.AddPrecompressedData(d3)
+	assert.Equal(t, "hello hello worldhello world", decompressBytes(t, b.BytesOrPanic()))
+}
+
+func TestPrecompressedDataFinalUnsupported(t *testing.T) {
+	w := NewPrecompressedWriter(DefaultCompression)
+	io.WriteString(w, "hello world")
+	d, err := w.FinalData()
+	require.NoError(t, err)
+
+	l := NewLayout(DefaultCompression)
+	l.AddPrecompressedData(d)
+	assert.Equal(t, errFinalData, l.Err(), "Layout")
+
+	bw := NewBGZFWriter(ioutil.Discard, DefaultCompression)
+	bw.AddPrecompressedData(d)
+	assert.Equal(t, errFinalData, bw.Close(), "BGZFWriter")
+
+	pw := NewPackWriter(ioutil.Discard, DefaultCompression)
+	assert.Equal(t, errFinalData, pw.AddPrecompressedData("d", d), "PackWriter")
+
+	tw := NewTarWriter(ioutil.Discard, DefaultCompression)
+	assert.Equal(t, errFinalData, tw.AddPrecompressedData(&tar.Header{Name: "d"}, d), "TarWriter")
+}
+
+func TestPrecompressedWriterFork(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+	prefix, suffix1, suffix2 := doc[:60<<10], doc[60<<10:70<<10], doc[90<<10:]
+
+	for level := HuffmanOnly; level <= BestCompression; level++ {
+		w := NewPrecompressedWriter(level)
+		w.Write(prefix)
+		f := w.Fork(false)
+
+		w.Write(suffix1)
+		f.Write(suffix2)
+
+		d1, err := w.Data()
+		require.NoError(t, err)
+		d2, err := f.Data()
+		require.NoError(t, err)
+
+		decompress := func(d *PrecompressedData) string {
+			b := NewBuilder(level)
+			b.AddPrecompressedData(d)
+			return decompressBytes(t, b.BytesOrPanic())
+		}
+
+		expect, err := PrecompressData(append(append([]byte(nil), prefix...), suffix1...), level)
+		require.NoError(t, err)
+		assert.Equal(t, string(prefix)+string(suffix1), decompress(d1), "level %d", level)
+		assert.Equal(t, expect.crc, d1.crc, "level %d", level)
+		assert.Equal(t, expect.size, d1.size, "level %d", level)
+
+		expect, err = PrecompressData(append(append([]byte(nil), prefix...), suffix2...), level)
+		require.NoError(t, err)
+		assert.Equal(t, string(prefix)+string(suffix2), decompress(d2), "level %d", level)
+		assert.Equal(t, expect.crc, d2.crc, "level %d", level)
+		assert.Equal(t, expect.size, d2.size, "level %d", level)
+
+		// The prefix is only compressed once, as the first fork flushes
+		// w as Data does.
+		shared, err := PrecompressData(prefix, level)
+		require.NoError(t, err)
+		assert.Equal(t, shared.bytes, d1.bytes[:len(shared.bytes)], "level %d", level)
+		assert.Equal(t, shared.bytes, d2.bytes[:len(shared.bytes)], "level %d", level)
+
+		// Later forks have the same compressor state as w, so they
+		// compress the same data identically.
+		g := w.Fork(false)
+		w.Write(suffix2)
+		g.Write(suffix2)
+
+		d1, err = w.Data()
+		require.NoError(t, err)
+		d3, err := g.Data()
+		require.NoError(t, err)
+		assert.Equal(t, d1.bytes, d3.bytes, "level %d: fork should match w", level)
+	}
+}
+
+func TestPrecompressedWriterForkSuffix(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+	random := randomBytes(20 << 10)
+	prefix := append(doc[:40<<10:40<<10], random...)
+	suffix1, suffix2 := random[:10<<10], doc[90<<10:]
+
+	for level := HuffmanOnly; level <= BestCompression; level++ {
+		w := NewPrecompressedWriter(level)
+		w.Write(prefix)
+		f1 := w.Fork(true)
+		f2 := w.Fork(true)
+
+		d, err := w.Data()
+		require.NoError(t, err)
+
+		f1.Write(suffix1)
+		d1, err := f1.Data()
+		require.NoError(t, err)
+		assert.Equal(t, uint64(len(suffix1)), d1.size, "level %d", level)
+		assert.Equal(t, crc32.ChecksumIEEE(suffix1), d1.crc, "level %d", level)
+
+		f2.Write(suffix2)
+		d2, err := f2.FinalData()
+		require.NoError(t, err)
+
+		b := NewBuilder(level)
+		b.UncompressedDigest(sha256.New())
+		b.AddUncompressedData([]byte("<!doctype html>"))
+		b.AddPrecompressedData(d)
+		b.AddPrecompressedData(d1)
+		assert.Equal(t, "<!doctype html>"+string(prefix)+string(suffix1),
+			decompressBytes(t, b.BytesOrPanic()), "level %d", level)
+
+		b = NewBuilder(level)
+		b.IndexEvery(1 << 10)
+		b.AddPrecompressedData(d)
+		b.AddPrecompressedData(d2)
+		assert.Equal(t, string(prefix)+string(suffix2),
+			decompressBytes(t, b.BytesOrPanic()), "level %d", level)
+		assert.Len(t, b.Index().Points, 1, "level %d: no point can be added before suffix", level)
+
+		if level >= BestSpeed {
+			full, err := PrecompressData(suffix1, level)
+			require.NoError(t, err)
+			assert.True(t, len(d1.bytes) < len(full.bytes), "level %d: suffix should refer back to prefix", level)
+		}
+	}
+}
+
+func TestPrecompressedWriterForkSuffixOrder(t *testing.T) {
+	w := NewPrecompressedWriter(DefaultCompression)
+	io.WriteString(w, "hello ")
+	f := w.Fork(true)
+	io.WriteString(f, "world")
+
+	d, err := w.Data()
+	require.NoError(t, err)
+	d1, err := f.Data()
+	require.NoError(t, err)
+
+	b := NewBuilder(DefaultCompression)
+	b.AddPrecompressedData(d1)
+	assert.EqualError(t, b.Err(), "gzipbuilder: PrecompressedData does not follow the data it continues")
+
+	b = NewBuilder(DefaultCompression)
+	b.AddPrecompressedData(d)
+	b.AddUncompressedData([]byte(", "))
+	b.AddPrecompressedData(d1)
+	assert.EqualError(t, b.Err(), "gzipbuilder: PrecompressedData does not follow the data it continues")
+
+	b = NewBuilder(DefaultCompression)
+	b.AddCompressedData([]byte("hello "))
+	b.AddPrecompressedData(d1)
+	assert.EqualError(t, b.Err(), "gzipbuilder: PrecompressedData does not follow the data it continues")
+
+	b = NewBuilder(DefaultCompression)
+	b.AddPrecompressedData(d)
+	cp := b.Checkpoint()
+	b.AddCompressedData([]byte("x"))
+	b.Rollback(cp)
+	b.AddPrecompressedData(d1)
+	assert.Equal(t, "hello world", decompressBytes(t, b.BytesOrPanic()))
+}
+
+func TestPrecompressedDataSuffixUnsupported(t *testing.T) {
+	w := NewPrecompressedWriter(DefaultCompression)
+	io.WriteString(w, "hello ")
+	f := w.Fork(true)
+	io.WriteString(f, "world")
+	d, err := f.Data()
+	require.NoError(t, err)
+
+	l := NewLayout(DefaultCompression)
+	l.AddPrecompressedData(d)
+	assert.Equal(t, errSuffixData, l.Err(), "Layout")
+
+	bw := NewBGZFWriter(ioutil.Discard, DefaultCompression)
+	bw.AddPrecompressedData(d)
+	assert.Equal(t, errSuffixData, bw.Close(), "BGZFWriter")
+
+	pw := NewPackWriter(ioutil.Discard, DefaultCompression)
+	assert.Equal(t, errSuffixData, pw.AddPrecompressedData("d", d), "PackWriter")
+
+	tw := NewTarWriter(ioutil.Discard, DefaultCompression)
+	assert.Equal(t, errSuffixData, tw.AddPrecompressedData(&tar.Header{Name: "d"}, d), "TarWriter")
+
+	zw := NewZipWriter(ioutil.Discard, DefaultCompression)
+	assert.Equal(t, errSuffixData, zw.AddPrecompressedData(&zip.FileHeader{Name: "d"}, d), "ZipWriter")
+}
+
+func benchmarkCompressedData(b *testing.B, level int) {
+	doc := spliceTestDocument(1 << 20)
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		w := NewWriter(ioutil.Discard, level)
+		w.AddCompressedData(doc)
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAddCompressedData(b *testing.B) {
+	benchmarkCompressedData(b, DefaultCompression)
+}
+
+func BenchmarkAddCompressedDataNoCompression(b *testing.B) {
+	benchmarkCompressedData(b, NoCompression)
+}
+
+func BenchmarkPrecompressedWriter(b *testing.B) {
+	doc := spliceTestDocument(1 << 20)
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		w := NewPrecompressedWriter(DefaultCompression)
+		w.Write(doc)
+		if _, err := w.Data(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
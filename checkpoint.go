@@ -0,0 +1,121 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// A Checkpoint records the state of a Builder so that data added after it can
+// be undone with Rollback.
+type Checkpoint struct {
+	b *Builder
+
+	n    int
+	last sectionType
+	size uint64
+	crc  uint32
+
+	uncompLen       uint16
+	uncompHeaderIdx int
+
+	prevSize uint64
+	prevCRC  uint32
+
+	// points, pos and next record the state of the index, if any.
+	points    int
+	pos, next int64
+
+	err error
+}
+
+// Checkpoint returns a Checkpoint that Rollback can return the Builder to. If
+// data is being compressed, the compressor is flushed so that the stream can
+// be truncated at the checkpoint, which costs a few bytes. Compression
+// continues with the same history unless the Builder is rolled back.
+//
+// Checkpoint is intended for adding content speculatively, such as a partial
+// whose rendering may fail halfway.
+func (b *Builder) Checkpoint() Checkpoint {
+	if b.uncompressedDigest != nil && b.err == nil {
+		b.err = errors.New("gzipbuilder: cannot checkpoint builder with uncompressed digest")
+	}
+	if b.last == compressed && !b.compressedFlushed && b.err == nil {
+		b.err = b.fw.Flush()
+		b.compressedFlushed = true
+	}
+
+	cp := Checkpoint{
+		b: b,
+
+		n:    b.w.(*bytes.Buffer).Len(),
+		last: b.last,
+		size: b.size,
+		crc:  b.crc,
+
+		uncompLen:       b.uncompLen,
+		uncompHeaderIdx: b.uncompHeaderIdx,
+
+		prevSize: b.prevSize,
+		prevCRC:  b.prevCRC,
+
+		err: b.err,
+	}
+	if cp.last == compressed || cp.last == assembled {
+		// Data added after a rollback must not refer back to data that
+		// was removed, so the compressor, or the window of assembled
+		// blocks, is reset.
+		cp.last = flushed
+	}
+	if b.index != nil {
+		cp.points = len(b.index.idx.Points)
+		cp.pos, cp.next = b.index.pos, b.index.next
+	}
+
+	return cp
+}
+
+// Rollback returns the Builder to the state recorded by cp, removing any data
+// added since. Any error that occurred since the checkpoint is cleared.
+//
+// Rolling back invalidates any checkpoint taken after cp. Rollback cannot be
+// used once Bytes or BytesOrPanic has been called.
+func (b *Builder) Rollback(cp Checkpoint) {
+	switch {
+	case cp.b != b:
+		b.err = errors.New("gzipbuilder: checkpoint is from another builder")
+		return
+	case b.last == finished:
+		if b.err == nil {
+			b.err = errors.New("gzipbuilder: cannot roll back builder after footer written")
+		}
+		return
+	}
+
+	buf := b.w.(*bytes.Buffer)
+	if cp.n > buf.Len() {
+		b.err = errors.New("gzipbuilder: invalid checkpoint")
+		return
+	}
+	buf.Truncate(cp.n)
+
+	b.last = cp.last
+	b.size, b.crc = cp.size, cp.crc
+	b.uncompLen, b.uncompHeaderIdx = cp.uncompLen, cp.uncompHeaderIdx
+	b.prevSize, b.prevCRC = cp.prevSize, cp.prevCRC
+	b.err = cp.err
+
+	// The header of the last stored block may have been rewritten as data
+	// was packed into it.
+	if b.last == uncompressed {
+		hdr := buf.Bytes()[b.uncompHeaderIdx : b.uncompHeaderIdx+5]
+		binary.LittleEndian.PutUint16(hdr[1:], b.uncompLen)
+		binary.LittleEndian.PutUint16(hdr[3:], ^b.uncompLen)
+	}
+
+	if ix := b.index; ix != nil {
+		ix.idx.Points = ix.idx.Points[:cp.points]
+		ix.pos, ix.next = cp.pos, cp.next
+		ix.window = ix.window[:0]
+	}
+}
@@ -0,0 +1,144 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuilderCheckpoint(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+	pd := MustPrecompressedData(PrecompressData([]byte("precompressed "), DefaultCompression))
+
+	adds := map[string]func(b *Builder){
+		"none":          func(b *Builder) {},
+		"compressed":    func(b *Builder) { b.AddCompressedData([]byte("compressed ")) },
+		"uncompressed":  func(b *Builder) { b.AddUncompressedData([]byte("uncompressed ")) },
+		"precompressed": func(b *Builder) { b.AddPrecompressedData(pd) },
+		"large":         func(b *Builder) { b.AddCompressedData(doc) },
+	}
+	expect := map[string]string{
+		"none":          "",
+		"compressed":    "compressed ",
+		"uncompressed":  "uncompressed ",
+		"precompressed": "precompressed ",
+		"large":         string(doc),
+	}
+
+	for before, addBefore := range adds {
+		for undone, addUndone := range adds {
+			for after, addAfter := range adds {
+				b := NewBuilder(DefaultCompression)
+				addBefore(b)
+				cp := b.Checkpoint()
+				addUndone(b)
+				addUndone(b)
+				b.Rollback(cp)
+				addAfter(b)
+				addAfter(b)
+
+				out, err := b.Bytes()
+				require.NoError(t, err, "%s, %s, %s", before, undone, after)
+
+				assert.Equal(t, expect[before]+expect[after]+expect[after], decompressBytes(t, out),
+					"%s, %s, %s", before, undone, after)
+			}
+		}
+	}
+}
+
+func TestBuilderCheckpointClearsError(t *testing.T) {
+	b := NewBuilder(DefaultCompression)
+	b.AddCompressedData([]byte("hello "))
+
+	cp := b.Checkpoint()
+	b.AddCompressedData([]byte("partial "))
+	b.AddPrecompressedData(MustPrecompressedData(PrecompressData([]byte("a"), BestSpeed)))
+	require.Error(t, b.Err())
+
+	b.Rollback(cp)
+	require.NoError(t, b.Err())
+
+	b.AddCompressedData([]byte("world"))
+	assert.Equal(t, "hello world", decompressBytes(t, b.BytesOrPanic()))
+}
+
+func TestBuilderCheckpointMultiple(t *testing.T) {
+	b := NewBuilder(DefaultCompression)
+	b.AddUncompressedData([]byte("a"))
+	cp1 := b.Checkpoint()
+	b.AddUncompressedData([]byte("b"))
+	cp2 := b.Checkpoint()
+	b.AddUncompressedData([]byte("c"))
+
+	b.Rollback(cp2)
+	b.AddUncompressedData([]byte("d"))
+	b.Rollback(cp2)
+	b.AddUncompressedData([]byte("e"))
+	b.Rollback(cp1)
+	b.AddCompressedData([]byte("f"))
+
+	assert.Equal(t, "af", decompressBytes(t, b.BytesOrPanic()))
+}
+
+func TestBuilderCheckpointIndex(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+
+	b := NewBuilder(DefaultCompression)
+	b.IndexEvery(8 << 10)
+	b.AddCompressedData(doc[:20<<10])
+	cp := b.Checkpoint()
+	b.AddCompressedData(doc)
+	b.Rollback(cp)
+	b.AddCompressedData(doc[20<<10:])
+	out := b.BytesOrPanic()
+
+	require.Equal(t, string(doc), decompressBytes(t, out))
+
+	r := NewIndexedReader(bytes.NewReader(out), b.Index())
+	for off := int64(0); off+100 <= int64(len(doc)); off += 5 << 10 {
+		p := make([]byte, 100)
+		_, err := r.ReadAt(p, off)
+		require.NoError(t, err)
+		assert.Equal(t, doc[off:off+100], p, "at offset %d", off)
+	}
+}
+
+func TestBuilderCheckpointPrecompressed(t *testing.T) {
+	b := NewBuilder(DefaultCompression)
+	b.AddCompressedData([]byte("hello "))
+	cp := b.Checkpoint()
+	b.AddCompressedData([]byte("world"))
+
+	pd, err := b.Precompressed()
+	require.NoError(t, err)
+
+	b.Rollback(cp)
+	b.AddUncompressedData([]byte("there"))
+	b.Precompressed()
+
+	b2 := NewBuilder(DefaultCompression)
+	b2.AddPrecompressedData(pd)
+	assert.Equal(t, "hello world", decompressBytes(t, b2.BytesOrPanic()),
+		"PrecompressedData should not be overwritten by Rollback")
+}
+
+func TestBuilderCheckpointErrors(t *testing.T) {
+	b := NewBuilder(DefaultCompression)
+	b.Rollback(NewBuilder(DefaultCompression).Checkpoint())
+	assert.EqualError(t, b.Err(), "gzipbuilder: checkpoint is from another builder")
+
+	b = NewBuilder(DefaultCompression)
+	cp := b.Checkpoint()
+	b.BytesOrPanic()
+	b.Rollback(cp)
+	assert.EqualError(t, b.Err(), "gzipbuilder: cannot roll back builder after footer written")
+
+	b = NewBuilder(DefaultCompression)
+	b.UncompressedDigest(sha256.New())
+	b.Checkpoint()
+	assert.EqualError(t, b.Err(), "gzipbuilder: cannot checkpoint builder with uncompressed digest")
+}
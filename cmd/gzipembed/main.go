@@ -0,0 +1,380 @@
+// Command gzipembed generates Go source declaring *gzipbuilder.PrecompressedData
+// variables for a set of files. It is intended to be used with go generate:
+//
+//	//go:generate gzipembed -o assets.go static/*.html static/*.js
+//
+// Each variable is named after the path of the file and is ready to be passed
+// to AddPrecompressedData without compressing the file at runtime. The data is
+// not decompressed to validate it at init either. Instead, when -o is given, a
+// test file is generated next to the output, such as assets_test.go, that
+// validates each variable with NewPrecompressedData, so that a stale or edited
+// file is caught by go test.
+//
+// If -fs is given, an embed.FS variable with that name that embeds the
+// original files is also declared. This requires Go 1.16 or later to build the
+// generated file, so -fs should only be used in modules that require it. The
+// files must be within the directory of the output file, as go:embed paths are
+// relative to it.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"go.tmthrgd.dev/gzipbuilder"
+)
+
+type config struct {
+	pkg    string
+	prefix string
+	fsVar  string
+	level  int
+
+	// dir is the directory of the output file, which go:embed paths are
+	// relative to.
+	dir string
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.pkg, "pkg", os.Getenv("GOPACKAGE"), "the package name of the generated file")
+	flag.StringVar(&cfg.prefix, "prefix", "", "a prefix for generated variable names")
+	flag.StringVar(&cfg.fsVar, "fs", "", "the name of an embed.FS variable to declare (requires Go 1.16)")
+	flag.IntVar(&cfg.level, "level", gzipbuilder.BestCompression, "the compression level")
+	exhaustive := flag.Bool("exhaustive", false, "compress exhaustively, which is much slower but gives smaller output")
+	out := flag.String("o", "", "the output file (default stdout)")
+	flag.Parse()
+
+	if *exhaustive {
+		cfg.level = gzipbuilder.ExhaustiveCompression
+	}
+
+	log.SetFlags(0)
+	log.SetPrefix("gzipembed: ")
+
+	if cfg.pkg == "" {
+		log.Fatal("-pkg is required when not run from go generate")
+	}
+
+	files, err := expandGlobs(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(files) == 0 {
+		log.Fatal("no input files")
+	}
+
+	if *out != "" {
+		cfg.dir = filepath.Dir(*out)
+	}
+
+	var buf bytes.Buffer
+	if err := generate(&buf, files, cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	if *out == "" {
+		if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := ioutil.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	buf.Reset()
+	base := strings.TrimSuffix(*out, ".go")
+	if err := generateTest(&buf, files, filepath.Base(base), cfg); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(base+"_test.go", buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// expandGlobs expands each pattern into the sorted list of regular files that
+// it matches.
+func expandGlobs(patterns []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if matches == nil {
+			return nil, fmt.Errorf("pattern %q matched no files", pattern)
+		}
+
+		for _, match := range matches {
+			fi, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !fi.Mode().IsRegular() || seen[match] {
+				continue
+			}
+
+			seen[match] = true
+			files = append(files, match)
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// varNames returns the variable name of each file.
+func varNames(prefix string, files []string) ([]string, error) {
+	names := make([]string, len(files))
+	seen := make(map[string]string)
+	for i, file := range files {
+		name := varName(prefix, file)
+		if other, dup := seen[name]; dup {
+			return nil, fmt.Errorf("%s and %s both map to variable name %s", other, file, name)
+		}
+		seen[name] = file
+		names[i] = name
+	}
+
+	return names, nil
+}
+
+// embedPath returns the go:embed path of file, which is relative to dir. It
+// returns an error if file is not within dir.
+func embedPath(dir, file string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(absDir, absFile)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside %s, the directory of the output file, so it cannot be embedded", file, absDir)
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+func generate(w io.Writer, files []string, cfg config) error {
+	names, err := varNames(cfg.prefix, files)
+	if err != nil {
+		return err
+	}
+
+	var embeds []string
+	if cfg.fsVar != "" {
+		for _, file := range files {
+			p, err := embedPath(cfg.dir, file)
+			if err != nil {
+				return err
+			}
+			embeds = append(embeds, p)
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by gzipembed; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", cfg.pkg)
+
+	if cfg.fsVar != "" {
+		buf.WriteString("import (\n\t\"embed\"\n\n\t\"go.tmthrgd.dev/gzipbuilder\"\n)\n\n")
+	} else {
+		buf.WriteString("import \"go.tmthrgd.dev/gzipbuilder\"\n\n")
+	}
+
+	for i, file := range files {
+		name := names[i]
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		d, err := gzipbuilder.PrecompressData(data, cfg.level)
+		if err != nil {
+			return err
+		}
+
+		var comp bytes.Buffer
+		if _, err := d.WriteTo(&comp); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&buf, "// %s is the precompressed form of %s.\n", name, filepath.ToSlash(file))
+		fmt.Fprintf(&buf, "var %s = gzipbuilder.UncheckedPrecompressedData(", name)
+		writeBytes(&buf, comp.Bytes())
+		fmt.Fprintf(&buf, ", %#08x, %d, %s)\n\n", d.CRC32(), d.Size(), levelName(d.Level()))
+	}
+
+	if cfg.fsVar != "" {
+		fmt.Fprintf(&buf, "// %s holds the uncompressed files. It requires Go 1.16 or later.\n", cfg.fsVar)
+		for _, p := range embeds {
+			fmt.Fprintf(&buf, "//go:embed %s\n", p)
+		}
+		fmt.Fprintf(&buf, "var %s embed.FS\n", cfg.fsVar)
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(src)
+	return err
+}
+
+// generateTest writes a test that validates each variable declared by
+// generate with NewPrecompressedData. base is the name of the output file,
+// without its extension, which the test is named after.
+func generateTest(w io.Writer, files []string, base string, cfg config) error {
+	names, err := varNames(cfg.prefix, files)
+	if err != nil {
+		return err
+	}
+
+	test := varName("", base)
+	test = "TestGzipembed" + strings.ToUpper(test[:1]) + test[1:]
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by gzipembed; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", cfg.pkg)
+	buf.WriteString("import (\n\t\"bytes\"\n\t\"testing\"\n\n\t\"go.tmthrgd.dev/gzipbuilder\"\n)\n\n")
+
+	fmt.Fprintf(&buf, "func %s(t *testing.T) {\n", test)
+	buf.WriteString("\tfor name, d := range map[string]*gzipbuilder.PrecompressedData{\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "\t\t%q: %s,\n", name, name)
+	}
+	buf.WriteString(`	} {
+		var buf bytes.Buffer
+		if _, err := d.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := gzipbuilder.NewPrecompressedData(buf.Bytes(), d.CRC32(), d.Size(), d.Level()); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+`)
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(src)
+	return err
+}
+
+// writeBytes writes p as a []byte conversion of a string literal, split over
+// multiple lines. The string is static data, which the conversion copies once
+// at init.
+func writeBytes(buf *bytes.Buffer, p []byte) {
+	const lineLen = 32
+
+	if len(p) == 0 {
+		buf.WriteString("nil")
+		return
+	}
+
+	buf.WriteString("[]byte(")
+	for i := 0; len(p) > 0; i++ {
+		n := lineLen
+		if n > len(p) {
+			n = len(p)
+		}
+
+		if i > 0 {
+			buf.WriteString(" +\n\t")
+		}
+		buf.WriteByte('"')
+		for _, c := range p[:n] {
+			fmt.Fprintf(buf, "\\x%02x", c)
+		}
+		buf.WriteByte('"')
+		p = p[n:]
+	}
+	buf.WriteString(")")
+}
+
+func levelName(level int) string {
+	switch level {
+	case gzipbuilder.NoCompression:
+		return "gzipbuilder.NoCompression"
+	case gzipbuilder.BestSpeed:
+		return "gzipbuilder.BestSpeed"
+	case gzipbuilder.BestCompression:
+		return "gzipbuilder.BestCompression"
+	case gzipbuilder.DefaultCompression:
+		return "gzipbuilder.DefaultCompression"
+	case gzipbuilder.HuffmanOnly:
+		return "gzipbuilder.HuffmanOnly"
+	default:
+		return strconv.Itoa(level)
+	}
+}
+
+// varName converts a file path into a Go identifier, such as
+// static/index.html into staticIndexHTML.
+func varName(prefix, file string) string {
+	var name strings.Builder
+	name.WriteString(prefix)
+
+	for _, word := range strings.FieldsFunc(file, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		switch {
+		case commonInitialisms[strings.ToUpper(word)] && name.Len() > 0:
+			word = strings.ToUpper(word)
+		case name.Len() > 0:
+			word = strings.ToUpper(word[:1]) + word[1:]
+		default:
+			word = strings.ToLower(word[:1]) + word[1:]
+		}
+
+		name.WriteString(word)
+	}
+
+	s := name.String()
+	if s == "" || unicode.IsDigit(rune(s[0])) {
+		s = "_" + s
+	}
+	if token.Lookup(s).IsKeyword() {
+		s += "_"
+	}
+	return s
+}
+
+var commonInitialisms = map[string]bool{
+	"CSS":  true,
+	"GIF":  true,
+	"HTML": true,
+	"ICO":  true,
+	"JPG":  true,
+	"JS":   true,
+	"JSON": true,
+	"PNG":  true,
+	"SVG":  true,
+	"TXT":  true,
+	"XML":  true,
+}
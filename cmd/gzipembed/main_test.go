@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.tmthrgd.dev/gzipbuilder"
+)
+
+func TestVarName(t *testing.T) {
+	for _, tc := range []struct{ prefix, file, name string }{
+		{"", "static/index.html", "staticIndexHTML"},
+		{"", "app.min.js", "appMinJS"},
+		{"asset", "style.css", "assetStyleCSS"},
+		{"", "404.html", "_404HTML"},
+		{"", "type", "type_"},
+		{"", "Main.Go", "mainGo"},
+	} {
+		assert.Equal(t, tc.name, varName(tc.prefix, tc.file), "varName(%q, %q)", tc.prefix, tc.file)
+	}
+}
+
+// constString folds a concatenation of string literals.
+func constString(t *testing.T, expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.BasicLit:
+		s, err := strconv.Unquote(expr.Value)
+		require.NoError(t, err, "invalid string literal")
+		return s
+	case *ast.BinaryExpr:
+		return constString(t, expr.X) + constString(t, expr.Y)
+	default:
+		t.Fatalf("unexpected expression %T", expr)
+		return ""
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gzipembed")
+	require.NoError(t, err, "creating temporary directory")
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("<p>hello world</p>\n"), 100)
+	file := filepath.Join(dir, "index.html")
+	require.NoError(t, ioutil.WriteFile(file, content, 0644))
+
+	var buf bytes.Buffer
+	require.NoError(t, generate(&buf, []string{file}, config{
+		pkg:   "assets",
+		fsVar: "files",
+		level: gzipbuilder.DefaultCompression,
+		dir:   dir,
+	}), "generate failed")
+
+	f, err := parser.ParseFile(token.NewFileSet(), "assets.go", buf.Bytes(), parser.ParseComments)
+	require.NoError(t, err, "generated invalid Go source")
+	assert.Equal(t, "assets", f.Name.Name)
+
+	var call *ast.CallExpr
+	ast.Inspect(f, func(n ast.Node) bool {
+		if c, ok := n.(*ast.CallExpr); ok {
+			if sel, ok := c.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "UncheckedPrecompressedData" {
+				call = c
+			}
+		}
+		return call == nil
+	})
+	require.NotNil(t, call, "missing call to UncheckedPrecompressedData")
+	require.Len(t, call.Args, 4)
+
+	data := constString(t, call.Args[0].(*ast.CallExpr).Args[0])
+	crc, err := strconv.ParseUint(call.Args[1].(*ast.BasicLit).Value, 0, 32)
+	require.NoError(t, err, "invalid CRC-32")
+	size, err := strconv.ParseUint(call.Args[2].(*ast.BasicLit).Value, 0, 64)
+	require.NoError(t, err, "invalid size")
+
+	d, err := gzipbuilder.NewPrecompressedData([]byte(data), uint32(crc), size, gzipbuilder.DefaultCompression)
+	require.NoError(t, err, "NewPrecompressedData failed")
+
+	b := gzipbuilder.NewBuilder(gzipbuilder.DefaultCompression)
+	b.RawDeflate()
+	b.AddPrecompressedData(d)
+	assert.NotEmpty(t, b.BytesOrPanic())
+
+	assert.Contains(t, buf.String(), "//go:embed index.html\nvar files embed.FS")
+	assert.NotContains(t, buf.String(), "NewPrecompressedData", "data should not be validated at init")
+}
+
+func TestGenerateExhaustive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gzipembed")
+	require.NoError(t, err, "creating temporary directory")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "index.html")
+	require.NoError(t, ioutil.WriteFile(file, bytes.Repeat([]byte("<p>hello world</p>\n"), 100), 0644))
+
+	var buf bytes.Buffer
+	require.NoError(t, generate(&buf, []string{file}, config{
+		pkg:   "assets",
+		level: gzipbuilder.ExhaustiveCompression,
+	}), "generate failed")
+
+	assert.Contains(t, buf.String(), ", gzipbuilder.BestCompression)\n")
+}
+
+func TestGenerateEmbedPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gzipembed")
+	require.NoError(t, err, "creating temporary directory")
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "static"), 0755))
+	for _, name := range []string{"index.html", "static/app.js"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("hello"), 0644))
+	}
+
+	for _, tc := range []struct{ file, path string }{
+		{filepath.Join(dir, "index.html"), "index.html"},
+		{filepath.Join(dir, "static", "app.js"), "static/app.js"},
+		{filepath.Join(dir, "static", "..", "index.html"), "index.html"},
+	} {
+		p, err := embedPath(dir, tc.file)
+		require.NoError(t, err, tc.file)
+		assert.Equal(t, tc.path, p, tc.file)
+	}
+
+	// The output file may be in a subdirectory of the inputs.
+	_, err = embedPath(filepath.Join(dir, "static"), filepath.Join(dir, "index.html"))
+	assert.Error(t, err)
+
+	var buf bytes.Buffer
+	err = generate(&buf, []string{filepath.Join(dir, "index.html")}, config{
+		pkg:   "assets",
+		fsVar: "files",
+		level: gzipbuilder.DefaultCompression,
+		dir:   filepath.Join(dir, "static"),
+	})
+	assert.Error(t, err, "files outside the output directory should be rejected")
+}
+
+func TestGenerateTest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gzipembed")
+	require.NoError(t, err, "creating temporary directory")
+	defer os.RemoveAll(dir)
+
+	files := []string{filepath.Join(dir, "index.html"), filepath.Join(dir, "app.js")}
+	for _, file := range files {
+		require.NoError(t, ioutil.WriteFile(file, []byte("hello"), 0644))
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, generateTest(&buf, files, "assets", config{pkg: "assets"}), "generateTest failed")
+
+	f, err := parser.ParseFile(token.NewFileSet(), "assets_test.go", buf.Bytes(), 0)
+	require.NoError(t, err, "generated invalid Go source")
+	assert.Equal(t, "assets", f.Name.Name)
+
+	var funcs []string
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			funcs = append(funcs, fn.Name.Name)
+		}
+	}
+	assert.Equal(t, []string{"TestGzipembedAssets"}, funcs)
+
+	src := buf.String()
+	assert.Contains(t, src, "gzipbuilder.NewPrecompressedData(")
+	for _, file := range files {
+		name := varName("", file)
+		assert.Regexp(t, strconv.Quote(name)+`:\s+`+name+`,`, src)
+	}
+}
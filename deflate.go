@@ -0,0 +1,1092 @@
+package gzipbuilder
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+const (
+	minMatch = 3
+	maxMatch = 258
+
+	// minLookahead is the input needed to find a match of maxMatch bytes
+	// at the next position.
+	minLookahead = maxMatch + minMatch + 1
+
+	// maxDist is the greatest distance searched for a match. It is a
+	// little less than windowSize so that the hash chains, which are
+	// indexed modulo windowSize, are never overwritten while in use.
+	maxDist = windowSize - minLookahead
+
+	// tooFar is the distance beyond which a match of minMatch bytes costs
+	// more than the literals it replaces.
+	tooFar = 4096
+
+	hashBits = 15
+	hashSize = 1 << hashBits
+
+	// maxBlockTokens is the number of literals and matches after which a
+	// block is written.
+	maxBlockTokens = 1 << 14
+
+	endBlockSym = 256
+)
+
+// encoderConfig holds the parameters of a compression level. They are those
+// of zlib.
+type encoderConfig struct {
+	// good is the match length above which the search for a longer match
+	// is shortened, lazy is the match length above which no lazy search is
+	// made, nice is the match length at which a search stops and chain is
+	// the number of hash chain entries searched.
+	//
+	// For the greedy levels, lazy is instead the longest match whose
+	// strings are added to the hash chains.
+	good, lazy, nice, chain int
+
+	greedy bool
+}
+
+var encoderConfigs = [...]encoderConfig{
+	BestSpeed: {4, 4, 8, 4, true},
+	2:         {4, 5, 16, 8, true},
+	3:         {4, 6, 32, 32, true},
+	4:         {4, 4, 16, 16, false},
+	5:         {8, 16, 32, 32, false},
+	6:         {8, 16, 128, 128, false},
+	7:         {8, 32, 128, 256, false},
+	8:         {32, 128, 258, 1024, false},
+	9:         {32, 258, 258, 4096, false},
+
+	ExhaustiveCompression: {258, 258, 258, 8192, false},
+}
+
+// A token is a literal byte or, if matchToken is set, a match of length
+// minMatch+(t>>16&0xff) bytes at a distance of 1+(t&0xffff).
+type token uint32
+
+const matchToken token = 1 << 31
+
+func literal(c byte) token { return token(c) }
+
+func match(length, dist int) token {
+	return matchToken | token(length-minMatch)<<16 | token(dist-1)
+}
+
+func (t token) length() int { return int(t>>16&0xff) + minMatch }
+func (t token) dist() int   { return int(t&0xffff) + 1 }
+
+// lengthCodes and distCodes map match lengths and distances to their symbols,
+// as zlib's _length_code and _dist_code do.
+var (
+	lengthCodes [maxMatch - minMatch + 1]uint8
+	distCodes   [512]uint8
+
+	fixedLitCode, fixedDistCode []hcode
+)
+
+func init() {
+	for code, base := range lengthBase[:len(lengthBase)-1] {
+		for i := 0; i < 1<<lengthExtra[code]; i++ {
+			lengthCodes[int(base)-minMatch+i] = uint8(code)
+		}
+	}
+	lengthCodes[maxMatch-minMatch] = uint8(len(lengthBase) - 1)
+
+	for code, base := range distBase {
+		for i := 0; i < 1<<distExtra[code]; i++ {
+			d := int(base) - 1 + i
+			if d >= 256 {
+				d = 256 + d>>7
+			}
+			distCodes[d] = uint8(code)
+		}
+	}
+
+	var lens [fixedLitCodes]uint8
+	for sym := range lens {
+		switch {
+		case sym < 144:
+			lens[sym] = 8
+		case sym < 256:
+			lens[sym] = 9
+		case sym < 280:
+			lens[sym] = 7
+		default:
+			lens[sym] = 8
+		}
+	}
+	fixedLitCode = make([]hcode, fixedLitCodes)
+	assignCodes(fixedLitCode, lens[:])
+
+	for sym := range lens[:maxDistCodes] {
+		lens[sym] = 5
+	}
+	fixedDistCode = make([]hcode, maxDistCodes)
+	assignCodes(fixedDistCode, lens[:maxDistCodes])
+}
+
+func lengthCode(length int) int { return int(lengthCodes[length-minMatch]) }
+
+func distCode(dist int) int {
+	if dist--; dist < 256 {
+		return int(distCodes[dist])
+	}
+
+	return int(distCodes[256+dist>>7])
+}
+
+// An encoder is a DEFLATE compressor with the same compression levels as
+// compress/flate and output of a similar size.
+//
+// Unlike a flate.Writer, an encoder can be cloned part way through a stream,
+// can be given a window to refer back to at any block boundary and can end a
+// block without aligning the stream to a byte boundary. It is slower than
+// compress/flate, so it is only used where those are needed: by forked
+// PrecompressedWriters, by Splice and at ExhaustiveCompression.
+type encoder struct {
+	level int
+	cfg   encoderConfig
+
+	bw bitWriter
+
+	// written is the number of bytes written to bw.w.
+	written int64
+
+	// window holds up to windowSize bytes of history followed by the
+	// input that is still to be compressed, which begins at pos. The
+	// tokens of the current block cover the input from blockStart, which
+	// is negative if the input has been slid out of window.
+	window     []byte
+	pos        int
+	blockStart int
+
+	// head holds, for each hash, one more than the last position in
+	// window with that hash, or zero. prev holds the same for the position
+	// before each position, modulo windowSize.
+	head [hashSize]int32
+	prev [windowSize]int32
+
+	// inserted is the position up to which compressOptimal has added the
+	// input to the hash chains, which may be beyond pos.
+	inserted int
+
+	// length and dist are the match found at pos-1 that is being
+	// compared with one at pos. pending is set if the byte at pos-1 has
+	// not yet been added as a literal or match.
+	length, dist int
+	pending      bool
+
+	tokens []token
+
+	// Scratch space for writing dynamic blocks.
+	litFreq  [maxLitCodes]int
+	distFreq [maxDistCodes]int
+	litLens  [maxLitCodes]uint8
+	distLens [maxDistCodes]uint8
+	litCode  [maxLitCodes]hcode
+	distCode [maxDistCodes]hcode
+
+	// opt, if non-nil, is the scratch space of compressOptimal.
+	opt *optimalParser
+
+	closed bool
+	err    error
+}
+
+var errEncoderClosed = errors.New("gzipbuilder: write to closed encoder")
+
+// newEncoder returns an encoder that writes to w at the given compression
+// level.
+func newEncoder(w io.Writer, level int) (*encoder, error) {
+	if level != ExhaustiveCompression {
+		if err := validCompressionLevel(level); err != nil {
+			return nil, err
+		}
+	}
+	if level == DefaultCompression {
+		level = 6
+	}
+
+	e := &encoder{
+		level: level,
+
+		window: make([]byte, 0, 2*windowSize),
+		tokens: make([]token, 0, maxBlockTokens),
+	}
+	if level >= BestSpeed {
+		e.cfg = encoderConfigs[level]
+	}
+	e.Reset(w)
+	return e, nil
+}
+
+// Reset discards the encoder's state and makes it equivalent to the result
+// of newEncoder, but writing to w instead.
+func (e *encoder) Reset(w io.Writer) {
+	e.bw = bitWriter{w: w, buf: e.bw.buf[:0]}
+	e.written = 0
+
+	e.window = e.window[:0]
+	e.pos, e.blockStart, e.inserted = 0, 0, 0
+
+	// prev is only read through head, so it needs no clearing.
+	e.head = [hashSize]int32{}
+
+	e.length, e.dist, e.pending = 0, 0, false
+	e.tokens = e.tokens[:0]
+
+	e.closed, e.err = false, nil
+}
+
+// Clone returns a copy of the encoder that writes to w. The copy continues
+// the stream from the same point and the two can then be used independently.
+func (e *encoder) Clone(w io.Writer) *encoder {
+	c := new(encoder)
+	*c = *e
+
+	c.bw = bitWriter{
+		w:   w,
+		buf: append([]byte(nil), e.bw.buf...),
+
+		bits:  e.bw.bits,
+		nbits: e.bw.nbits,
+	}
+
+	c.window = append(make([]byte, 0, cap(e.window)), e.window...)
+	c.tokens = append(make([]token, 0, cap(e.tokens)), e.tokens...)
+	c.opt = nil
+	return c
+}
+
+// history returns a copy of the data that data written next may refer back
+// to, at most windowSize bytes. It must be called at a block boundary.
+func (e *encoder) history() []byte {
+	p := e.window[:e.pos]
+	if len(p) > windowSize {
+		p = p[len(p)-windowSize:]
+	}
+
+	return append([]byte(nil), p...)
+}
+
+// SetWindow sets the history that data written afterwards may refer back to,
+// replacing any data written before. Only the last windowSize bytes of p are
+// used. It must be called at a block boundary, before any data is written or
+// after EndBlock or Flush, and the decoder must be given the same history.
+func (e *encoder) SetWindow(p []byte) {
+	if e.err != nil {
+		return
+	}
+	if e.pos != len(e.window) || len(e.tokens) != 0 {
+		e.err = errors.New("gzipbuilder: encoder window set with data pending")
+		return
+	}
+
+	if len(p) > windowSize {
+		p = p[len(p)-windowSize:]
+	}
+
+	e.window = append(e.window[:0], p...)
+	e.pos, e.blockStart, e.inserted = len(p), len(p), 0
+
+	e.head = [hashSize]int32{}
+	if e.level >= BestSpeed {
+		for i := 0; i+minMatch <= len(p); i++ {
+			e.insert(i)
+		}
+	}
+}
+
+// Write compresses p. Compressed data is written in whole blocks, so data may
+// be held by the encoder until Flush, EndBlock or Close.
+func (e *encoder) Write(p []byte) (int, error) {
+	switch {
+	case e.err != nil:
+		return 0, e.err
+	case e.closed:
+		return 0, errEncoderClosed
+	}
+
+	n := len(p)
+	for len(p) > 0 && e.err == nil {
+		if len(e.window) == cap(e.window) {
+			e.slide()
+		}
+
+		c := copy(e.window[len(e.window):cap(e.window)], p)
+		e.window = e.window[:len(e.window)+c]
+		p = p[c:]
+
+		e.compress(false)
+	}
+	if e.err != nil {
+		return 0, e.err
+	}
+
+	return n, nil
+}
+
+// EndBlock compresses any data held by the encoder and ends the current
+// block, if any. Unlike Flush, the stream is not aligned to a byte boundary.
+// The bits of the final partial byte are held until more is written.
+func (e *encoder) EndBlock() error {
+	if e.err == nil && !e.closed {
+		e.compress(true)
+		if len(e.tokens) > 0 {
+			e.writeBlock(false)
+		}
+		e.flushBits()
+	}
+
+	return e.err
+}
+
+// BitPos returns the number of bits written to the stream, including those
+// held by the encoder. After EndBlock, it is the position of the block
+// boundary.
+func (e *encoder) BitPos() int64 {
+	return (e.written+int64(len(e.bw.buf)))*8 + int64(e.bw.nbits)
+}
+
+// Align ends the current block, as EndBlock does, and then aligns the stream
+// to a byte boundary with as few bits as possible.
+func (e *encoder) Align() error {
+	if e.EndBlock() == nil {
+		e.bw.alignShort()
+		e.flushBits()
+	}
+
+	return e.err
+}
+
+// Flush ends the current block and writes an empty stored block, which aligns
+// the stream to a byte boundary, as a sync flush in zlib or compress/flate
+// does.
+func (e *encoder) Flush() error {
+	if e.EndBlock() == nil {
+		e.bw.alignStored()
+		e.flushBits()
+	}
+
+	return e.err
+}
+
+// Close compresses any data held by the encoder and ends the stream with a
+// final block. It does not close the underlying io.Writer.
+func (e *encoder) Close() error {
+	if e.err != nil || e.closed {
+		return e.err
+	}
+	e.closed = true
+
+	e.compress(true)
+	if len(e.tokens) > 0 {
+		e.writeBlock(true)
+	} else {
+		e.bw.emptyFixedBlock(true)
+	}
+	if e.bw.nbits > 0 {
+		e.bw.writeBits(0, 8-e.bw.nbits)
+	}
+
+	e.flushBits()
+	return e.err
+}
+
+// flushBits writes the whole bytes held by bw.
+func (e *encoder) flushBits() {
+	if e.err != nil || len(e.bw.buf) == 0 {
+		return
+	}
+
+	e.written += int64(len(e.bw.buf))
+	e.err = e.bw.flush()
+}
+
+// slide discards the oldest windowSize bytes of window to make room for more
+// input.
+func (e *encoder) slide() {
+	copy(e.window, e.window[windowSize:])
+	e.window = e.window[:len(e.window)-windowSize]
+	e.pos -= windowSize
+	e.blockStart -= windowSize
+	e.inserted -= windowSize
+
+	slideChain(e.head[:])
+	slideChain(e.prev[:])
+}
+
+func slideChain(chain []int32) {
+	for i, v := range chain {
+		if v > windowSize {
+			chain[i] = v - windowSize
+		} else {
+			chain[i] = 0
+		}
+	}
+}
+
+func (e *encoder) hash(i int) uint32 {
+	v := uint32(e.window[i])<<16 | uint32(e.window[i+1])<<8 | uint32(e.window[i+2])
+	return v * 0x9e3779b1 >> (32 - hashBits)
+}
+
+// insert adds the position i to the hash chains and returns the last
+// position with the same hash, or -1 if there is none.
+func (e *encoder) insert(i int) int {
+	h := e.hash(i)
+	head := e.head[h]
+	e.prev[i%windowSize] = head
+	e.head[h] = int32(i + 1)
+	return int(head) - 1
+}
+
+// findMatch returns the longest match for pos that is longer than best,
+// searching the hash chain from cur. It returns a length of zero if there is
+// none.
+func (e *encoder) findMatch(pos, cur, best int) (length, dist int) {
+	win := e.window
+
+	maxLen := len(win) - pos
+	if maxLen > maxMatch {
+		maxLen = maxMatch
+	}
+	if best >= maxLen {
+		return 0, 0
+	}
+
+	chain, nice := e.cfg.chain, e.cfg.nice
+	if best >= e.cfg.good {
+		chain >>= 2
+	}
+	if nice > maxLen {
+		nice = maxLen
+	}
+
+	limit := pos - maxDist
+	for ; cur >= limit && cur >= 0 && chain > 0; chain-- {
+		if win[cur+best] == win[pos+best] && win[cur] == win[pos] {
+			if n := matchLen(win[cur:cur+maxLen], win[pos:pos+maxLen]); n > best {
+				best, length, dist = n, n, pos-cur
+				if n >= nice {
+					break
+				}
+			}
+		}
+
+		cur = int(e.prev[cur%windowSize]) - 1
+	}
+
+	return length, dist
+}
+
+// matchLen returns the length of the common prefix of a and b, which must
+// be the same length.
+func matchLen(a, b []byte) int {
+	n := 0
+	for len(a) >= 8 {
+		if x := binary.LittleEndian.Uint64(a) ^ binary.LittleEndian.Uint64(b); x != 0 {
+			return n + bits.TrailingZeros64(x)/8
+		}
+
+		a, b = a[8:], b[8:]
+		n += 8
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			break
+		}
+		n++
+	}
+
+	return n
+}
+
+// compress turns the input in window into tokens, writing a block whenever
+// maxBlockTokens is reached. Unless flush is set, enough input is left to
+// find a match of maxMatch bytes at pos.
+func (e *encoder) compress(flush bool) {
+	switch {
+	case e.level < BestSpeed:
+		e.compressLiterals()
+	case e.level == ExhaustiveCompression:
+		e.compressOptimal(flush)
+	case e.cfg.greedy:
+		e.compressGreedy(flush)
+	default:
+		e.compressLazy(flush)
+	}
+}
+
+func (e *encoder) addToken(t token) {
+	if len(e.tokens) == maxBlockTokens {
+		e.writeBlock(false)
+	}
+
+	e.tokens = append(e.tokens, t)
+}
+
+// compressLiterals adds all of the input as literals, for NoCompression and
+// HuffmanOnly.
+func (e *encoder) compressLiterals() {
+	for ; e.pos < len(e.window); e.pos++ {
+		e.addToken(literal(e.window[e.pos]))
+	}
+}
+
+// compressGreedy uses each match as soon as it is found, as zlib's
+// deflate_fast does.
+func (e *encoder) compressGreedy(flush bool) {
+	for e.err == nil {
+		lookahead := len(e.window) - e.pos
+		if lookahead == 0 || !flush && lookahead < minLookahead {
+			return
+		}
+
+		var length, dist int
+		if lookahead >= minMatch {
+			if cur := e.insert(e.pos); cur >= 0 {
+				length, dist = e.findMatch(e.pos, cur, minMatch-1)
+				if length == minMatch && dist > tooFar {
+					length = 0
+				}
+			}
+		}
+
+		if length == 0 {
+			e.addToken(literal(e.window[e.pos]))
+			e.pos++
+			continue
+		}
+
+		e.addToken(match(length, dist))
+		end := e.pos + length
+		maxInsert := len(e.window) - minMatch
+		if length > e.cfg.lazy {
+			// Only the last string of a long match is added, so that
+			// a run is continued at the same distance.
+			if e.pos = end; e.pos-1 <= maxInsert {
+				e.insert(e.pos - 1)
+			}
+			continue
+		}
+
+		for e.pos++; e.pos < end; e.pos++ {
+			if e.pos <= maxInsert {
+				e.insert(e.pos)
+			}
+		}
+	}
+}
+
+// compressLazy only uses a match if there is no longer match at the next
+// position, as zlib's deflate_slow does.
+func (e *encoder) compressLazy(flush bool) {
+	for e.err == nil {
+		lookahead := len(e.window) - e.pos
+		if lookahead == 0 || !flush && lookahead < minLookahead {
+			break
+		}
+
+		prevLength, prevDist := e.length, e.dist
+		e.length, e.dist = 0, 0
+		if lookahead >= minMatch {
+			if cur := e.insert(e.pos); cur >= 0 && prevLength < e.cfg.lazy {
+				best := prevLength
+				if best < minMatch-1 {
+					best = minMatch - 1
+				}
+
+				e.length, e.dist = e.findMatch(e.pos, cur, best)
+				if e.length == minMatch && e.dist > tooFar {
+					e.length = 0
+				}
+			}
+		}
+
+		if prevLength == 0 || e.length > prevLength {
+			if e.pending {
+				e.addToken(literal(e.window[e.pos-1]))
+			}
+			e.pending = true
+			e.pos++
+			continue
+		}
+
+		// The match at pos-1 is at least as long as any at pos.
+		e.addToken(match(prevLength, prevDist))
+		end := e.pos - 1 + prevLength
+		maxInsert := len(e.window) - minMatch
+		for e.pos++; e.pos < end; e.pos++ {
+			if e.pos <= maxInsert {
+				e.insert(e.pos)
+			}
+		}
+		e.length, e.pending = 0, false
+	}
+
+	if flush && e.pending && e.err == nil {
+		e.addToken(literal(e.window[e.pos-1]))
+		e.length, e.pending = 0, false
+	}
+}
+
+// writeBlock writes the tokens as a single block, using whichever of the
+// stored, fixed and dynamic encodings is shortest. At ExhaustiveCompression,
+// the tokens are instead split into the blocks that encode them shortest.
+func (e *encoder) writeBlock(final bool) {
+	if e.err != nil {
+		return
+	}
+
+	end := e.pos
+	if e.pending {
+		end--
+	}
+
+	if e.level == ExhaustiveCompression {
+		e.writeSplitBlocks(final)
+	} else {
+		e.writeTokenBlock(e.tokens, end, final)
+	}
+
+	e.tokens = e.tokens[:0]
+	e.flushBits()
+}
+
+// writeTokenBlock writes tokens, which cover the input from blockStart to end,
+// as a single block.
+func (e *encoder) writeTokenBlock(tokens []token, end int, final bool) {
+	extraBits := e.countTokens(tokens)
+	hdr, dynamicBits, fixedBits := e.dynamicCodes(extraBits)
+
+	storedBits := -1
+	if e.blockStart >= 0 {
+		storedBits = storedBlockBits(e.bw.nbits, end-e.blockStart)
+	}
+
+	switch {
+	case storedBits >= 0 && (e.level == NoCompression || storedBits <= fixedBits && storedBits <= dynamicBits):
+		e.writeStored(e.window[e.blockStart:end], final)
+	case fixedBits <= dynamicBits:
+		e.writeHeader(1, final)
+		writeTokens(&e.bw, tokens, fixedLitCode, fixedDistCode)
+	default:
+		e.writeHeader(2, final)
+		assignCodes(e.litCode[:], e.litLens[:])
+		assignCodes(e.distCode[:], e.distLens[:])
+		hdr.write(&e.bw)
+		writeTokens(&e.bw, tokens, e.litCode[:], e.distCode[:])
+	}
+
+	e.blockStart = end
+}
+
+// countTokens counts the symbols of tokens, and the end of block symbol, in
+// litFreq and distFreq. It returns the number of extra bits the tokens need.
+func (e *encoder) countTokens(tokens []token) int {
+	e.litFreq = [maxLitCodes]int{}
+	e.distFreq = [maxDistCodes]int{}
+	extraBits := 0
+	for _, t := range tokens {
+		if t&matchToken == 0 {
+			e.litFreq[t]++
+			continue
+		}
+
+		lc, dc := lengthCode(t.length()), distCode(t.dist())
+		e.litFreq[257+lc]++
+		e.distFreq[dc]++
+		extraBits += int(lengthExtra[lc]) + int(distExtra[dc])
+	}
+	e.litFreq[endBlockSym]++
+
+	return extraBits
+}
+
+// dynamicCodes builds the dynamic Huffman codes for the symbols counted by
+// countTokens in litLens and distLens. It returns their header and the size in
+// bits of a dynamic and a fixed block holding the symbols.
+func (e *encoder) dynamicCodes(extraBits int) (hdr *dynamicHeader, dynamicBits, fixedBits int) {
+	huffmanLengths(e.litLens[:], e.litFreq[:], maxCodeBits)
+	huffmanLengths(e.distLens[:], e.distFreq[:], maxCodeBits)
+	hdr = newDynamicHeader(e.litLens[:], e.distLens[:])
+	dynamicBits = 3 + hdr.bits + extraBits + e.symbolBits()
+
+	if e.level == ExhaustiveCompression {
+		// Code lengths that suit the run-length encoding of the header
+		// can save more there than they cost in the symbols.
+		lits, dists := e.litLens, e.distLens
+		rleHuffmanLengths(e.litLens[:], e.litFreq[:])
+		rleHuffmanLengths(e.distLens[:], e.distFreq[:])
+
+		rleHdr := newDynamicHeader(e.litLens[:], e.distLens[:])
+		if bits := 3 + rleHdr.bits + extraBits + e.symbolBits(); bits < dynamicBits {
+			hdr, dynamicBits = rleHdr, bits
+		} else {
+			e.litLens, e.distLens = lits, dists
+		}
+	}
+
+	fixedBits = 3 + extraBits
+	for sym, f := range e.litFreq {
+		fixedBits += f * int(fixedLitCode[sym].len)
+	}
+	for sym, f := range e.distFreq {
+		fixedBits += f * int(fixedDistCode[sym].len)
+	}
+
+	return hdr, dynamicBits, fixedBits
+}
+
+// symbolBits returns the size in bits of the symbols counted by countTokens,
+// coded with litLens and distLens.
+func (e *encoder) symbolBits() int {
+	bits := 0
+	for sym, f := range e.litFreq {
+		bits += f * int(e.litLens[sym])
+	}
+	for sym, f := range e.distFreq {
+		bits += f * int(e.distLens[sym])
+	}
+
+	return bits
+}
+
+func (e *encoder) writeHeader(btype uint64, final bool) {
+	if final {
+		e.bw.writeBits(btype<<1|1, 3)
+	} else {
+		e.bw.writeBits(btype<<1, 3)
+	}
+}
+
+// storedBlockBits returns the number of bits needed to write n bytes as stored
+// blocks, from a position nbits into a byte.
+func storedBlockBits(nbits uint, n int) int {
+	bits := 0
+	for {
+		bits += 3
+		if r := (int(nbits) + bits) % 8; r != 0 {
+			bits += 8 - r
+		}
+
+		chunk := n
+		if chunk > storedBlockLen {
+			chunk = storedBlockLen
+		}
+		bits += (storedBlockHeaderLen-1)*8 + chunk*8
+
+		if n -= chunk; n == 0 {
+			return bits
+		}
+	}
+}
+
+func (e *encoder) writeStored(p []byte, final bool) {
+	for {
+		chunk := p
+		if len(chunk) > storedBlockLen {
+			chunk = chunk[:storedBlockLen]
+		}
+		p = p[len(chunk):]
+
+		e.writeHeader(0, final && len(p) == 0)
+		if e.bw.nbits > 0 {
+			e.bw.writeBits(0, 8-e.bw.nbits)
+		}
+
+		n := uint16(len(chunk))
+		e.bw.buf = append(e.bw.buf, byte(n), byte(n>>8), ^byte(n), ^byte(n>>8))
+		e.bw.buf = append(e.bw.buf, chunk...)
+
+		if len(p) == 0 {
+			return
+		}
+	}
+}
+
+// writeTokens writes tokens, and the end of block symbol, with the given codes.
+func writeTokens(bw *bitWriter, tokens []token, lcodes, dcodes []hcode) {
+	for _, t := range tokens {
+		if t&matchToken == 0 {
+			lcodes[t].write(bw)
+			continue
+		}
+
+		bw.writeBits(matchBits(t, lcodes, dcodes))
+	}
+
+	lcodes[endBlockSym].write(bw)
+}
+
+// matchBits returns the bits of the match t, with its extra bits, which are
+// at most 48 bits long.
+func matchBits(t token, lcodes, dcodes []hcode) (uint64, uint) {
+	length, dist := t.length(), t.dist()
+
+	lc := lengthCode(length)
+	c := lcodes[257+lc]
+	v, n := uint64(c.code), uint(c.len)
+	v |= uint64(length-int(lengthBase[lc])) << n
+	n += uint(lengthExtra[lc])
+
+	dc := distCode(dist)
+	c = dcodes[dc]
+	v |= uint64(c.code) << n
+	n += uint(c.len)
+	v |= uint64(dist-int(distBase[dc])) << n
+	n += uint(distExtra[dc])
+
+	return v, n
+}
+
+// An hcode is a Huffman code, with its bits reversed to be written to a
+// DEFLATE stream.
+type hcode struct {
+	code uint16
+	len  uint8
+}
+
+func (c hcode) write(bw *bitWriter) {
+	bw.writeBits(uint64(c.code), uint(c.len))
+}
+
+// assignCodes assigns the canonical Huffman code for the code lengths lens.
+func assignCodes(codes []hcode, lens []uint8) {
+	var count [maxCodeBits + 1]int
+	for _, l := range lens {
+		count[l]++
+	}
+	count[0] = 0
+
+	var next [maxCodeBits + 1]int
+	for l, code := 1, 0; l <= maxCodeBits; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	for sym, l := range lens {
+		if l == 0 {
+			codes[sym] = hcode{}
+			continue
+		}
+
+		code := next[l]
+		next[l]++
+		codes[sym] = hcode{bits.Reverse16(uint16(code)) >> (16 - l), l}
+	}
+}
+
+// huffmanLengths sets lens to the code lengths of a Huffman code for the
+// symbol frequencies freq, with no code longer than maxBits. At least two
+// symbols are given codes, as a decoder may reject a code with only one.
+func huffmanLengths(lens []uint8, freq []int, maxBits int) {
+	var syms []int
+	for sym, f := range freq {
+		lens[sym] = 0
+		if f > 0 {
+			syms = append(syms, sym)
+		}
+	}
+
+	if len(syms) < 2 {
+		lens[0], lens[1] = 1, 1
+		if len(syms) == 1 && syms[0] > 1 {
+			lens[1], lens[syms[0]] = 0, 1
+		}
+		return
+	}
+
+	sort.Slice(syms, func(i, j int) bool {
+		fi, fj := freq[syms[i]], freq[syms[j]]
+		return fi < fj || fi == fj && syms[i] < syms[j]
+	})
+
+	// Build the tree with two queues: the leaves, which are sorted, and
+	// the internal nodes, which are created in order of weight.
+	n := len(syms)
+	weight := make([]int, 2*n-1)
+	parent := make([]int, 2*n-1)
+	for i, sym := range syms {
+		weight[i] = freq[sym]
+	}
+
+	leaf, node := 0, n
+	for next := n; next < len(weight); next++ {
+		for k := 0; k < 2; k++ {
+			pick := node
+			if leaf < n && (node == next || weight[leaf] <= weight[node]) {
+				pick = leaf
+				leaf++
+			} else {
+				node++
+			}
+
+			weight[next] += weight[pick]
+			parent[pick] = next
+		}
+	}
+
+	// weight is reused to hold the depth of each node.
+	var count [maxCodeBits + 1]int
+	weight[len(weight)-1] = 0
+	for i := len(weight) - 2; i >= 0; i-- {
+		weight[i] = weight[parent[i]] + 1
+		if i < n {
+			d := weight[i]
+			if d > maxBits {
+				d = maxBits
+			}
+			count[d]++
+		}
+	}
+
+	// Limiting the lengths over-subscribes the code, which is corrected by
+	// lengthening shorter codes, as miniz does.
+	total := 0
+	for l := 1; l <= maxBits; l++ {
+		total += count[l] << uint(maxBits-l)
+	}
+	for ; total > 1<<uint(maxBits); total-- {
+		count[maxBits]--
+		for l := maxBits - 1; l > 0; l-- {
+			if count[l] > 0 {
+				count[l]--
+				count[l+1] += 2
+				break
+			}
+		}
+	}
+
+	// The least frequent symbols are given the longest codes.
+	i := 0
+	for l := maxBits; l > 0; l-- {
+		for ; count[l] > 0; count[l]-- {
+			lens[syms[i]] = uint8(l)
+			i++
+		}
+	}
+}
+
+// A dynamicHeader is the header of a dynamic block, which holds the code
+// lengths run-length encoded with a third Huffman code.
+type dynamicHeader struct {
+	nlit, ndist, ncode int
+
+	// syms holds the code length symbols, each with its extra bits in
+	// the high byte.
+	syms []uint16
+
+	lens [len(codeLengthOrder)]uint8
+	code [len(codeLengthOrder)]hcode
+
+	// bits is the length of the header in bits, excluding the block
+	// header.
+	bits int
+}
+
+func newDynamicHeader(litLens, distLens []uint8) *dynamicHeader {
+	h := &dynamicHeader{nlit: 257, ndist: 1, ncode: 4}
+	for i, l := range litLens {
+		if l > 0 && i >= h.nlit {
+			h.nlit = i + 1
+		}
+	}
+	for i, l := range distLens {
+		if l > 0 && i >= h.ndist {
+			h.ndist = i + 1
+		}
+	}
+
+	lens := make([]uint8, 0, h.nlit+h.ndist)
+	lens = append(lens, litLens[:h.nlit]...)
+	lens = append(lens, distLens[:h.ndist]...)
+
+	var freq [len(codeLengthOrder)]int
+	add := func(sym, extra int) {
+		h.syms = append(h.syms, uint16(sym)|uint16(extra)<<8)
+		freq[sym]++
+	}
+
+	for i := 0; i < len(lens); {
+		l := lens[i]
+		run := 1
+		for i+run < len(lens) && lens[i+run] == l {
+			run++
+		}
+		i += run
+
+		if l == 0 {
+			for run >= 11 {
+				n := run
+				if n > 138 {
+					n = 138
+				}
+				add(18, n-11)
+				run -= n
+			}
+			if run >= 3 {
+				add(17, run-3)
+				run = 0
+			}
+		} else {
+			add(int(l), 0)
+			for run--; run >= 3; {
+				n := run
+				if n > 6 {
+					n = 6
+				}
+				add(16, n-3)
+				run -= n
+			}
+		}
+
+		for ; run > 0; run-- {
+			add(int(l), 0)
+		}
+	}
+
+	huffmanLengths(h.lens[:], freq[:], 7)
+	for i, sym := range codeLengthOrder {
+		if h.lens[sym] > 0 && i >= h.ncode {
+			h.ncode = i + 1
+		}
+	}
+
+	h.bits = 5 + 5 + 4 + 3*h.ncode
+	for sym, f := range freq {
+		h.bits += f * int(h.lens[sym])
+	}
+	h.bits += 2*freq[16] + 3*freq[17] + 7*freq[18]
+	return h
+}
+
+func (h *dynamicHeader) write(bw *bitWriter) {
+	assignCodes(h.code[:], h.lens[:])
+
+	bw.writeBits(uint64(h.nlit-257), 5)
+	bw.writeBits(uint64(h.ndist-1), 5)
+	bw.writeBits(uint64(h.ncode-4), 4)
+	for _, sym := range codeLengthOrder[:h.ncode] {
+		bw.writeBits(uint64(h.lens[sym]), 3)
+	}
+
+	for _, s := range h.syms {
+		sym, extra := s&0xff, uint64(s>>8)
+		h.code[sym].write(bw)
+		switch sym {
+		case 16:
+			bw.writeBits(extra, 2)
+		case 17:
+			bw.writeBits(extra, 3)
+		case 18:
+			bw.writeBits(extra, 7)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeBytes(t *testing.T, data []byte, level, chunk int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	e, err := newEncoder(&buf, level)
+	require.NoError(t, err)
+
+	for p := data; len(p) > 0; {
+		n := chunk
+		if n > len(p) {
+			n = len(p)
+		}
+
+		_, err := e.Write(p[:n])
+		require.NoError(t, err)
+		p = p[n:]
+	}
+
+	require.NoError(t, e.Close())
+	return buf.Bytes()
+}
+
+func TestEncoder(t *testing.T) {
+	inputs := map[string][]byte{
+		"empty":  nil,
+		"short":  []byte("hello hello hello world"),
+		"text":   spliceTestDocument(300 << 10),
+		"random": randomBytes(100 << 10),
+		"zeros":  make([]byte, 200<<10),
+	}
+
+	for name, data := range inputs {
+		for level := HuffmanOnly; level <= BestCompression; level++ {
+			for _, chunk := range []int{1 << 20, 7919, 1} {
+				if chunk == 1 && len(data) > 1<<10 {
+					continue
+				}
+
+				out := encodeBytes(t, data, level, chunk)
+				assert.Equal(t, string(data), decompressFlateBytes(t, out),
+					"%s: level %d, chunks of %d", name, level, chunk)
+
+				_, err := scanDeflate(out)
+				assert.NoError(t, err, "%s: level %d, chunks of %d", name, level, chunk)
+			}
+		}
+	}
+}
+
+func TestEncoderSize(t *testing.T) {
+	inputs := map[string][]byte{
+		"text":   spliceTestDocument(1 << 20),
+		"random": randomBytes(100 << 10),
+		"zeros":  make([]byte, 200<<10),
+	}
+
+	for name, data := range inputs {
+		for level := HuffmanOnly; level <= BestCompression; level++ {
+			out := encodeBytes(t, data, level, 1<<20)
+
+			var buf bytes.Buffer
+			fw, err := flate.NewWriter(&buf, level)
+			require.NoError(t, err)
+			fw.Write(data)
+			require.NoError(t, fw.Close())
+
+			ratio := float64(len(out)) / float64(buf.Len())
+			assert.True(t, ratio < 1.05, "%s: level %d: %d bytes, flate %d bytes", name, level, len(out), buf.Len())
+
+			debugLogf(t, "%s: level %d: %d bytes, flate %d bytes (%.3f)", name, level, len(out), buf.Len(), ratio)
+		}
+	}
+}
+
+func TestEncoderInvalidLevel(t *testing.T) {
+	_, err := newEncoder(ioutil.Discard, ExhaustiveCompression+1)
+	assert.Error(t, err)
+
+	_, err = newEncoder(ioutil.Discard, HuffmanOnly-1)
+	assert.Error(t, err)
+}
+
+func TestEncoderClone(t *testing.T) {
+	doc := spliceTestDocument(200 << 10)
+
+	for level := HuffmanOnly; level <= BestCompression; level++ {
+		var buf1 bytes.Buffer
+		e1, err := newEncoder(&buf1, level)
+		require.NoError(t, err)
+		e1.Write(doc[:100<<10])
+		require.NoError(t, e1.EndBlock())
+
+		var buf2 bytes.Buffer
+		e2 := e1.Clone(&buf2)
+		prefix := append([]byte(nil), buf1.Bytes()...)
+
+		e1.Write(doc[100<<10:])
+		require.NoError(t, e1.Close())
+
+		e2.Write([]byte("goodbye"))
+		e2.Write(doc[:10<<10])
+		require.NoError(t, e2.Close())
+
+		assert.Equal(t, string(doc), decompressFlateBytes(t, buf1.Bytes()), "level %d", level)
+		assert.Equal(t, string(doc[:100<<10])+"goodbye"+string(doc[:10<<10]),
+			decompressFlateBytes(t, append(prefix, buf2.Bytes()...)), "level %d", level)
+	}
+}
+
+func TestEncoderSetWindow(t *testing.T) {
+	dict := randomBytes(20 << 10)
+	data := append(spliceTestDocument(10<<10), dict...)
+
+	for level := HuffmanOnly; level <= BestCompression; level++ {
+		var buf bytes.Buffer
+		e, err := newEncoder(&buf, level)
+		require.NoError(t, err)
+		e.SetWindow(dict)
+		e.Write(data)
+		require.NoError(t, e.Close())
+
+		r := flate.NewReaderDict(bytes.NewReader(buf.Bytes()), dict)
+		out, err := ioutil.ReadAll(r)
+		require.NoError(t, err, "level %d", level)
+		assert.Equal(t, string(data), string(out), "level %d", level)
+
+		if level >= BestSpeed {
+			assert.True(t, buf.Len() < len(dict)/2, "level %d: window should be referred to", level)
+		}
+	}
+
+	e, err := newEncoder(ioutil.Discard, DefaultCompression)
+	require.NoError(t, err)
+	e.Write([]byte("hello"))
+	e.SetWindow(dict)
+	assert.EqualError(t, e.EndBlock(), "gzipbuilder: encoder window set with data pending")
+}
+
+func TestEncoderBlockBoundaries(t *testing.T) {
+	doc := spliceTestDocument(50 << 10)
+
+	for level := HuffmanOnly; level <= BestCompression; level++ {
+		var buf bytes.Buffer
+		e, err := newEncoder(&buf, level)
+		require.NoError(t, err)
+
+		var ends []int64
+		for i := 0; i < 20; i++ {
+			e.Write(doc[i*100 : (i+1)*100])
+			require.NoError(t, e.EndBlock())
+			ends = append(ends, e.BitPos())
+		}
+
+		require.NoError(t, e.Align())
+		assert.Zero(t, e.BitPos()%8, "level %d", level)
+		assert.True(t, e.BitPos()-ends[len(ends)-1] < 3+7+3+32+8, "level %d", level)
+		require.NoError(t, e.Close())
+
+		assert.Equal(t, string(doc[:2000]), decompressFlateBytes(t, buf.Bytes()), "level %d", level)
+
+		f := newInflater(buf.Bytes())
+		for {
+			blk, err := f.next()
+			require.NoError(t, err, "level %d", level)
+			if blk.final {
+				break
+			}
+
+			if len(ends) > 0 && blk.endBit == ends[0] {
+				ends = ends[1:]
+			}
+		}
+		assert.Empty(t, ends, "level %d: blocks should end at BitPos", level)
+	}
+}
+
+func TestEncoderFlush(t *testing.T) {
+	var buf bytes.Buffer
+	e, err := newEncoder(&buf, DefaultCompression)
+	require.NoError(t, err)
+
+	e.Write([]byte("hello world"))
+	require.NoError(t, e.Flush())
+	assert.Equal(t, []byte{0x00, 0x00, 0xff, 0xff}, buf.Bytes()[buf.Len()-4:])
+
+	e.Write([]byte(", goodbye"))
+	require.NoError(t, e.Close())
+	assert.Equal(t, "hello world, goodbye", decompressFlateBytes(t, buf.Bytes()))
+
+	_, err = e.Write([]byte("x"))
+	assert.Equal(t, errEncoderClosed, err)
+}
+
+func TestHuffmanLengths(t *testing.T) {
+	// Fibonacci frequencies give the deepest possible tree.
+	freq := make([]int, 30)
+	freq[0], freq[1] = 1, 1
+	for i := 2; i < len(freq); i++ {
+		freq[i] = freq[i-1] + freq[i-2]
+	}
+
+	for _, maxBits := range []int{7, 15} {
+		lens := make([]uint8, len(freq))
+		huffmanLengths(lens, freq, maxBits)
+
+		var kraft float64
+		for i, l := range lens {
+			require.NotZero(t, l, "code %d", i)
+			assert.True(t, int(l) <= maxBits, "code %d has length %d", i, l)
+			kraft += 1 / float64(uint(1)<<l)
+		}
+		assert.Equal(t, 1.0, kraft, "code should be complete")
+	}
+
+	lens := make([]uint8, 4)
+	huffmanLengths(lens, []int{0, 5, 0, 0}, 15)
+	assert.Equal(t, []uint8{1, 1, 0, 0}, lens, "at least two codes are assigned")
+}
@@ -0,0 +1,347 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A Fragment is the content of an include resolved by a FragmentSource.
+type Fragment struct {
+	// Precompressed, if non-nil, is added to the output without being
+	// recompressed. It must have been created with the same compression
+	// level as the document.
+	Precompressed *PrecompressedData
+
+	// Data is compressed and added to the output if Precompressed is nil.
+	Data []byte
+}
+
+// A FragmentSource resolves the src of an include to a Fragment. It may be
+// backed by a cache, a backend service or a local function.
+type FragmentSource interface {
+	Fragment(ctx context.Context, src string) (Fragment, error)
+}
+
+// The FragmentSourceFunc type is an adapter to allow the use of ordinary
+// functions as a FragmentSource.
+type FragmentSourceFunc func(ctx context.Context, src string) (Fragment, error)
+
+// Fragment calls f(ctx, src).
+func (f FragmentSourceFunc) Fragment(ctx context.Context, src string) (Fragment, error) {
+	return f(ctx, src)
+}
+
+// A FragmentCache is a FragmentSource that caches the fragments returned from
+// another FragmentSource as PrecompressedData. It is safe for concurrent use.
+//
+// A PrecompressedData returned from the other FragmentSource must use the
+// compression level of the cache, and must not be final or from a suffix fork,
+// otherwise an error is returned and it is not cached.
+type FragmentCache struct {
+	src   FragmentSource
+	level int
+
+	mu    sync.Mutex
+	cache map[string]*PrecompressedData
+}
+
+// NewFragmentCache returns a FragmentCache that resolves cache misses with src
+// and precompresses them at the given compression level.
+func NewFragmentCache(src FragmentSource, level int) *FragmentCache {
+	return &FragmentCache{
+		src:   src,
+		level: level,
+
+		cache: make(map[string]*PrecompressedData),
+	}
+}
+
+// Fragment implements FragmentSource.
+func (c *FragmentCache) Fragment(ctx context.Context, src string) (Fragment, error) {
+	c.mu.Lock()
+	d, ok := c.cache[src]
+	c.mu.Unlock()
+	if ok {
+		return Fragment{Precompressed: d}, nil
+	}
+
+	f, err := c.src.Fragment(ctx, src)
+	if err != nil {
+		return Fragment{}, err
+	}
+
+	switch d := f.Precompressed; {
+	case d == nil:
+		if f.Precompressed, err = PrecompressData(f.Data, c.level); err != nil {
+			return Fragment{}, err
+		}
+	case d.final:
+		return Fragment{}, errFinalData
+	case d.prefix != nil:
+		return Fragment{}, errSuffixData
+	case d.level != c.level:
+		return Fragment{}, errors.New("gzipbuilder: compression level mismatch")
+	}
+
+	c.mu.Lock()
+	c.cache[src] = f.Precompressed
+	c.mu.Unlock()
+	return Fragment{Precompressed: f.Precompressed}, nil
+}
+
+// Invalidate removes the fragment with the given src from the cache.
+func (c *FragmentCache) Invalidate(src string) {
+	c.mu.Lock()
+	delete(c.cache, src)
+	c.mu.Unlock()
+}
+
+// An ESIDocument is a document containing Edge Side Includes that has been
+// precompressed once and can be assembled from fragments many times.
+//
+// The following ESI elements are supported:
+//
+//	<esi:include src="..." alt="..." onerror="continue"/>
+//	<esi:remove>...</esi:remove>
+//	<esi:comment text="..."/>
+//
+// Each include is resolved against a FragmentSource. If resolving src fails,
+// alt is tried, if present. If that also fails and onerror is "continue", the
+// include is omitted, otherwise rendering fails.
+type ESIDocument struct {
+	level int
+
+	segments []*PrecompressedData
+	includes []esiInclude
+}
+
+type esiInclude struct {
+	src, alt string
+
+	continueOnError bool
+}
+
+// ParseESI parses the document and precompresses the spans between includes
+// at the given compression level.
+func ParseESI(doc []byte, level int) (*ESIDocument, error) {
+	d := &ESIDocument{level: level}
+
+	var span []byte
+	addSpan := func() error {
+		pd, err := PrecompressData(span, level)
+		if err != nil {
+			return err
+		}
+
+		d.segments = append(d.segments, pd)
+		span = nil
+		return nil
+	}
+
+	for {
+		i, endTag := indexESITag(doc)
+		if i < 0 {
+			break
+		}
+		if endTag {
+			// End tags are consumed with their elements, so this
+			// one has no matching start tag.
+			return nil, errors.New("gzipbuilder: unexpected ESI end tag")
+		}
+		span = append(span, doc[:i]...)
+		doc = doc[i:]
+
+		name := tagName(doc[len("<esi:"):])
+		end := bytes.IndexByte(doc, '>')
+		if name == nil || end < 0 {
+			return nil, errors.New("gzipbuilder: malformed ESI element")
+		}
+
+		tag := doc[len("<esi:")+len(name) : end]
+		selfClosing := bytes.HasSuffix(tag, []byte("/"))
+		if selfClosing {
+			tag = tag[:len(tag)-1]
+		}
+		doc = doc[end+1:]
+
+		switch string(name) {
+		case "include":
+			attrs := parseAttributes(tag)
+			if attrs["src"] == "" {
+				return nil, errors.New("gzipbuilder: ESI include missing src attribute")
+			}
+
+			if err := addSpan(); err != nil {
+				return nil, err
+			}
+
+			d.includes = append(d.includes, esiInclude{
+				src: attrs["src"],
+				alt: attrs["alt"],
+
+				continueOnError: attrs["onerror"] == "continue",
+			})
+		case "comment":
+		case "remove":
+			if selfClosing {
+				break
+			}
+
+			end := bytes.Index(doc, []byte("</esi:remove>"))
+			if end < 0 {
+				return nil, errors.New("gzipbuilder: unterminated ESI remove element")
+			}
+			doc = doc[end+len("</esi:remove>"):]
+		default:
+			return nil, fmt.Errorf("gzipbuilder: unsupported ESI element esi:%s", name)
+		}
+
+		if !selfClosing && string(name) != "remove" {
+			closeTag := "</esi:" + string(name) + ">"
+			if bytes.HasPrefix(doc, []byte(closeTag)) {
+				doc = doc[len(closeTag):]
+			}
+		}
+	}
+
+	span = append(span, doc...)
+	if err := addSpan(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// indexESITag returns the index of the first ESI start or end tag in p, or -1
+// if there is none. endTag reports whether it is an end tag.
+func indexESITag(p []byte) (i int, endTag bool) {
+	for off := 0; ; {
+		j := bytes.Index(p[off:], []byte("esi:"))
+		if j < 0 {
+			return -1, false
+		}
+		j += off
+
+		switch {
+		case j >= 1 && p[j-1] == '<':
+			return j - 1, false
+		case j >= 2 && p[j-2] == '<' && p[j-1] == '/':
+			return j - 2, true
+		}
+		off = j + len("esi:")
+	}
+}
+
+// parseAttributes parses the attributes of an element.
+func parseAttributes(p []byte) map[string]string {
+	attrs := make(map[string]string)
+	for {
+		p = bytes.TrimLeft(p, " \t\n\f\r")
+		if len(p) == 0 {
+			return attrs
+		}
+
+		name, nameEnd, n := parseAttribute(p)
+
+		value := bytes.TrimLeft(p[nameEnd:n], " \t\n\f\r")
+		value = bytes.TrimPrefix(value, []byte("="))
+		value = bytes.TrimLeft(value, " \t\n\f\r")
+		if len(value) > 0 && (value[0] == '"' || value[0] == '\'') {
+			value = bytes.TrimSuffix(value[1:], value[:1])
+		}
+
+		attrs[string(bytes.ToLower(name))] = string(value)
+		p = p[n:]
+	}
+}
+
+// Includes returns the number of includes in the document.
+func (d *ESIDocument) Includes() int {
+	return len(d.includes)
+}
+
+// maxConcurrentIncludes is the number of includes that resolve resolves at
+// once.
+const maxConcurrentIncludes = 8
+
+// resolve resolves every include concurrently.
+func (d *ESIDocument) resolve(ctx context.Context, src FragmentSource) ([]Fragment, error) {
+	frags := make([]Fragment, len(d.includes))
+	errs := make([]error, len(d.includes))
+
+	sem := make(chan struct{}, maxConcurrentIncludes)
+
+	var wg sync.WaitGroup
+	for i, inc := range d.includes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, inc esiInclude) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			frags[i], errs[i] = src.Fragment(ctx, inc.src)
+			if errs[i] != nil && inc.alt != "" {
+				frags[i], errs[i] = src.Fragment(ctx, inc.alt)
+			}
+			if errs[i] != nil && inc.continueOnError {
+				frags[i], errs[i] = Fragment{}, nil
+			}
+		}(i, inc)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("gzipbuilder: ESI include %q: %v", d.includes[i].src, err)
+		}
+	}
+
+	return frags, nil
+}
+
+// Render resolves every include in the document against src and adds the
+// assembled document to w. w must use the same compression level as the
+// document. The caller is responsible for closing w.
+//
+// Includes are resolved concurrently, at most eight at a time, before anything
+// is added to w, so an error resolving an include leaves w untouched.
+func (d *ESIDocument) Render(ctx context.Context, w *Writer, src FragmentSource) error {
+	return d.render(ctx, &w.builder, src)
+}
+
+// Bytes resolves every include in the document against src and returns the
+// assembled document as a complete GZIP stream.
+func (d *ESIDocument) Bytes(ctx context.Context, src FragmentSource) ([]byte, error) {
+	b := NewBuilder(d.level)
+	if err := d.render(ctx, &b.builder, src); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes()
+}
+
+func (d *ESIDocument) render(ctx context.Context, b *builder, src FragmentSource) error {
+	frags, err := d.resolve(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	for i, seg := range d.segments {
+		if i > 0 {
+			if f := frags[i-1]; f.Precompressed != nil {
+				b.AddPrecompressedData(f.Precompressed)
+			} else {
+				b.AddCompressedData(f.Data)
+			}
+		}
+
+		b.AddPrecompressedData(seg)
+	}
+
+	return b.err
+}
@@ -0,0 +1,209 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestESIDocument(t *testing.T) {
+	const doc = `<html><esi:include src="/header" /><p>body</p>` +
+		`<esi:remove><a href="/header">fallback</a></esi:remove>` +
+		`<esi:comment text="sidebar"/><esi:include src="/missing" alt="/sidebar"/>` +
+		`<esi:include src="/broken" onerror="continue"></esi:include></html>`
+
+	d, err := ParseESI([]byte(doc), DefaultCompression)
+	require.NoError(t, err, "ParseESI failed")
+	assert.Equal(t, 3, d.Includes())
+
+	header, err := PrecompressData([]byte("<h1>header</h1>"), DefaultCompression)
+	require.NoError(t, err, "failed to precompress data")
+
+	var calls int32
+	src := FragmentSourceFunc(func(ctx context.Context, src string) (Fragment, error) {
+		atomic.AddInt32(&calls, 1)
+
+		switch src {
+		case "/header":
+			return Fragment{Precompressed: header}, nil
+		case "/sidebar":
+			return Fragment{Data: []byte("<nav>sidebar</nav>")}, nil
+		default:
+			return Fragment{}, errors.New("not found")
+		}
+	})
+
+	const expect = `<html><h1>header</h1><p>body</p><nav>sidebar</nav></html>`
+
+	bb, err := d.Bytes(context.Background(), src)
+	require.NoError(t, err, "Bytes failed")
+
+	debugLogf(t, "%d:%x", len(bb), bb)
+
+	assert.Equal(t, expect, decompressBytes(t, bb))
+	assert.EqualValues(t, 4, calls)
+
+	cache := NewFragmentCache(src, DefaultCompression)
+
+	for i := 0; i < 3; i++ {
+		var buf bytes.Buffer
+		w := NewWriter(&buf, DefaultCompression)
+		require.NoError(t, d.Render(context.Background(), w, cache), "Render failed")
+		require.NoError(t, w.Close(), "Close failed")
+
+		assert.Equal(t, expect, decompressBytes(t, buf.Bytes()))
+	}
+
+	// Failed includes are not cached, so /missing and /broken are retried.
+	assert.EqualValues(t, 4+4+2+2, calls)
+
+	cache.Invalidate("/sidebar")
+
+	_, err = d.Bytes(context.Background(), cache)
+	require.NoError(t, err, "Bytes failed")
+	assert.EqualValues(t, 4+4+2+2+3, calls)
+}
+
+func TestESIDocumentError(t *testing.T) {
+	d, err := ParseESI([]byte(`a<esi:include src="/a"/>b`), DefaultCompression)
+	require.NoError(t, err, "ParseESI failed")
+
+	src := FragmentSourceFunc(func(ctx context.Context, src string) (Fragment, error) {
+		return Fragment{}, errors.New("backend unavailable")
+	})
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, DefaultCompression)
+
+	err = d.Render(context.Background(), w, src)
+	assert.EqualError(t, err, `gzipbuilder: ESI include "/a": backend unavailable`)
+	assert.Equal(t, start, w.last, "nothing should have been written")
+
+	d2, err := PrecompressData([]byte("x"), BestCompression)
+	require.NoError(t, err, "failed to precompress data")
+
+	src = FragmentSourceFunc(func(ctx context.Context, src string) (Fragment, error) {
+		return Fragment{Precompressed: d2}, nil
+	})
+
+	_, err = d.Bytes(context.Background(), src)
+	assert.EqualError(t, err, "gzipbuilder: compression level mismatch")
+}
+
+func TestParseESIErrors(t *testing.T) {
+	for _, tc := range []struct{ doc, err string }{
+		{`<esi:include/>`, "gzipbuilder: ESI include missing src attribute"},
+		{`<esi:include src="a"`, "gzipbuilder: malformed ESI element"},
+		{`<esi:remove>`, "gzipbuilder: unterminated ESI remove element"},
+		{`<esi:choose>`, "gzipbuilder: unsupported ESI element esi:choose"},
+		{`a</esi:include>b`, "gzipbuilder: unexpected ESI end tag"},
+		{`<esi:include src="a">b</esi:include>`, "gzipbuilder: unexpected ESI end tag"},
+		{`<esi:remove>a</esi:remove></esi:remove>`, "gzipbuilder: unexpected ESI end tag"},
+	} {
+		d, err := ParseESI([]byte(tc.doc), DefaultCompression)
+		assert.EqualError(t, err, tc.err, "for %q", tc.doc)
+		assert.Nil(t, d, "expected nil *ESIDocument")
+	}
+}
+
+func TestIndexESITag(t *testing.T) {
+	for _, tc := range []struct {
+		doc    string
+		i      int
+		endTag bool
+	}{
+		{"", -1, false},
+		{"esi: /esi: <esi", -1, false},
+		{"<esi:include/>", 0, false},
+		{"ab</esi:include>", 2, true},
+		{"esi:/esi:<esi:", 9, false},
+		{"x/esi:</esi:<esi:", 6, true},
+	} {
+		i, endTag := indexESITag([]byte(tc.doc))
+		assert.Equal(t, tc.i, i, "for %q", tc.doc)
+		assert.Equal(t, tc.endTag, endTag, "for %q", tc.doc)
+	}
+}
+
+func BenchmarkParseESI(b *testing.B) {
+	doc := bytes.Repeat([]byte(`<p><esi:comment text="x"/>`), 1<<12)
+
+	b.SetBytes(int64(len(doc)))
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseESI(doc, BestSpeed); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFragmentCacheInvalid(t *testing.T) {
+	best, err := PrecompressData([]byte("best"), BestCompression)
+	require.NoError(t, err, "failed to precompress data")
+
+	pw := NewPrecompressedWriter(DefaultCompression)
+	pw.Write([]byte("final"))
+	final, err := pw.FinalData()
+	require.NoError(t, err, "FinalData failed")
+
+	pw = NewPrecompressedWriter(DefaultCompression)
+	pw.Write([]byte("prefix"))
+	fork := pw.Fork(true)
+	fork.Write([]byte("suffix"))
+	suffix, err := fork.Data()
+	require.NoError(t, err, "Data failed")
+
+	frags := map[string]*PrecompressedData{"/best": best, "/final": final, "/suffix": suffix}
+	var calls int32
+	cache := NewFragmentCache(FragmentSourceFunc(func(ctx context.Context, src string) (Fragment, error) {
+		atomic.AddInt32(&calls, 1)
+		return Fragment{Precompressed: frags[src]}, nil
+	}), DefaultCompression)
+
+	for src, err := range map[string]string{
+		"/best":   "gzipbuilder: compression level mismatch",
+		"/final":  errFinalData.Error(),
+		"/suffix": errSuffixData.Error(),
+	} {
+		for i := 0; i < 2; i++ {
+			_, e := cache.Fragment(context.Background(), src)
+			assert.EqualError(t, e, err, "for %s", src)
+		}
+	}
+	assert.EqualValues(t, 6, calls, "invalid fragments should not be cached")
+}
+
+func TestESIDocumentConcurrency(t *testing.T) {
+	var doc bytes.Buffer
+	for i := 0; i < 50; i++ {
+		doc.WriteString(`<esi:include src="/a"/>`)
+	}
+
+	d, err := ParseESI(doc.Bytes(), DefaultCompression)
+	require.NoError(t, err, "ParseESI failed")
+
+	var active, peak int32
+	src := FragmentSourceFunc(func(ctx context.Context, src string) (Fragment, error) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&active, -1)
+
+		return Fragment{Data: []byte("a")}, nil
+	})
+
+	bb, err := d.Bytes(context.Background(), src)
+	require.NoError(t, err, "Bytes failed")
+	assert.Equal(t, string(bytes.Repeat([]byte("a"), 50)), decompressBytes(t, bb))
+	assert.True(t, peak <= maxConcurrentIncludes, "%d includes resolved at once", peak)
+}
@@ -0,0 +1,299 @@
+package gzipbuilder
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// An Index records points in a compressed stream at which decompression can
+// begin, allowing a range of the decompressed data to be read without
+// inflating the stream from the start. It is built by a Builder or Writer
+// when IndexEvery is called, and is read by an IndexedReader.
+type Index struct {
+	Points []IndexPoint
+
+	// Size is the length of the decompressed data.
+	Size int64
+}
+
+// An IndexPoint is a point in a compressed stream at which decompression can
+// begin.
+type IndexPoint struct {
+	// CompressedOffset is the offset in the compressed stream, including
+	// any GZIP header, at which the DEFLATE data for the point begins. The
+	// builder flushes to a byte boundary at each point.
+	CompressedOffset int64
+
+	// UncompressedOffset is the offset of the point in the decompressed
+	// data.
+	UncompressedOffset int64
+
+	// Window holds the decompressed data preceding the point that the
+	// DEFLATE data after it may refer back to, at most 32KiB. It is empty
+	// where the compressor was reset, as nothing before the point may be
+	// referred to.
+	Window []byte
+}
+
+// indexer builds an Index as data is added to a builder.
+type indexer struct {
+	span int64
+
+	// pos is the uncompressed offset of the data added so far and next is
+	// the offset at which the next point is due.
+	pos  int64
+	next int64
+
+	// window holds the most recent data of the current compressed run.
+	window []byte
+
+	idx Index
+}
+
+// IndexEvery sets the builder to build an Index as it writes, with a point
+// added at least every span bytes of decompressed data where possible. The
+// Index can be retrieved with Index.
+//
+// Most points are added where the builder resets the compressor anyway, such
+// as before precompressed or uncompressed data, and these do not need a
+// window. Within a long run of compressed data, the compressor is flushed to
+// add a point, which costs a few bytes, and the preceding 32KiB is recorded
+// with it. Points cannot be added within PrecompressedData or DEFLATE streams
+// added to the builder, so a point may be more than span bytes from the last.
+//
+// IndexEvery cannot be used with Adaptive.
+func (b *builder) IndexEvery(span int64) {
+	if !b.canSetOption() {
+		return
+	}
+
+	switch {
+	case span <= 0:
+		b.err = errors.New("gzipbuilder: index span must be positive")
+	case !b.canTrackOffset():
+		b.err = errors.New("gzipbuilder: index not supported")
+	case b.adaptBuf != nil:
+		b.err = errors.New("gzipbuilder: adaptive mode cannot be used with an index")
+	default:
+		b.index = &indexer{span: span}
+	}
+}
+
+// Index returns the Index built by the builder, or nil if IndexEvery was not
+// called. The Index is only complete once Bytes or Close has been called.
+func (b *builder) Index() *Index {
+	if b.index == nil {
+		return nil
+	}
+
+	return &b.index.idx
+}
+
+func (b *builder) canTrackOffset() bool {
+	switch b.w.(type) {
+	case *bytes.Buffer, *bufio.Writer:
+		return true
+	default:
+		return false
+	}
+}
+
+// offset returns the number of bytes written so far.
+func (b *builder) offset() int64 {
+	if bw, ok := b.w.(*bufio.Writer); ok {
+		return b.written + int64(bw.Buffered())
+	}
+
+	return int64(b.w.(*bytes.Buffer).Len())
+}
+
+// indexReset adds an index point, if one is due, before n bytes of data that
+// does not refer back to anything that precedes it. It reports whether a point
+// was added.
+func (b *builder) indexReset(n int64) bool {
+	ix := b.index
+	if ix == nil || b.err != nil {
+		return false
+	}
+
+	added := ix.pos >= ix.next
+	if added {
+		ix.add(b.offset(), nil)
+	}
+
+	ix.window = ix.window[:0]
+	ix.pos += n
+	return added
+}
+
+// indexSkip advances the index past n bytes of data that refers back to the
+// data before it, so no point can be added before it.
+func (b *builder) indexSkip(n int64) {
+	if ix := b.index; ix != nil && b.err == nil {
+		ix.pos += n
+	}
+}
+
+// indexBlock adds an index point, if one is due, before the data of an
+// assembled block that begins at start in the builder's window.
+func (b *builder) indexBlock(start int) {
+	ix := b.index
+	if ix == nil || b.err != nil {
+		return
+	}
+
+	if ix.pos >= ix.next {
+		ix.add(b.offset(), b.window[:start])
+	}
+	ix.window = ix.window[:0]
+	ix.pos += int64(len(b.window) - start)
+}
+
+// indexRun adds an index point, if one is due, before a run of n bytes of data
+// that may refer back to window. It returns the length of the part of the run
+// that precedes the next point, which the index is advanced past.
+func (b *builder) indexRun(window []byte, n int) int {
+	ix := b.index
+	if ix == nil || b.err != nil {
+		return n
+	}
+
+	if ix.pos >= ix.next {
+		ix.add(b.offset(), window)
+	}
+	if due := ix.next - ix.pos; due < int64(n) {
+		n = int(due)
+	}
+	ix.window = ix.window[:0]
+	ix.pos += int64(n)
+	return n
+}
+
+// writeCompressedIndexed writes data to the compressor, flushing it to add an
+// index point each time one is due.
+func (b *builder) writeCompressedIndexed(data []byte) {
+	ix := b.index
+	for {
+		n := int64(len(data))
+		if due := ix.next - ix.pos; due < n {
+			n = due
+		}
+
+		if b.compress(data[:n]); b.err != nil {
+			return
+		}
+		ix.record(data[:n])
+		ix.pos += n
+
+		if data = data[n:]; len(data) == 0 {
+			return
+		}
+
+		if b.err = b.fw.Flush(); b.err != nil {
+			return
+		}
+		ix.add(b.offset(), ix.window)
+	}
+}
+
+func (ix *indexer) add(off int64, window []byte) {
+	if len(window) > windowSize {
+		window = window[len(window)-windowSize:]
+	}
+
+	ix.idx.Points = append(ix.idx.Points, IndexPoint{
+		CompressedOffset:   off,
+		UncompressedOffset: ix.pos,
+		Window:             append([]byte(nil), window...),
+	})
+	ix.next = ix.pos + ix.span
+}
+
+// record adds p to the window of the current compressed run.
+func (ix *indexer) record(p []byte) {
+	if len(p) >= windowSize {
+		ix.window = ix.window[:0]
+		p = p[len(p)-windowSize:]
+	}
+
+	ix.window = append(ix.window, p...)
+	if len(ix.window) > 2*windowSize {
+		ix.window = append(ix.window[:0], ix.window[len(ix.window)-windowSize:]...)
+	}
+}
+
+// An IndexedReader reads ranges of the decompressed data of a compressed
+// stream, using an Index to begin decompressing close to each range.
+type IndexedReader struct {
+	r   io.ReaderAt
+	idx *Index
+}
+
+// NewIndexedReader returns an IndexedReader that reads the compressed stream
+// from r using idx, which must have been built when the stream was written.
+func NewIndexedReader(r io.ReaderAt, idx *Index) *IndexedReader {
+	return &IndexedReader{r, idx}
+}
+
+// Size returns the length of the decompressed data.
+func (r *IndexedReader) Size() int64 {
+	return r.idx.Size
+}
+
+// ReadAt implements io.ReaderAt, reading from the decompressed data. It
+// decompresses from the last index point at or before off.
+func (r *IndexedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("gzipbuilder: negative offset")
+	}
+	if off >= r.idx.Size {
+		return 0, io.EOF
+	}
+
+	points := r.idx.Points
+	i := sort.Search(len(points), func(i int) bool {
+		return points[i].UncompressedOffset > off
+	}) - 1
+	if i < 0 {
+		return 0, errors.New("gzipbuilder: offset not covered by index")
+	}
+	pt := points[i]
+
+	sr := io.NewSectionReader(r.r, pt.CompressedOffset, math.MaxInt64-pt.CompressedOffset)
+	fr := flate.NewReaderDict(bufio.NewReader(sr), pt.Window)
+	defer fr.Close()
+
+	if _, err := io.CopyN(ioutil.Discard, fr, off-pt.UncompressedOffset); err != nil {
+		return 0, noEOF(err)
+	}
+
+	want := len(p)
+	if rem := r.idx.Size - off; int64(want) > rem {
+		p = p[:rem]
+	}
+
+	n, err := io.ReadFull(fr, p)
+	switch {
+	case err != nil:
+		return n, noEOF(err)
+	case n < want:
+		return n, io.EOF
+	default:
+		return n, nil
+	}
+}
+
+// noEOF converts io.EOF into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
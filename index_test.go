@@ -0,0 +1,143 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex(t *testing.T) {
+	doc := spliceTestDocument(256 << 10)
+	pd := MustPrecompressedData(PrecompressData(doc[:100<<10], DefaultCompression))
+
+	var expect []byte
+	add := func(b *builder) {
+		expect = expect[:0]
+
+		b.AddCompressedData(doc)
+		expect = append(expect, doc...)
+		b.AddPrecompressedData(pd)
+		expect = append(expect, doc[:100<<10]...)
+		for i := 0; i < 10; i++ {
+			b.AddUncompressedData(doc[i<<10 : (i+5)<<10])
+			expect = append(expect, doc[i<<10:(i+5)<<10]...)
+		}
+		b.AddCompressedData(doc[:1000])
+		expect = append(expect, doc[:1000]...)
+		b.AddCompressedData(doc[1000:50000])
+		expect = append(expect, doc[1000:50000]...)
+	}
+
+	for _, useWriter := range []bool{false, true} {
+		var (
+			buf bytes.Buffer
+			b   *builder
+			out []byte
+		)
+		if useWriter {
+			w := NewWriter(&buf, DefaultCompression)
+			w.IndexEvery(16 << 10)
+			add(&w.builder)
+			require.NoError(t, w.Close())
+			b, out = &w.builder, buf.Bytes()
+		} else {
+			bb := NewBuilder(DefaultCompression)
+			bb.IndexEvery(16 << 10)
+			add(&bb.builder)
+			b, out = &bb.builder, bb.BytesOrPanic()
+		}
+
+		require.Equal(t, string(expect), decompressBytes(t, out), "writer=%t", useWriter)
+
+		idx := b.Index()
+		require.NotNil(t, idx)
+		assert.Equal(t, int64(len(expect)), idx.Size, "writer=%t", useWriter)
+
+		debugLogf(t, "writer=%t: %d index points", useWriter, len(idx.Points))
+
+		var windows, resets int
+		for i, pt := range idx.Points {
+			if i > 0 {
+				assert.True(t, pt.UncompressedOffset > idx.Points[i-1].UncompressedOffset,
+					"points are ordered")
+			}
+			if len(pt.Window) > 0 {
+				windows++
+			} else {
+				resets++
+			}
+			assert.True(t, len(pt.Window) <= windowSize, "window is at most 32KiB")
+		}
+		assert.True(t, windows > 0, "points with windows")
+		assert.True(t, resets > 0, "points without windows")
+
+		r := NewIndexedReader(bytes.NewReader(out), idx)
+		assert.Equal(t, int64(len(expect)), r.Size())
+
+		rand := rand.New(rand.NewSource(1))
+		for i := 0; i < 200; i++ {
+			off := rand.Int63n(int64(len(expect)))
+			p := make([]byte, rand.Intn(20<<10))
+
+			n, err := r.ReadAt(p, off)
+			if end := off + int64(len(p)); end > int64(len(expect)) {
+				assert.Equal(t, io.EOF, err)
+				assert.Equal(t, int(int64(len(expect))-off), n)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, len(p), n)
+			}
+
+			if !assert.Equal(t, expect[off:off+int64(n)], p[:n], "at offset %d", off) {
+				break
+			}
+		}
+	}
+}
+
+func TestIndexEmpty(t *testing.T) {
+	b := NewBuilder(DefaultCompression)
+	b.IndexEvery(1 << 10)
+
+	out, err := b.Bytes()
+	require.NoError(t, err)
+
+	idx := b.Index()
+	require.NotNil(t, idx)
+	assert.Empty(t, idx.Points)
+	assert.Equal(t, int64(0), idx.Size)
+
+	n, err := NewIndexedReader(bytes.NewReader(out), idx).ReadAt(make([]byte, 1), 0)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestIndexErrors(t *testing.T) {
+	assert.Nil(t, NewBuilder(DefaultCompression).Index())
+
+	b := NewBuilder(DefaultCompression)
+	b.IndexEvery(0)
+	assert.EqualError(t, b.Err(), "gzipbuilder: index span must be positive")
+
+	b = NewBuilder(DefaultCompression)
+	b.AddCompressedData([]byte("hello"))
+	b.IndexEvery(1 << 10)
+	assert.EqualError(t, b.Err(), "gzipbuilder: setting options must be done before writing")
+
+	b = NewBuilder(DefaultCompression)
+	b.IndexEvery(1 << 10)
+	b.AddCompressedData(spliceTestDocument(10 << 10))
+	out := b.BytesOrPanic()
+
+	r := NewIndexedReader(bytes.NewReader(out), b.Index())
+	_, err := r.ReadAt(make([]byte, 1), -1)
+	assert.EqualError(t, err, "gzipbuilder: negative offset")
+
+	r = NewIndexedReader(bytes.NewReader(out[:len(out)/2]), b.Index())
+	_, err = r.ReadAt(make([]byte, 10<<10), 0)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
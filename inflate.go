@@ -0,0 +1,677 @@
+package gzipbuilder
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// windowSize is the maximum distance a DEFLATE back-reference may reach.
+const windowSize = 1 << 15
+
+var errInvalidDeflate = errors.New("gzipbuilder: invalid DEFLATE stream")
+
+// inflater is a minimal DEFLATE decoder. Unlike compress/flate, it decodes a
+// single block at a time and reports where each block begins and ends in the
+// compressed stream and how far back into the output the block reaches. This
+// is what is needed to copy blocks from one stream into another.
+//
+// It is based on puff.c from the zlib distribution and favours simplicity
+// over speed.
+type inflater struct {
+	in  []byte
+	off int // offset of the next byte to load into bitBuf
+
+	// r, if non-nil, is read from once in is exhausted. inBase is the
+	// offset of in within the compressed stream.
+	r      io.Reader
+	inBase int64
+
+	bitBuf uint32
+	bitCnt uint
+
+	// out holds the decoded output from base onwards. At least windowSize
+	// bytes of history are kept before the current block.
+	out  []byte
+	base int64
+
+	crc uint32
+
+	final bool
+
+	lenCode, distCode huffman
+}
+
+// inflateBlock describes a block decoded by inflater.
+type inflateBlock struct {
+	// startBit and endBit are the bit offsets of the block within the
+	// compressed input.
+	startBit, endBit int64
+
+	// start and end are the offsets of the block's output within the
+	// decoded stream.
+	start, end int64
+
+	// minRef is the lowest offset in the decoded stream that the block
+	// references. It is equal to start if the block references nothing
+	// before itself.
+	minRef int64
+
+	// crc is the CRC-32 checksum of the decoded stream up to start.
+	crc uint32
+
+	final bool
+}
+
+func newInflater(in []byte) *inflater {
+	return &inflater{in: in}
+}
+
+// newReaderInflater returns an inflater that decodes in followed by the data
+// read from r.
+func newReaderInflater(in []byte, r io.Reader) *inflater {
+	return &inflater{in: in, r: r}
+}
+
+// bitPos returns the bit offset of the next unread bit.
+func (f *inflater) bitPos() int64 {
+	return (f.inBase+int64(f.off))*8 - int64(f.bitCnt)
+}
+
+// fill replaces in with the next data read from r.
+func (f *inflater) fill() error {
+	if f.r == nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	buf := f.in[:cap(f.in)]
+	if len(buf) < 32<<10 {
+		buf = make([]byte, 32<<10)
+	}
+
+	n, err := io.ReadAtLeast(f.r, buf, 1)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+
+	f.inBase += int64(len(f.in))
+	f.in, f.off = buf[:n], 0
+	return nil
+}
+
+// pos returns the offset of the end of the decoded stream.
+func (f *inflater) pos() int64 {
+	return f.base + int64(len(f.out))
+}
+
+// trim discards the decoded output before keep, while always retaining
+// enough history to continue decoding. The decoded output is otherwise kept
+// in full.
+func (f *inflater) trim(keep int64) {
+	if min := f.pos() - windowSize; keep > min {
+		keep = min
+	}
+	if keep <= f.base {
+		return
+	}
+
+	n := copy(f.out, f.out[keep-f.base:])
+	f.out = f.out[:n]
+	f.base = keep
+}
+
+// bytes returns the decoded output between start and end, which must not
+// have been trimmed.
+func (f *inflater) bytes(start, end int64) []byte {
+	return f.out[start-f.base : end-f.base]
+}
+
+func (f *inflater) bits(need uint) (uint32, error) {
+	val := f.bitBuf
+	for f.bitCnt < need {
+		if f.off == len(f.in) {
+			if err := f.fill(); err != nil {
+				return 0, err
+			}
+		}
+
+		val |= uint32(f.in[f.off]) << f.bitCnt
+		f.off++
+		f.bitCnt += 8
+	}
+
+	f.bitBuf = val >> need
+	f.bitCnt -= need
+	return val & (1<<need - 1), nil
+}
+
+// next decodes the next block. It returns io.EOF after the final block.
+func (f *inflater) next() (inflateBlock, error) {
+	if f.final {
+		return inflateBlock{}, io.EOF
+	}
+
+	blk := inflateBlock{
+		startBit: f.bitPos(),
+		start:    f.pos(),
+		minRef:   f.pos(),
+		crc:      f.crc,
+	}
+
+	hdr, err := f.bits(3)
+	if err != nil {
+		return blk, err
+	}
+	blk.final = hdr&1 != 0
+
+	switch hdr >> 1 {
+	case 0:
+		err = f.stored()
+	case 1:
+		f.fixedCodes()
+		err = f.codes(&blk)
+	case 2:
+		if err = f.dynamicCodes(); err == nil {
+			err = f.codes(&blk)
+		}
+	default:
+		err = errInvalidDeflate
+	}
+	if err != nil {
+		return blk, err
+	}
+
+	f.final = blk.final
+	blk.endBit = f.bitPos()
+	blk.end = f.pos()
+
+	f.crc = crc32.Update(f.crc, crc32.IEEETable, f.bytes(blk.start, blk.end))
+	return blk, nil
+}
+
+// syncFlushStart returns the bit offset in p of the empty stored block that a
+// sync flush writes at the end of p, which is where the last block before it
+// ends. p must begin at a block boundary, but its blocks may refer back to data
+// that precedes it.
+func syncFlushStart(p []byte) (int64, error) {
+	f := newInflater(p)
+
+	// The data that precedes p is unknown, but only the block boundaries
+	// are needed, so references to it are decoded as zeros.
+	f.out = make([]byte, windowSize)
+	f.base = -windowSize
+
+	end := int64(len(p)) * 8
+	for {
+		f.trim(f.pos())
+
+		blk, err := f.next()
+		switch {
+		case err != nil:
+			return 0, err
+		case blk.final:
+			return 0, errors.New("gzipbuilder: DEFLATE stream contains final block")
+		case blk.endBit != end:
+			continue
+		case blk.start != blk.end || readBits(p, blk.startBit, 3) != 0:
+			return 0, errors.New("gzipbuilder: DEFLATE stream does not end with sync flush")
+		default:
+			return blk.startBit, nil
+		}
+	}
+}
+
+// deflateHistory returns the last windowSize bytes of the data decoded from p,
+// which must end at a block boundary on a byte boundary and must not refer
+// back to data that precedes it.
+func deflateHistory(p []byte) ([]byte, error) {
+	f := newInflater(p)
+
+	end := int64(len(p)) * 8
+	for f.bitPos() < end {
+		f.trim(f.pos())
+
+		if _, err := f.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	start := f.pos() - windowSize
+	if start < f.base {
+		start = f.base
+	}
+
+	return f.bytes(start, f.pos()), nil
+}
+
+func (f *inflater) stored() error {
+	// Discard the remaining bits of the current byte.
+	f.bitBuf, f.bitCnt = 0, 0
+
+	hdr, err := f.bits(16)
+	if err != nil {
+		return err
+	}
+	nhdr, err := f.bits(16)
+	if err != nil {
+		return err
+	}
+	if nhdr != ^hdr&0xffff {
+		return errInvalidDeflate
+	}
+
+	for n := int(hdr); n > 0; {
+		if f.off == len(f.in) {
+			if err := f.fill(); err != nil {
+				return err
+			}
+		}
+
+		p := f.in[f.off:]
+		if len(p) > n {
+			p = p[:n]
+		}
+
+		f.out = append(f.out, p...)
+		f.off += len(p)
+		n -= len(p)
+	}
+
+	return nil
+}
+
+const (
+	maxCodeBits   = 15
+	maxLitCodes   = 286
+	maxDistCodes  = 30
+	fixedLitCodes = 288
+)
+
+var (
+	lengthBase  = [...]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [...]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [...]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [...]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+	// codeLengthOrder is the order in which the code length code lengths
+	// are stored in a dynamic block header.
+	codeLengthOrder = [...]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+// huffman is a canonical Huffman code, stored as the number of symbols of
+// each length and the symbols ordered by code.
+type huffman struct {
+	count  [maxCodeBits + 1]uint16
+	symbol [fixedLitCodes]uint16
+}
+
+// init constructs the code from the code lengths. It returns the number of
+// unused codes: zero for a complete code, positive for an incomplete code and
+// negative for an over-subscribed code.
+func (h *huffman) init(lengths []uint8) int {
+	h.count = [maxCodeBits + 1]uint16{}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	if int(h.count[0]) == len(lengths) {
+		return 0
+	}
+
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left <<= 1
+		left -= int(h.count[l])
+		if left < 0 {
+			return left
+		}
+	}
+
+	var offs [maxCodeBits + 1]uint16
+	for l := 1; l < maxCodeBits; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+
+	return left
+}
+
+func (f *inflater) decode(h *huffman) (int, error) {
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxCodeBits; l++ {
+		bit, err := f.bits(1)
+		if err != nil {
+			return 0, err
+		}
+
+		code |= int(bit)
+		count := int(h.count[l])
+		if code-count < first {
+			return int(h.symbol[index+(code-first)]), nil
+		}
+
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+
+	return 0, errInvalidDeflate
+}
+
+func (f *inflater) fixedCodes() {
+	var lengths [fixedLitCodes]uint8
+	for sym := range lengths {
+		switch {
+		case sym < 144:
+			lengths[sym] = 8
+		case sym < 256:
+			lengths[sym] = 9
+		case sym < 280:
+			lengths[sym] = 7
+		default:
+			lengths[sym] = 8
+		}
+	}
+	f.lenCode.init(lengths[:])
+
+	for sym := range lengths[:maxDistCodes] {
+		lengths[sym] = 5
+	}
+	f.distCode.init(lengths[:maxDistCodes])
+}
+
+func (f *inflater) dynamicCodes() error {
+	hdr, err := f.bits(14)
+	if err != nil {
+		return err
+	}
+
+	nlen := int(hdr&0x1f) + 257
+	ndist := int(hdr>>5&0x1f) + 1
+	ncode := int(hdr>>10) + 4
+	if nlen > maxLitCodes || ndist > maxDistCodes {
+		return errInvalidDeflate
+	}
+
+	var lengths [maxLitCodes + maxDistCodes]uint8
+	for i := 0; i < ncode; i++ {
+		l, err := f.bits(3)
+		if err != nil {
+			return err
+		}
+
+		lengths[codeLengthOrder[i]] = uint8(l)
+	}
+
+	// The code length code must be complete.
+	if f.lenCode.init(lengths[:len(codeLengthOrder)]) != 0 {
+		return errInvalidDeflate
+	}
+
+	for i := 0; i < nlen+ndist; {
+		sym, err := f.decode(&f.lenCode)
+		if err != nil {
+			return err
+		}
+
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+
+		var l uint8
+		var rep uint32
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errInvalidDeflate
+			}
+			l = lengths[i-1]
+			rep, err = f.bits(2)
+			rep += 3
+		case 17:
+			rep, err = f.bits(3)
+			rep += 3
+		default:
+			rep, err = f.bits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(rep) > nlen+ndist {
+			return errInvalidDeflate
+		}
+
+		for ; rep > 0; rep-- {
+			lengths[i] = l
+			i++
+		}
+	}
+
+	if lengths[256] == 0 {
+		return errInvalidDeflate
+	}
+
+	// An incomplete code is only allowed for a single code of length one.
+	if left := f.lenCode.init(lengths[:nlen]); left < 0 ||
+		left > 0 && nlen-int(f.lenCode.count[0]) != 1 {
+		return errInvalidDeflate
+	}
+	if left := f.distCode.init(lengths[nlen : nlen+ndist]); left < 0 ||
+		left > 0 && ndist-int(f.distCode.count[0]) > 1 {
+		return errInvalidDeflate
+	}
+
+	return nil
+}
+
+func (f *inflater) codes(blk *inflateBlock) error {
+	for {
+		sym, err := f.decode(&f.lenCode)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case sym < 256:
+			f.out = append(f.out, byte(sym))
+			continue
+		case sym == 256:
+			return nil
+		}
+
+		sym -= 257
+		if sym >= len(lengthBase) {
+			return errInvalidDeflate
+		}
+
+		extra, err := f.bits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int(lengthBase[sym]) + int(extra)
+
+		sym, err = f.decode(&f.distCode)
+		if err != nil {
+			return err
+		}
+		if sym >= len(distBase) {
+			return errInvalidDeflate
+		}
+
+		extra, err = f.bits(uint(distExtra[sym]))
+		if err != nil {
+			return err
+		}
+		dist := int(distBase[sym]) + int(extra)
+
+		if dist > len(f.out) {
+			return errInvalidDeflate
+		}
+		if ref := f.pos() - int64(dist); ref < blk.minRef {
+			blk.minRef = ref
+		}
+
+		for i := len(f.out) - dist; length > 0; i, length = i+1, length-1 {
+			f.out = append(f.out, f.out[i])
+		}
+	}
+}
+
+// bitWriter writes a DEFLATE bit stream. Bits are buffered until flush is
+// called.
+type bitWriter struct {
+	w io.Writer
+
+	buf []byte
+
+	bits  uint64
+	nbits uint
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	w.bits |= v << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits >>= 8
+		w.nbits -= 8
+	}
+}
+
+// copyBits copies the bits between the start and end bit offsets of src.
+func (w *bitWriter) copyBits(src []byte, start, end int64) {
+	if w.nbits == 0 && start%8 == 0 {
+		w.buf = append(w.buf, src[start/8:end/8]...)
+		start = end &^ 7
+	}
+
+	for ; start+32 <= end; start += 32 {
+		w.writeBits(uint64(readBits(src, start, 32)), 32)
+	}
+	if start < end {
+		w.writeBits(uint64(readBits(src, start, uint(end-start))), uint(end-start))
+	}
+}
+
+// readBits returns the n bits of src beginning at the bit offset pos. n must
+// be at most 32.
+func readBits(src []byte, pos int64, n uint) uint32 {
+	var v uint64
+	for i := uint(0); i < (uint(pos%8)+n+7)/8; i++ {
+		v |= uint64(src[pos/8+int64(i)]) << (8 * i)
+	}
+
+	return uint32(v>>uint(pos%8)) & (1<<n - 1)
+}
+
+// storedBlock writes a non-final stored block containing p, which must be at
+// most 65535 bytes long. This leaves the stream byte aligned.
+func (w *bitWriter) storedBlock(p []byte) {
+	w.writeBits(0, 3)
+	if w.nbits > 0 {
+		w.writeBits(0, 8-w.nbits)
+	}
+
+	n := uint16(len(p))
+	w.buf = append(w.buf, byte(n), byte(n>>8), ^byte(n), ^byte(n>>8))
+	w.buf = append(w.buf, p...)
+}
+
+// alignStored writes an empty stored block, which leaves the stream byte
+// aligned.
+func (w *bitWriter) alignStored() {
+	w.storedBlock(nil)
+}
+
+// emptyFixedBlock writes an empty block with fixed codes, which is ten bits
+// long.
+func (w *bitWriter) emptyFixedBlock(final bool) {
+	hdr := uint64(1 << 1) // fixed codes
+	if final {
+		hdr |= 1
+	}
+
+	w.writeBits(hdr, 3)
+	w.writeBits(0, 7) // the end of block code
+}
+
+// alignShort leaves the stream byte aligned using as few bits as possible.
+// Empty fixed blocks are used where they can reach a byte boundary, which is
+// only from an even bit position, and an empty stored block otherwise.
+func (w *bitWriter) alignShort() {
+	if w.nbits%2 != 0 {
+		w.alignStored()
+		return
+	}
+
+	for w.nbits != 0 {
+		w.emptyFixedBlock(false)
+	}
+}
+
+// alignTo writes an empty dynamic block, if needed, so that n bits of the
+// current byte have been written.
+//
+// The block has a literal/length code where every literal except 255 and the
+// end of block code are eight bits long, and the length of its header can be
+// varied in steps of three bits by changing the number of code length codes.
+// This allows any alignment to be reached.
+func (w *bitWriter) alignTo(n uint) {
+	if w.nbits == n {
+		return
+	}
+
+	const (
+		minCodes = 5 // enough for the code lengths 0 and 8
+		baseBits = 3 + 5 + 5 + 4 + 257 + 1 + 8
+	)
+
+	ncode := minCodes
+	for (w.nbits+baseBits+3*uint(ncode))%8 != n {
+		ncode++
+	}
+
+	w.writeBits(2<<1, 3) // not final, dynamic codes
+	w.writeBits(0, 5)    // 257 literal/length codes
+	w.writeBits(0, 5)    // 1 distance code
+	w.writeBits(uint64(ncode-4), 4)
+
+	for _, sym := range codeLengthOrder[:ncode] {
+		if sym == 0 || sym == 8 {
+			w.writeBits(1, 3)
+		} else {
+			w.writeBits(0, 3)
+		}
+	}
+
+	// With two code length codes of length one, 0 is coded as 0 and 8 as
+	// 1.
+	for sym := 0; sym < 257; sym++ {
+		if sym == 255 {
+			w.writeBits(0, 1)
+		} else {
+			w.writeBits(1, 1)
+		}
+	}
+	w.writeBits(0, 1) // the unused distance code
+
+	// The end of block code is the last of the eight bit codes.
+	w.writeBits(0xff, 8)
+}
+
+// flush writes the buffered whole bytes.
+func (w *bitWriter) flush() error {
+	_, err := w.w.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
@@ -0,0 +1,126 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInflater(t *testing.T) {
+	data := spliceTestDocument(256 << 10)
+
+	for level := HuffmanOnly; level <= BestCompression; level++ {
+		var buf bytes.Buffer
+		fw, err := flate.NewWriter(&buf, level)
+		require.NoError(t, err)
+
+		fw.Write(data[:1000])
+		require.NoError(t, fw.Flush())
+		fw.Write(data[1000:])
+		require.NoError(t, fw.Close())
+
+		f := newInflater(buf.Bytes())
+
+		var blocks []inflateBlock
+		for {
+			blk, err := f.next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err, "next failed at level %d", level)
+
+			blocks = append(blocks, blk)
+		}
+
+		if !assert.Equal(t, data, f.out, "at level %d", level) {
+			continue
+		}
+
+		var last inflateBlock
+		for _, blk := range blocks {
+			assert.Equal(t, last.endBit, blk.startBit, "at level %d", level)
+			assert.Equal(t, last.end, blk.start, "at level %d", level)
+			assert.True(t, blk.minRef <= blk.start, "at level %d", level)
+			assert.True(t, blk.start-blk.minRef <= windowSize, "at level %d", level)
+			last = blk
+		}
+
+		assert.True(t, last.final, "at level %d", level)
+		assert.Equal(t, int64(buf.Len()), (last.endBit+7)/8, "at level %d", level)
+
+		// The flush must be a block boundary.
+		found := false
+		for _, blk := range blocks {
+			found = found || blk.end == 1000
+		}
+		assert.True(t, found, "at level %d", level)
+	}
+}
+
+func TestInflaterInvalid(t *testing.T) {
+	for _, in := range [][]byte{
+		{0x07},                         // reserved block type
+		{0x01, 0x01, 0x00, 0xff, 0xfe}, // length mismatch
+		{0x03, 0x62, 0x00},             // distance too far back
+	} {
+		_, err := newInflater(in).next()
+		assert.Equal(t, errInvalidDeflate, err, "for %x", in)
+	}
+
+	_, err := newInflater([]byte{0x01, 0x05, 0x00}).next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestBitWriterAlignTo(t *testing.T) {
+	for pre := uint(0); pre < 8; pre++ {
+		for n := uint(0); n < 8; n++ {
+			var buf bytes.Buffer
+			w := &bitWriter{w: &buf}
+
+			// Empty fixed blocks are ten bits long.
+			for i := uint(0); i < pre; i++ {
+				w.writeBits(1<<1, 3)
+				w.writeBits(0, 7)
+			}
+
+			w.alignTo(n)
+			assert.Equal(t, n, w.nbits, "alignTo(%d) after %d blocks", n, pre)
+
+			w.alignStored()
+			w.buf = append(w.buf, closeFooter...)
+			require.NoError(t, w.flush())
+
+			p, err := ioutil.ReadAll(flate.NewReader(&buf))
+			assert.NoError(t, err, "alignTo(%d) after %d blocks", n, pre)
+			assert.Empty(t, p)
+		}
+	}
+}
+
+func TestBitWriterCopyBits(t *testing.T) {
+	src := spliceTestDocument(1 << 10)
+
+	for pre := uint(0); pre < 8; pre++ {
+		for start := int64(0); start < 16; start++ {
+			end := int64(len(src)*8) - start*3
+
+			var buf bytes.Buffer
+			w := &bitWriter{w: &buf}
+			w.writeBits(0x55&(1<<pre-1), pre)
+			w.copyBits(src, start, end)
+			w.writeBits(0, 7)
+			require.NoError(t, w.flush())
+
+			for i := int64(0); i < end-start; i++ {
+				if readBits(buf.Bytes(), int64(pre)+i, 1) != readBits(src, start+i, 1) {
+					t.Fatalf("copyBits(%d, %d) after %d bits differs at bit %d", start, end, pre, i)
+				}
+			}
+		}
+	}
+}
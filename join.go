@@ -0,0 +1,148 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// deflateScan is the result of decoding a complete DEFLATE stream to find its
+// final block.
+type deflateScan struct {
+	final inflateBlock
+
+	// n is the length of the stream in bytes.
+	n int
+
+	size uint64
+	crc  uint32
+}
+
+func scanDeflate(in []byte) (deflateScan, error) {
+	f := newInflater(in)
+	for {
+		// Only the window is needed to continue decoding.
+		f.trim(f.pos())
+
+		blk, err := f.next()
+		if err != nil {
+			return deflateScan{}, err
+		}
+
+		if blk.final {
+			return deflateScan{
+				final: blk,
+				n:     int((blk.endBit + 7) / 8),
+				size:  uint64(blk.end),
+				crc:   f.crc,
+			}, nil
+		}
+	}
+}
+
+// AddDeflateStream adds a complete raw DEFLATE stream to the builder, such as
+// one created by compress/flate or by another library or tool.
+//
+// Unlike AddPrecompressedData, the stream may have been created at any
+// compression level and may end with a final block at any bit position. It
+// is decoded to find its final block, but is not recompressed. The final
+// block flag is cleared and the stream is padded to a byte boundary with an
+// empty stored block, if needed, so that more data can follow.
+func (b *builder) AddDeflateStream(data []byte) {
+	if b.last == start {
+		b.writeHeader()
+	}
+	if !b.canWrite() {
+		return
+	}
+
+	scan, err := scanDeflate(data)
+	switch {
+	case err != nil:
+		b.err = err
+	case scan.n != len(data):
+		b.err = errors.New("gzipbuilder: trailing data after DEFLATE stream")
+	default:
+		b.addDeflateStream(data, scan)
+	}
+}
+
+// AddGzipMember adds the compressed data of a single GZIP member to the
+// builder without decompressing and recompressing it. The GZIP header and
+// trailer of the member are discarded, after the checksum and size have been
+// verified.
+//
+// This allows GZIP files from any source to be concatenated into a single
+// GZIP member, as zlib's gzjoin example does. See AddDeflateStream.
+func (b *builder) AddGzipMember(member []byte) {
+	if b.last == start {
+		b.writeHeader()
+	}
+	if !b.canWrite() {
+		return
+	}
+
+	n, err := gzipHeaderSize(member)
+	if err != nil {
+		b.err = err
+		return
+	}
+	data := member[n:]
+
+	scan, err := scanDeflate(data)
+	switch {
+	case err != nil:
+		b.err = err
+	case len(data)-scan.n < 8:
+		b.err = io.ErrUnexpectedEOF
+	case len(data)-scan.n > 8:
+		b.err = errors.New("gzipbuilder: trailing data after GZIP member")
+	case binary.LittleEndian.Uint32(data[scan.n:]) != scan.crc ||
+		binary.LittleEndian.Uint32(data[scan.n+4:]) != uint32(scan.size):
+		b.err = errors.New("gzipbuilder: checksum or size mismatch")
+	default:
+		b.addDeflateStream(data[:scan.n], scan)
+	}
+}
+
+func (b *builder) addDeflateStream(data []byte, scan deflateScan) {
+	if scan.size == 0 || !b.flushCompressed() || !b.reserve(int64(len(data))) {
+		return
+	}
+	b.last = precompressed
+	b.prevSize, b.prevCRC = scan.size, scan.crc
+	b.indexReset(int64(scan.size))
+
+	if !b.rawDeflate {
+		b.size += scan.size
+		b.crc = combineCRC32(crc32Mat, b.crc, scan.crc, scan.size)
+	}
+	if b.digestDeflate(bytes.NewReader(data), nil); b.err != nil {
+		return
+	}
+
+	// An empty final block, as written by many compressors when they are
+	// closed, can be dropped entirely.
+	final, end := scan.final, scan.final.endBit
+	if final.start == final.end {
+		end = final.startBit
+	}
+
+	// Everything before the final block is copied as is.
+	if _, b.err = b.w.Write(data[:final.startBit/8]); b.err != nil {
+		return
+	}
+
+	bw := &bitWriter{w: b.w}
+	bw.copyBits(data, final.startBit&^7, final.startBit)
+	if end > final.startBit {
+		bw.writeBits(0, 1) // clear the final block flag
+		bw.copyBits(data, final.startBit+1, end)
+	}
+	if bw.nbits > 0 {
+		bw.alignStored()
+	}
+
+	b.err = bw.flush()
+}
@@ -0,0 +1,118 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func deflateBytes(t *testing.T, data []byte, level int) []byte {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, level)
+	require.NoError(t, err)
+
+	fw.Write(data)
+	require.NoError(t, fw.Close())
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, data []byte, level int) []byte {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	require.NoError(t, err)
+	zw.Name = "test.txt"
+	zw.Comment = "a comment"
+	zw.Extra = []byte("extra")
+
+	zw.Write(data)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestBuilderAddDeflateStream(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+
+	for level := HuffmanOnly; level <= BestCompression; level++ {
+		for _, data := range [][]byte{nil, []byte("a"), []byte("hello"), doc[:1000], doc} {
+			b := NewBuilder(DefaultCompression)
+			b.AddCompressedData([]byte("first "))
+			b.AddDeflateStream(deflateBytes(t, data, level))
+			b.AddUncompressedData([]byte(" second "))
+			b.AddDeflateStream(deflateBytes(t, data, level))
+			b.AddDeflateStream(deflateBytes(t, []byte(" third"), level))
+
+			bb, err := b.Bytes()
+			require.NoError(t, err, "at level %d", level)
+
+			assert.Equal(t, "first "+string(data)+" second "+string(data)+" third",
+				decompressBytes(t, bb), "at level %d", level)
+		}
+	}
+}
+
+func TestBuilderAddDeflateStreamMidByte(t *testing.T) {
+	// A single fixed block holding "a" that ends mid-byte.
+	stream := []byte{0x4b, 0x04, 0x00}
+
+	p, err := scanDeflate(stream)
+	require.NoError(t, err)
+	require.NotZero(t, p.final.endBit%8, "test stream should end mid-byte")
+
+	b := NewBuilder(DefaultCompression)
+	b.AddDeflateStream(stream)
+	b.AddDeflateStream(stream)
+
+	bb, err := b.Bytes()
+	require.NoError(t, err)
+
+	debugLogf(t, "%d:%x", len(bb), bb)
+
+	assert.Equal(t, "aa", decompressBytes(t, bb))
+}
+
+func TestBuilderAddGzipMember(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, BestSpeed)
+	for level := HuffmanOnly; level <= BestCompression; level++ {
+		w.AddGzipMember(gzipBytes(t, doc, level))
+	}
+	require.NoError(t, w.Close())
+
+	expect := bytes.Repeat(doc, BestCompression-HuffmanOnly+1)
+	assert.Equal(t, string(expect), decompressBytes(t, buf.Bytes()))
+}
+
+func TestBuilderAddGzipMemberErrors(t *testing.T) {
+	member := gzipBytes(t, []byte("hello, world"), DefaultCompression)
+
+	bad := append([]byte(nil), member...)
+	bad[len(bad)-5] ^= 0xff
+
+	for _, tc := range []struct {
+		member []byte
+		err    string
+	}{
+		{member[:len(member)-1], "unexpected EOF"},
+		{member[:len(member)-10], "unexpected EOF"},
+		{append(member[:len(member):len(member)], 0), "gzipbuilder: trailing data after GZIP member"},
+		{bad, "gzipbuilder: checksum or size mismatch"},
+		{member[3:], "gzipbuilder: invalid GZIP header"},
+	} {
+		b := NewBuilder(DefaultCompression)
+		b.AddGzipMember(tc.member)
+
+		_, err := b.Bytes()
+		assert.EqualError(t, err, tc.err)
+	}
+
+	b := NewBuilder(DefaultCompression)
+	b.AddDeflateStream([]byte{0x03, 0x00, 0x00})
+	_, err := b.Bytes()
+	assert.EqualError(t, err, "gzipbuilder: trailing data after DEFLATE stream")
+}
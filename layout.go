@@ -0,0 +1,430 @@
+package gzipbuilder
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// storedBlockLen is the maximum length of the data in a stored block, and
+// storedBlockHeaderLen is the length of its header.
+const (
+	storedBlockLen       = 1<<16 - 1
+	storedBlockHeaderLen = 5
+)
+
+var errStopRender = errors.New("gzipbuilder: render stopped")
+
+// A Layout is a GZIP stream built from a fixed list of segments, whose byte
+// layout is computed without building the stream. It implements io.ReaderAt,
+// producing only the bytes of the stream that are read: precompressed
+// segments are sliced directly and live segments are only rendered when they
+// are read.
+//
+// This allows Range requests for a response with Content-Encoding: gzip to be
+// served, such as to resume the download of a large generated export, without
+// building the response from the start. See ServeContent.
+//
+// A Layout must not be modified once it has been read from. It is safe for
+// concurrent reads.
+type Layout struct {
+	level int
+
+	segs []layoutSegment
+	size int64
+
+	// usize is the length of the decompressed data.
+	usize uint64
+
+	mu     sync.Mutex
+	crc    uint32
+	crcSet bool
+
+	err error
+}
+
+type layoutSegment struct {
+	// off is the offset of the segment in the stream and n is its length.
+	off int64
+	n   int64
+
+	pd *PrecompressedData
+
+	// data or render, if pd is nil, produces the data of the segment,
+	// which is written as stored blocks.
+	data   []byte
+	render func(w io.Writer) error
+
+	// usize is the length of the decompressed data.
+	usize int64
+}
+
+// NewLayout creates a Layout using the given compression level.
+func NewLayout(level int) *Layout {
+	return &Layout{
+		level: level,
+		size:  gzipHeaderLen,
+
+		err: validCompressionLevel(level),
+	}
+}
+
+// Err returns an error if one has occurred during building.
+func (l *Layout) Err() error {
+	return l.err
+}
+
+func (l *Layout) add(seg layoutSegment) {
+	seg.off = l.size
+	l.segs = append(l.segs, seg)
+	l.size += seg.n
+}
+
+// AddPrecompressedData adds data that was precompressed to the Layout.
+//
+// The PrecompressedData must have been created with the same compression level
+// as the Layout.
+func (l *Layout) AddPrecompressedData(data *PrecompressedData) {
+	if l.err != nil {
+		return
+	}
+	if l.level != data.level {
+		l.err = errors.New("gzipbuilder: compression level mismatch")
+		return
+	}
+	if data.final {
+		l.err = errFinalData
+		return
+	}
+	if data.prefix != nil {
+		l.err = errSuffixData
+		return
+	}
+	if data.size == 0 {
+		return
+	}
+
+	n := int64(len(data.bytes))
+	if data.src != nil {
+		n = data.src.Size()
+	}
+
+	l.add(layoutSegment{n: n, pd: data, usize: int64(data.size)})
+	l.usize += data.size
+}
+
+// AddCompressedData compresses data and adds it to the Layout. data is
+// compressed immediately, as the layout depends on its compressed length.
+//
+// Note: AddCompressedData is vulnerable to exploits such as BREACH when used
+// with secret data.
+func (l *Layout) AddCompressedData(data []byte) {
+	if l.err != nil {
+		return
+	}
+
+	d, err := PrecompressData(data, l.level)
+	if err != nil {
+		l.err = err
+		return
+	}
+
+	l.AddPrecompressedData(d)
+}
+
+// AddUncompressedData adds data to the Layout without compressing it.
+//
+// Note: AddUncompressedData should be used to add secret data to the stream,
+// such as authentication cookies, as it is immune to exploits such as BREACH.
+func (l *Layout) AddUncompressedData(data []byte) {
+	if l.err != nil || len(data) == 0 {
+		return
+	}
+
+	l.addStored(layoutSegment{data: data, usize: int64(len(data))})
+}
+
+// AddLiveData adds size bytes of data that are rendered on demand by render,
+// without compression. render must write exactly size bytes and must write the
+// same bytes each time it is called.
+//
+// render is only called when the segment is read, and may be stopped early by
+// an error from the io.Writer once the bytes needed have been written. The
+// GZIP trailer holds a checksum of all the data, so render is called once for
+// every live segment the first time the trailer is read.
+func (l *Layout) AddLiveData(size int64, render func(w io.Writer) error) {
+	if l.err != nil || size == 0 {
+		return
+	}
+	if size < 0 {
+		l.err = errors.New("gzipbuilder: negative live data size")
+		return
+	}
+
+	l.addStored(layoutSegment{render: render, usize: size})
+}
+
+func (l *Layout) addStored(seg layoutSegment) {
+	blocks := (seg.usize + storedBlockLen - 1) / storedBlockLen
+	seg.n = seg.usize + blocks*storedBlockHeaderLen
+
+	l.add(seg)
+	l.usize += uint64(seg.usize)
+}
+
+// Size returns the length of the GZIP stream.
+func (l *Layout) Size() int64 {
+	return l.size + int64(len(closeFooter)) + 8
+}
+
+// NewReader returns an io.ReadSeeker that reads the GZIP stream.
+func (l *Layout) NewReader() io.ReadSeeker {
+	return io.NewSectionReader(l, 0, l.Size())
+}
+
+// ServeContent replies to the request with the GZIP stream using
+// http.ServeContent, which handles Range, If-Range and conditional requests.
+// Only the bytes of the stream that intersect the requested ranges are
+// produced. The Content-Encoding header is set to gzip, so that ranges apply
+// to the compressed representation.
+//
+// The caller should set the Content-Type header and may set a strong ETag
+// header, which must change when the segments do.
+func (l *Layout) ServeContent(w http.ResponseWriter, r *http.Request, name string, modtime time.Time) {
+	if l.err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	http.ServeContent(w, r, name, modtime, l.NewReader())
+}
+
+// WriteTo writes the GZIP stream to w.
+func (l *Layout) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, io.NewSectionReader(l, 0, l.Size()))
+}
+
+// ReadAt implements io.ReaderAt.
+func (l *Layout) ReadAt(p []byte, off int64) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if off < 0 {
+		return 0, errors.New("gzipbuilder: negative offset")
+	}
+
+	size := l.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	var eof error
+	if int64(len(p)) > size-off {
+		p, eof = p[:size-off], io.EOF
+	}
+	n := len(p)
+
+	if off < gzipHeaderLen {
+		c := copy(p, l.header()[off:])
+		p, off = p[c:], off+int64(c)
+	}
+
+	i := sort.Search(len(l.segs), func(i int) bool {
+		return l.segs[i].off+l.segs[i].n > off
+	})
+	for ; i < len(l.segs) && len(p) > 0; i++ {
+		seg := &l.segs[i]
+
+		c := seg.off + seg.n - off
+		if c > int64(len(p)) {
+			c = int64(len(p))
+		}
+		if err := seg.readAt(p[:c], off-seg.off); err != nil {
+			return 0, err
+		}
+		p, off = p[c:], off+c
+	}
+
+	if len(p) > 0 {
+		footer, err := l.footer()
+		if err != nil {
+			return 0, err
+		}
+
+		copy(p, footer[off-l.size:])
+	}
+
+	return n, eof
+}
+
+func (l *Layout) header() []byte {
+	hdr := [gzipHeaderLen]byte{
+		0: 0x1f, 1: 0x8b, 2: 8,
+		9: 255, // unknown OS
+	}
+
+	switch l.level {
+	case BestCompression:
+		hdr[8] = 2
+	case BestSpeed:
+		hdr[8] = 4
+	}
+
+	return hdr[:]
+}
+
+// footer returns the final block and the GZIP trailer. The checksum is
+// calculated the first time it is needed.
+func (l *Layout) footer() ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.crcSet {
+		var crc uint32
+		for i := range l.segs {
+			segCRC, err := l.segs[i].checksum()
+			if err != nil {
+				return nil, err
+			}
+
+			crc = combineCRC32(crc32Mat, crc, segCRC, uint64(l.segs[i].usize))
+		}
+
+		l.crc, l.crcSet = crc, true
+	}
+
+	footer := make([]byte, len(closeFooter)+8)
+	n := copy(footer, closeFooter)
+	binary.LittleEndian.PutUint32(footer[n:], l.crc)
+	binary.LittleEndian.PutUint32(footer[n+4:], uint32(l.usize))
+	return footer, nil
+}
+
+func (s *layoutSegment) checksum() (uint32, error) {
+	switch {
+	case s.pd != nil:
+		return s.pd.crc, nil
+	case s.render == nil:
+		return crc32.ChecksumIEEE(s.data), nil
+	}
+
+	h := crc32.NewIEEE()
+	cw := &countWriter{w: h}
+	if err := s.render(cw); err != nil {
+		return 0, err
+	}
+	if cw.n != s.usize {
+		return 0, errors.New("gzipbuilder: live data size mismatch")
+	}
+
+	return h.Sum32(), nil
+}
+
+// readAt fills p from the segment at off, which must be within the segment.
+func (s *layoutSegment) readAt(p []byte, off int64) error {
+	if s.pd != nil {
+		if s.pd.src != nil {
+			// An io.ReaderAt may return io.EOF alongside a full read at
+			// the end of its data.
+			n, err := s.pd.src.ReadAt(p, off)
+			if err == io.EOF && n == len(p) {
+				err = nil
+			}
+			return err
+		}
+
+		copy(p, s.pd.bytes[off:])
+		return nil
+	}
+
+	// Each stored block holds storedBlockLen bytes of data, except for the
+	// last, and is preceded by its header.
+	const blockLen = storedBlockHeaderLen + storedBlockLen
+
+	start := off/blockLen*storedBlockLen + off%blockLen - storedBlockHeaderLen
+	if off%blockLen < storedBlockHeaderLen {
+		start = off / blockLen * storedBlockLen
+	}
+	end := start + int64(len(p))
+	if end > s.usize {
+		end = s.usize
+	}
+
+	data, err := s.content(start, end)
+	if err != nil {
+		return err
+	}
+
+	for len(p) > 0 {
+		k, pos := off/blockLen, off%blockLen
+
+		n := s.usize - k*storedBlockLen
+		if n > storedBlockLen {
+			n = storedBlockLen
+		}
+
+		var c int
+		if pos < storedBlockHeaderLen {
+			hdr := [storedBlockHeaderLen]byte{0, byte(n), byte(n >> 8), ^byte(n), ^byte(n >> 8)}
+			c = copy(p, hdr[pos:])
+		} else {
+			from, to := k*storedBlockLen+pos-storedBlockHeaderLen, k*storedBlockLen+n
+			if to > end {
+				to = end
+			}
+			c = copy(p, data[from-start:to-start])
+		}
+
+		p, off = p[c:], off+int64(c)
+	}
+
+	return nil
+}
+
+// content returns the data of the segment from start to end.
+func (s *layoutSegment) content(start, end int64) ([]byte, error) {
+	if s.render == nil || start == end {
+		return s.data[start:end], nil
+	}
+
+	cw := &captureWriter{skip: start, buf: make([]byte, 0, end-start)}
+	switch err := s.render(cw); {
+	case err == errStopRender:
+	case err != nil:
+		return nil, err
+	case int64(len(cw.buf)) < end-start:
+		return nil, errors.New("gzipbuilder: live data size mismatch")
+	}
+
+	return cw.buf, nil
+}
+
+// captureWriter captures cap(buf) bytes after skipping skip bytes, and then
+// stops the render with errStopRender.
+type captureWriter struct {
+	skip int64
+	buf  []byte
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.skip >= int64(len(p)) {
+		w.skip -= int64(len(p))
+		return n, nil
+	}
+	p, w.skip = p[w.skip:], 0
+
+	if c := cap(w.buf) - len(w.buf); len(p) >= c {
+		w.buf = append(w.buf, p[:c]...)
+		return n, errStopRender
+	}
+
+	w.buf = append(w.buf, p...)
+	return n, nil
+}
@@ -0,0 +1,217 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type layoutTest struct {
+	doc, live []byte
+	renders   int
+}
+
+func (lt *layoutTest) render(w io.Writer) error {
+	lt.renders++
+
+	// Write in small pieces, as a template might.
+	for p := lt.live; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+
+		if _, err := w.Write(p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+
+	return nil
+}
+
+func (lt *layoutTest) layout(t *testing.T) (*Layout, string) {
+	pd := MustPrecompressedData(PrecompressData(lt.doc, DefaultCompression))
+
+	l := NewLayout(DefaultCompression)
+	l.AddPrecompressedData(pd)
+	l.AddUncompressedData(lt.doc[:150000])
+	l.AddLiveData(int64(len(lt.live)), lt.render)
+	l.AddCompressedData([]byte("compressed"))
+	l.AddPrecompressedData(MustPrecompressedData(PrecompressData(nil, DefaultCompression)))
+	l.AddUncompressedData([]byte("secret"))
+	require.NoError(t, l.Err())
+
+	return l, string(lt.doc) + string(lt.doc[:150000]) + string(lt.live) + "compressed" + "secret"
+}
+
+func newLayoutTest() *layoutTest {
+	return &layoutTest{
+		doc:  spliceTestDocument(200 << 10),
+		live: spliceTestDocument(140000),
+	}
+}
+
+func TestLayout(t *testing.T) {
+	lt := newLayoutTest()
+	l, expect := lt.layout(t)
+
+	var buf bytes.Buffer
+	n, err := l.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, l.Size(), n)
+	assert.Equal(t, int64(buf.Len()), l.Size())
+
+	full := buf.Bytes()
+	assert.Equal(t, expect, decompressBytes(t, full))
+
+	rand := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		off := rand.Int63n(l.Size())
+		p := make([]byte, rand.Intn(100<<10))
+
+		n, err := l.ReadAt(p, off)
+		if off+int64(len(p)) > l.Size() {
+			assert.Equal(t, io.EOF, err)
+		} else {
+			require.NoError(t, err)
+		}
+
+		if !assert.Equal(t, full[off:off+int64(n)], p[:n], "at offset %d", off) {
+			break
+		}
+	}
+}
+
+// eofReaderAt returns io.EOF alongside any read that reaches the end of its
+// data, as the io.ReaderAt contract permits.
+type eofReaderAt struct{ *bytes.Reader }
+
+func (r eofReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.Reader.ReadAt(p, off)
+	if err == nil && off+int64(n) == r.Size() {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func TestLayoutReaderAtEOF(t *testing.T) {
+	doc := spliceTestDocument(10 << 10)
+
+	var buf bytes.Buffer
+	w := NewPrecompressedStreamWriter(&buf, DefaultCompression)
+	w.Write(doc)
+	_, err := w.Len()
+	require.NoError(t, err)
+
+	pd, err := w.Data(eofReaderAt{bytes.NewReader(buf.Bytes())}, 0)
+	require.NoError(t, err)
+
+	l := NewLayout(DefaultCompression)
+	l.AddPrecompressedData(pd)
+	require.NoError(t, l.Err())
+
+	p := make([]byte, l.Size())
+	n, err := l.ReadAt(p, 0)
+	require.NoError(t, err)
+	assert.Equal(t, len(p), n)
+	assert.Equal(t, string(doc), decompressBytes(t, p))
+}
+
+func TestLayoutRenders(t *testing.T) {
+	lt := newLayoutTest()
+	l, _ := lt.layout(t)
+
+	// The precompressed segment does not render the live segment.
+	_, err := l.ReadAt(make([]byte, 1000), 1000)
+	require.NoError(t, err)
+	assert.Equal(t, 0, lt.renders)
+
+	// Reading the trailer renders it once to calculate the checksum.
+	_, err = l.ReadAt(make([]byte, 8), l.Size()-8)
+	require.NoError(t, err)
+	assert.Equal(t, 1, lt.renders)
+	_, err = l.ReadAt(make([]byte, 8), l.Size()-8)
+	require.NoError(t, err)
+	assert.Equal(t, 1, lt.renders)
+
+	// Reading the live segment renders it.
+	_, err = l.ReadAt(make([]byte, 10), l.segs[2].off+70000)
+	require.NoError(t, err)
+	assert.Equal(t, 2, lt.renders)
+}
+
+func TestLayoutServeContent(t *testing.T) {
+	lt := newLayoutTest()
+	l, _ := lt.layout(t)
+
+	var buf bytes.Buffer
+	_, err := l.WriteTo(&buf)
+	require.NoError(t, err)
+	full := buf.Bytes()
+
+	for _, test := range []struct {
+		rng    string
+		status int
+		body   []byte
+	}{
+		{"", http.StatusOK, full},
+		{"bytes=100-199", http.StatusPartialContent, full[100:200]},
+		{"bytes=300000-", http.StatusPartialContent, full[300000:]},
+		{"bytes=-20", http.StatusPartialContent, full[len(full)-20:]},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/export.csv", nil)
+		if test.rng != "" {
+			req.Header.Set("Range", test.rng)
+		}
+
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Type", "text/csv")
+		l.ServeContent(w, req, "export.csv", time.Time{})
+
+		assert.Equal(t, test.status, w.Code, test.rng)
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"), test.rng)
+		assert.Equal(t, "text/csv", w.Header().Get("Content-Type"), test.rng)
+		assert.True(t, bytes.Equal(test.body, w.Body.Bytes()), test.rng)
+	}
+}
+
+func TestLayoutErrors(t *testing.T) {
+	l := NewLayout(DefaultCompression)
+	l.AddPrecompressedData(MustPrecompressedData(PrecompressData([]byte("a"), BestSpeed)))
+	assert.EqualError(t, l.Err(), "gzipbuilder: compression level mismatch")
+
+	w := httptest.NewRecorder()
+	l.ServeContent(w, httptest.NewRequest(http.MethodGet, "/", nil), "", time.Time{})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	l = NewLayout(DefaultCompression)
+	l.AddLiveData(-1, nil)
+	assert.EqualError(t, l.Err(), "gzipbuilder: negative live data size")
+
+	l = NewLayout(DefaultCompression)
+	l.AddLiveData(10, func(w io.Writer) error {
+		_, err := w.Write([]byte("short"))
+		return err
+	})
+	_, err := l.WriteTo(ioutil.Discard)
+	assert.EqualError(t, err, "gzipbuilder: live data size mismatch")
+
+	renderErr := errors.New("render failed")
+	l = NewLayout(DefaultCompression)
+	l.AddLiveData(10, func(w io.Writer) error { return renderErr })
+	_, err = l.WriteTo(ioutil.Discard)
+	assert.Equal(t, renderErr, err)
+
+	_, err = NewLayout(DefaultCompression).ReadAt(make([]byte, 1), -1)
+	assert.EqualError(t, err, "gzipbuilder: negative offset")
+}
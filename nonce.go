@@ -0,0 +1,276 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"errors"
+)
+
+// A NonceTemplate is an HTML document that has been precompressed once and
+// can be rendered with a fresh Content-Security-Policy nonce for every
+// request.
+//
+// Every nonce attribute in the document, whatever its value, becomes a slot
+// for the nonce. The document is otherwise left as is, unless it was created
+// with NewNonceTemplateAddMissing. The static spans between the slots are added as
+// precompressed data and the nonce is added as uncompressed data, so the nonce
+// never enters the compression context and rendering costs little more than
+// copying the cached bytes.
+type NonceTemplate struct {
+	level int
+
+	segments []*PrecompressedData
+}
+
+// NewNonceTemplate parses and precompresses the HTML document at the given
+// compression level.
+func NewNonceTemplate(html []byte, level int) (*NonceTemplate, error) {
+	return newNonceTemplate(html, level, false)
+}
+
+// NewNonceTemplateAddMissing is like NewNonceTemplate, but also adds a nonce
+// attribute to every <script> and <style> element that lacks one.
+//
+// This allows every inline script and style in the document under the
+// Content-Security-Policy, including any that were deliberately left without
+// a nonce, so it should only be used with documents that are fully trusted.
+func NewNonceTemplateAddMissing(html []byte, level int) (*NonceTemplate, error) {
+	return newNonceTemplate(html, level, true)
+}
+
+func newNonceTemplate(html []byte, level int, addMissing bool) (*NonceTemplate, error) {
+	t := &NonceTemplate{level: level}
+	for _, span := range splitNonceSlots(html, addMissing) {
+		d, err := PrecompressData(span, level)
+		if err != nil {
+			return nil, err
+		}
+
+		t.segments = append(t.segments, d)
+	}
+
+	return t, nil
+}
+
+// Slots returns the number of nonce slots in the document.
+func (t *NonceTemplate) Slots() int {
+	return len(t.segments) - 1
+}
+
+// Render adds the document to w with nonce in every slot. w must use the same
+// compression level as the template. The caller is responsible for closing w.
+//
+// The nonce must be a non-empty base64 or base64url string, anything else will
+// cause an error to be returned from Close.
+func (t *NonceTemplate) Render(w *Writer, nonce []byte) {
+	t.render(&w.builder, nonce)
+}
+
+// Bytes renders the document with nonce in every slot and returns the
+// complete GZIP stream.
+//
+// The nonce must be a non-empty base64 or base64url string.
+func (t *NonceTemplate) Bytes(nonce []byte) ([]byte, error) {
+	b := NewBuilder(t.level)
+	t.render(&b.builder, nonce)
+	return b.Bytes()
+}
+
+func (t *NonceTemplate) render(b *builder, nonce []byte) {
+	if !validNonce(nonce) && b.err == nil {
+		b.err = errors.New("gzipbuilder: invalid CSP nonce")
+	}
+
+	for i, d := range t.segments {
+		if i > 0 {
+			b.AddUncompressedData(nonce)
+		}
+
+		b.AddPrecompressedData(d)
+	}
+}
+
+func validNonce(nonce []byte) bool {
+	for _, c := range nonce {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '+' || c == '/' || c == '-' || c == '_' || c == '=') {
+			return false
+		}
+	}
+
+	return len(nonce) > 0
+}
+
+// splitNonceSlots splits html at each nonce slot. The returned spans are
+// separated by slots. If addMissing is true, a slot is added to every script
+// and style element without a nonce attribute.
+func splitNonceSlots(html []byte, addMissing bool) [][]byte {
+	spans := [][]byte{nil}
+	add := func(p []byte) {
+		spans[len(spans)-1] = append(spans[len(spans)-1], p...)
+	}
+	slot := func() {
+		spans = append(spans, nil)
+	}
+
+	for len(html) > 0 {
+		i := bytes.IndexByte(html, '<')
+		if i < 0 {
+			break
+		}
+		add(html[:i])
+		html = html[i:]
+
+		if bytes.HasPrefix(html, []byte("<!--")) {
+			end := bytes.Index(html[4:], []byte("-->"))
+			if end < 0 {
+				break
+			}
+
+			add(html[:4+end+3])
+			html = html[4+end+3:]
+			continue
+		}
+
+		name := tagName(html[1:])
+		if name == nil {
+			add(html[:1])
+			html = html[1:]
+			continue
+		}
+
+		add(html[:1+len(name)])
+		html = html[1+len(name):]
+
+		rawText := bytes.EqualFold(name, []byte("script")) || bytes.EqualFold(name, []byte("style"))
+		hasNonce := false
+
+		for {
+			// Whitespace before the attribute.
+			n := 0
+			for n < len(html) && isHTMLSpace(html[n]) {
+				n++
+			}
+			add(html[:n])
+			html = html[n:]
+
+			if len(html) == 0 {
+				return spans
+			}
+			if html[0] == '>' || bytes.HasPrefix(html, []byte("/>")) {
+				break
+			}
+
+			attr, nameEnd, n := parseAttribute(html)
+			if !bytes.EqualFold(attr, []byte("nonce")) {
+				add(html[:n])
+				html = html[n:]
+				continue
+			}
+
+			hasNonce = true
+
+			add(html[:nameEnd])
+			add([]byte(`="`))
+			slot()
+			add([]byte(`"`))
+			html = html[n:]
+		}
+
+		if rawText && !hasNonce && addMissing {
+			add([]byte(` nonce="`))
+			slot()
+			add([]byte(`"`))
+		}
+
+		end := bytes.IndexByte(html, '>')
+		add(html[:end+1])
+		html = html[end+1:]
+
+		if rawText {
+			// Skip over the contents of the element so that markup
+			// inside scripts and styles is not parsed.
+			endTag := indexFold(html, append([]byte("</"), name...))
+			if endTag < 0 {
+				break
+			}
+
+			add(html[:endTag])
+			html = html[endTag:]
+		}
+	}
+
+	add(html)
+	return spans
+}
+
+// tagName returns the name of the start tag that p begins with, or nil if p
+// does not begin with a start tag.
+func tagName(p []byte) []byte {
+	n := 0
+	for n < len(p) && ('a' <= p[n]|0x20 && p[n]|0x20 <= 'z' || n > 0 && '0' <= p[n] && p[n] <= '9') {
+		n++
+	}
+
+	if n == 0 || n < len(p) && !isHTMLSpace(p[n]) && p[n] != '>' && p[n] != '/' {
+		return nil
+	}
+
+	return p[:n]
+}
+
+// parseAttribute parses the attribute that p begins with. It returns the name
+// of the attribute, the offset of the end of the name and the total length of
+// the attribute including any value.
+func parseAttribute(p []byte) (name []byte, nameEnd, n int) {
+	for n < len(p) && !isHTMLSpace(p[n]) && p[n] != '=' && p[n] != '>' &&
+		!(p[n] == '/' && n+1 < len(p) && p[n+1] == '>') {
+		n++
+	}
+	name, nameEnd = p[:n], n
+
+	i := n
+	for i < len(p) && isHTMLSpace(p[i]) {
+		i++
+	}
+	if i == len(p) || p[i] != '=' {
+		return name, nameEnd, n
+	}
+
+	i++
+	for i < len(p) && isHTMLSpace(p[i]) {
+		i++
+	}
+
+	switch {
+	case i == len(p):
+		return name, nameEnd, i
+	case p[i] == '"' || p[i] == '\'':
+		end := bytes.IndexByte(p[i+1:], p[i])
+		if end < 0 {
+			return name, nameEnd, len(p)
+		}
+
+		return name, nameEnd, i + 1 + end + 1
+	default:
+		for i < len(p) && !isHTMLSpace(p[i]) && p[i] != '>' {
+			i++
+		}
+
+		return name, nameEnd, i
+	}
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
+
+// indexFold is like bytes.Index, but is case-insensitive for ASCII.
+func indexFold(s, sep []byte) int {
+	for i := 0; i+len(sep) <= len(s); i++ {
+		if bytes.EqualFold(s[i:i+len(sep)], sep) {
+			return i
+		}
+	}
+
+	return -1
+}
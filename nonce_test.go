@@ -0,0 +1,104 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitNonceSlots(t *testing.T) {
+	for _, tc := range []struct{ in, out, added string }{
+		{"", "", ""},
+		{"<p>hello</p>", "<p>hello</p>", "<p>hello</p>"},
+		{"<script></script>", "<script></script>", `<script nonce="{}"></script>`},
+		{"<SCRIPT src=a.js></SCRIPT>", "<SCRIPT src=a.js></SCRIPT>", `<SCRIPT src=a.js nonce="{}"></SCRIPT>`},
+		{`<script nonce="old" async>x</script>`, `<script nonce="{}" async>x</script>`, `<script nonce="{}" async>x</script>`},
+		{`<script nonce=old>x</script>`, `<script nonce="{}">x</script>`, `<script nonce="{}">x</script>`},
+		{`<style nonce>a{}</style>`, `<style nonce="{}">a{}</style>`, `<style nonce="{}">a{}</style>`},
+		{`<link rel=preload NONCE='x'/>`, `<link rel=preload NONCE="{}"/>`, `<link rel=preload NONCE="{}"/>`},
+		{`<div data-nonce="x">`, `<div data-nonce="x">`, `<div data-nonce="x">`},
+		{`<script>if (a<b) document.write("<script nonce=x></script>")</script><style>`,
+			`<script>if (a<b) document.write("<script nonce=x></script>")</script><style>`,
+			`<script nonce="{}">if (a<b) document.write("<script nonce=x></script>")</script><style nonce="{}">`},
+		{`<!-- <script nonce=x> --><a>`, `<!-- <script nonce=x> --><a>`, `<!-- <script nonce=x> --><a>`},
+		{`a < b <3`, `a < b <3`, `a < b <3`},
+		{`<script`, `<script`, `<script`},
+		{`<script nonce="x`, `<script nonce="{}"`, `<script nonce="{}"`},
+	} {
+		for _, addMissing := range []bool{false, true} {
+			spans := splitNonceSlots([]byte(tc.in), addMissing)
+
+			var got []string
+			for _, span := range spans {
+				got = append(got, string(span))
+			}
+
+			expect := tc.out
+			if addMissing {
+				expect = tc.added
+			}
+			assert.Equal(t, expect, strings.Join(got, "{}"), "for %q, addMissing=%t", tc.in, addMissing)
+		}
+	}
+}
+
+func TestNonceTemplate(t *testing.T) {
+	const html = `<!DOCTYPE html><html><head><script src="/app.js"></script>` +
+		`<style nonce="placeholder">body{}</style></head><body><p>Hello</p>` +
+		`<script>console.log("hi")</script></body></html>`
+
+	tmpl, err := NewNonceTemplate([]byte(html), DefaultCompression)
+	require.NoError(t, err, "NewNonceTemplate failed")
+	assert.Equal(t, 1, tmpl.Slots())
+
+	bb, err := tmpl.Bytes([]byte("abc123"))
+	require.NoError(t, err, "Bytes failed")
+	assert.Equal(t, strings.Replace(html, "placeholder", "abc123", 1), decompressBytes(t, bb),
+		"only existing nonce attributes should be replaced")
+
+	tmpl, err = NewNonceTemplateAddMissing([]byte(html), DefaultCompression)
+	require.NoError(t, err, "NewNonceTemplateAddMissing failed")
+	assert.Equal(t, 3, tmpl.Slots())
+
+	expect := strings.NewReplacer(
+		`<script>`, `<script nonce="NONCE">`,
+		`"/app.js">`, `"/app.js" nonce="NONCE">`,
+		`nonce="placeholder"`, `nonce="NONCE"`,
+	).Replace(html)
+
+	for _, nonce := range []string{"abc123", "r4nd0m+/=="} {
+		bb, err := tmpl.Bytes([]byte(nonce))
+		require.NoError(t, err, "Bytes failed")
+
+		debugLogf(t, "%d:%x", len(bb), bb)
+
+		assert.Equal(t, strings.Replace(expect, "NONCE", nonce, -1), decompressBytes(t, bb))
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, DefaultCompression)
+	tmpl.Render(w, []byte("xyz"))
+	require.NoError(t, w.Close(), "Close failed")
+
+	assert.Equal(t, strings.Replace(expect, "NONCE", "xyz", -1), decompressBytes(t, buf.Bytes()))
+}
+
+func TestNonceTemplateInvalidNonce(t *testing.T) {
+	tmpl, err := NewNonceTemplate([]byte("<script nonce></script>"), DefaultCompression)
+	require.NoError(t, err, "NewNonceTemplate failed")
+
+	for _, nonce := range []string{"", `"><script>alert(1)</script>`, "a b"} {
+		bb, err := tmpl.Bytes([]byte(nonce))
+		assert.EqualError(t, err, "gzipbuilder: invalid CSP nonce", "for %q", nonce)
+		assert.Nil(t, bb, "expected nil []byte from Bytes")
+	}
+}
+
+func TestNonceTemplateInvalidLevel(t *testing.T) {
+	tmpl, err := NewNonceTemplate(nil, -100)
+	assert.EqualError(t, err, "flate: invalid compression level -100: want value in range [-2, 9]")
+	assert.Nil(t, tmpl, "expected nil *NonceTemplate")
+}
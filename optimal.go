@@ -0,0 +1,538 @@
+package gzipbuilder
+
+import (
+	"math"
+	"math/rand"
+)
+
+// ExhaustiveCompression is a compression level beyond BestCompression that
+// spends far more time to produce smaller output, in the way of zopfli. Each
+// chunk of input is parsed repeatedly, choosing the cheapest sequence of
+// literals and matches for the symbol costs of the last parse, the blocks are
+// split where that makes them smaller and the Huffman codes are tuned to the
+// run-length encoding of the block headers.
+//
+// It is intended for assets that are precompressed once and served many times,
+// and is only accepted by PrecompressData, PrecompressedWriter and
+// PrecompressedStreamWriter. The PrecompressedData they return has the level
+// BestCompression, so it can be added to a Builder at that level.
+const ExhaustiveCompression = BestCompression + 1
+
+const (
+	// optimalIterations is the number of times each chunk is parsed.
+	optimalIterations = 15
+
+	// maxSplitBlocks is the greatest number of blocks that the tokens of a
+	// chunk are split into.
+	maxSplitBlocks = 15
+)
+
+// dataLevel returns the compression level of the data compressed at level.
+func dataLevel(level int) int {
+	if level == ExhaustiveCompression {
+		return BestCompression
+	}
+
+	return level
+}
+
+// optimalMatch records that, for the lengths after the last optimalMatch for
+// the same position up to length, the nearest match is dist bytes back.
+type optimalMatch struct {
+	length, dist uint16
+}
+
+// optimalParser holds the scratch space of compressOptimal.
+type optimalParser struct {
+	// matches holds the optimalMatches of each position of the chunk, in
+	// order of length, from matchStart[i] to matchStart[i+1].
+	matches    []optimalMatch
+	matchStart []int32
+
+	// cost is the cheapest cost of reaching each position of the chunk,
+	// which is reached by the token at the same index of step.
+	cost []float64
+	step []token
+
+	tokens, bestTokens []token
+
+	// stats holds the symbol counts that the costs are derived from, last
+	// holds those of the parse before and best those of the best parse.
+	stats, last, best symbolStats
+	rng               *rand.Rand
+
+	litCost  [maxLitCodes]float64
+	distCost [maxDistCodes]float64
+	lenCost  [maxMatch + 1]float64
+}
+
+// compressOptimal buffers the input until the window is full, or until flush,
+// and then parses it as ExhaustiveCompression does. Unless flush is set, the
+// last minLookahead bytes are left to be parsed with the input that follows,
+// so that matches are not cut short at the end of the window.
+//
+// The tokens are written as they would be at other levels, or before the next
+// slide would remove the input that they cover from the window if they are
+// shorter written as a stored block.
+func (e *encoder) compressOptimal(flush bool) {
+	if e.pos == len(e.window) || !flush && len(e.window) < cap(e.window) {
+		return
+	}
+
+	if e.opt == nil {
+		e.opt = &optimalParser{rng: rand.New(rand.NewSource(1))}
+	}
+	p := e.opt
+
+	start, end := e.pos, len(e.window)
+	e.findMatches(start, end)
+
+	limit := end - start
+	if !flush {
+		limit -= minLookahead
+	}
+
+	// The chunk is parsed with the costs of the fixed Huffman codes and
+	// then repeatedly with the costs of the symbols in the last parse,
+	// which are blended with those before once they have settled. If
+	// parsing stops changing, the best counts are perturbed at random to
+	// escape the local minimum, as zopfli does.
+	p.rng.Seed(1)
+	p.fixedCosts()
+
+	var lastCost float64
+	bestBits := -1
+	for i := 0; i < optimalIterations; i++ {
+		cost := p.parse(e.window[start:end], limit)
+
+		// The parse is judged by the block it makes, rather than the
+		// costs it was made with.
+		bits := e.blockBits(p.tokens)
+		p.last = p.stats
+		p.stats.count(e)
+		if bestBits < 0 || bits < bestBits {
+			bestBits = bits
+			p.bestTokens = append(p.bestTokens[:0], p.tokens...)
+			p.best = p.stats
+		}
+
+		if i > 5 {
+			p.stats.blend(&p.last)
+			if cost == lastCost {
+				p.stats = p.best
+				p.stats.randomize(p.rng)
+			}
+		}
+		lastCost = cost
+
+		p.statCosts()
+	}
+
+	e.tokens = append(e.tokens, p.bestTokens...)
+	e.pos = start + tokensLen(p.bestTokens)
+
+	if !flush && (len(e.tokens) >= maxBlockTokens || e.blockStart < windowSize && e.storedIsShorter()) {
+		e.writeBlock(false)
+	}
+}
+
+// storedIsShorter reports whether the tokens would be shorter written as a
+// stored block.
+func (e *encoder) storedIsShorter() bool {
+	return storedBlockBits(e.bw.nbits, e.pos-e.blockStart) <= e.blockBits(e.tokens)
+}
+
+// findMatches adds each position from start to end to the hash chains and
+// records its matches, of every length, with the input that precedes it.
+// Matches do not extend past end.
+func (e *encoder) findMatches(start, end int) {
+	p, win := e.opt, e.window
+
+	p.matches = p.matches[:0]
+	p.matchStart = append(p.matchStart[:0], 0)
+	for pos := start; pos < end; pos++ {
+		if pos+minMatch > end {
+			p.matchStart = append(p.matchStart, int32(len(p.matches)))
+			continue
+		}
+
+		maxLen := end - pos
+		if maxLen > maxMatch {
+			maxLen = maxMatch
+		}
+
+		// Positions left unparsed by the last call are already in the
+		// hash chains, which must not be added to again.
+		var cur int
+		if pos < e.inserted {
+			cur = int(e.prev[pos%windowSize]) - 1
+		} else {
+			cur = e.insert(pos)
+			e.inserted = pos + 1
+		}
+
+		best, limit := minMatch-1, pos-maxDist
+		for chain := e.cfg.chain; cur >= limit && cur >= 0 && chain > 0; chain-- {
+			if win[cur+best] == win[pos+best] {
+				if n := matchLen(win[cur:cur+maxLen], win[pos:pos+maxLen]); n > best {
+					best = n
+					p.matches = append(p.matches, optimalMatch{uint16(n), uint16(pos - cur)})
+					if n == maxLen {
+						break
+					}
+				}
+			}
+
+			cur = int(e.prev[cur%windowSize]) - 1
+		}
+
+		p.matchStart = append(p.matchStart, int32(len(p.matches)))
+	}
+}
+
+// fixedCosts sets the symbol costs to the lengths of the fixed Huffman codes.
+func (p *optimalParser) fixedCosts() {
+	for sym := range p.litCost {
+		p.litCost[sym] = float64(fixedLitCode[sym].len)
+	}
+	for sym := range p.distCost {
+		p.distCost[sym] = float64(fixedDistCode[sym].len)
+	}
+
+	p.lengthCosts()
+}
+
+// symbolStats holds counts of the literal and length, and distance, symbols.
+type symbolStats struct {
+	lit  [maxLitCodes]float64
+	dist [maxDistCodes]float64
+}
+
+// count sets the counts to those counted by countTokens.
+func (s *symbolStats) count(e *encoder) {
+	for sym, f := range e.litFreq {
+		s.lit[sym] = float64(f)
+	}
+	for sym, f := range e.distFreq {
+		s.dist[sym] = float64(f)
+	}
+}
+
+// blend adds half of the counts of last to the counts.
+func (s *symbolStats) blend(last *symbolStats) {
+	for sym, f := range last.lit {
+		s.lit[sym] += f / 2
+	}
+	for sym, f := range last.dist {
+		s.dist[sym] += f / 2
+	}
+}
+
+// randomize replaces a third of the counts with others at random.
+func (s *symbolStats) randomize(rng *rand.Rand) {
+	randomizeCounts(rng, s.lit[:])
+	randomizeCounts(rng, s.dist[:])
+	s.lit[endBlockSym] = 1
+}
+
+func randomizeCounts(rng *rand.Rand, counts []float64) {
+	for i := range counts {
+		if rng.Intn(3) == 0 {
+			counts[i] = counts[rng.Intn(len(counts))]
+		}
+	}
+}
+
+// statCosts sets the symbol costs to their entropy in stats.
+func (p *optimalParser) statCosts() {
+	entropy(p.litCost[:], p.stats.lit[:])
+	entropy(p.distCost[:], p.stats.dist[:])
+	p.lengthCosts()
+}
+
+// entropy sets cost to the number of bits needed to code each symbol with the
+// frequencies freq. Symbols that do not occur are costed as though they
+// occurred once.
+func entropy(cost, freq []float64) {
+	var sum float64
+	for _, f := range freq {
+		sum += f
+	}
+
+	log2sum := math.Log2(sum)
+	if sum == 0 {
+		log2sum = math.Log2(float64(len(freq)))
+	}
+
+	for sym, f := range freq {
+		if f == 0 {
+			cost[sym] = log2sum
+		} else if cost[sym] = log2sum - math.Log2(f); cost[sym] < 0 {
+			cost[sym] = 0
+		}
+	}
+}
+
+// lengthCosts sets lenCost from litCost.
+func (p *optimalParser) lengthCosts() {
+	for length := minMatch; length <= maxMatch; length++ {
+		lc := lengthCode(length)
+		p.lenCost[length] = p.litCost[257+lc] + float64(lengthExtra[lc])
+	}
+}
+
+// parse finds the cheapest sequence of tokens for in, with the matches found
+// by findMatches, and stores those that cover at least the first limit bytes
+// in tokens. It returns the cost of the whole sequence.
+func (p *optimalParser) parse(in []byte, limit int) float64 {
+	n := len(in)
+	if cap(p.cost) < n+1 {
+		p.cost = make([]float64, n+1)
+		p.step = make([]token, n+1)
+	}
+	cost, step := p.cost[:n+1], p.step[:n+1]
+
+	cost[0] = 0
+	for i := 1; i <= n; i++ {
+		cost[i] = math.Inf(1)
+	}
+
+	for i := 0; i < n; i++ {
+		c := cost[i]
+		if lc := c + p.litCost[in[i]]; lc < cost[i+1] {
+			cost[i+1], step[i+1] = lc, literal(in[i])
+		}
+
+		length := minMatch
+		for _, m := range p.matches[p.matchStart[i]:p.matchStart[i+1]] {
+			dist := int(m.dist)
+			dc := distCode(dist)
+			mc := c + p.distCost[dc] + float64(distExtra[dc])
+
+			for ; length <= int(m.length); length++ {
+				if lc := mc + p.lenCost[length]; lc < cost[i+length] {
+					cost[i+length], step[i+length] = lc, match(length, dist)
+				}
+			}
+		}
+	}
+
+	// The tokens are found from the end, so they are stored in reverse.
+	p.tokens = p.tokens[:0]
+	for i := n; i > 0; {
+		t := step[i]
+		p.tokens = append(p.tokens, t)
+
+		if t&matchToken == 0 {
+			i--
+		} else {
+			i -= t.length()
+		}
+	}
+	for i, j := 0, len(p.tokens)-1; i < j; i, j = i+1, j-1 {
+		p.tokens[i], p.tokens[j] = p.tokens[j], p.tokens[i]
+	}
+
+	for i, n := 0, 0; i < len(p.tokens); i++ {
+		if n >= limit {
+			p.tokens = p.tokens[:i]
+			break
+		}
+
+		if t := p.tokens[i]; t&matchToken == 0 {
+			n++
+		} else {
+			n += t.length()
+		}
+	}
+
+	return cost[n]
+}
+
+// writeSplitBlocks writes the tokens as the blocks, of up to maxSplitBlocks,
+// that encode them shortest.
+func (e *encoder) writeSplitBlocks(final bool) {
+	splits := e.splitTokens(e.tokens, nil, maxSplitBlocks)
+
+	start := 0
+	for i := 0; i <= len(splits); i++ {
+		end := len(e.tokens)
+		if i < len(splits) {
+			end = splits[i]
+		}
+
+		tokens := e.tokens[start:end]
+		inEnd := e.blockStart + tokensLen(tokens)
+		e.writeTokenBlock(tokens, inEnd, final && end == len(e.tokens))
+		start = end
+	}
+}
+
+// tokensLen returns the length of the input that tokens cover.
+func tokensLen(tokens []token) int {
+	n := 0
+	for _, t := range tokens {
+		if t&matchToken == 0 {
+			n++
+		} else {
+			n += t.length()
+		}
+	}
+
+	return n
+}
+
+// blockBits returns the size in bits of tokens as a fixed or dynamic block.
+func (e *encoder) blockBits(tokens []token) int {
+	_, dynamicBits, fixedBits := e.dynamicCodes(e.countTokens(tokens))
+	if fixedBits < dynamicBits {
+		return fixedBits
+	}
+
+	return dynamicBits
+}
+
+// splitTokens appends to splits, in order, the indexes at which tokens should
+// be split into separate blocks, of which there may be at most maxBlocks.
+func (e *encoder) splitTokens(tokens []token, splits []int, maxBlocks int) []int {
+	const minBlockTokens = 512
+	if maxBlocks < 2 || len(tokens) < 2*minBlockTokens {
+		return splits
+	}
+
+	whole := e.blockBits(tokens)
+	split := func(i int) int {
+		return e.blockBits(tokens[:i]) + e.blockBits(tokens[i:])
+	}
+
+	// The split point is found by sampling the range and then narrowing
+	// it around the best sample, as the cost varies smoothly enough.
+	const samples = 8
+	lo, hi := minBlockTokens, len(tokens)-minBlockTokens
+	best, bestBits := 0, whole
+	for hi-lo > samples {
+		step := (hi - lo) / samples
+		at := 0
+		for i := lo; i <= hi; i += step {
+			if bits := split(i); bits < bestBits {
+				best, bestBits, at = i, bits, i
+			}
+		}
+		if at == 0 {
+			break
+		}
+
+		lo, hi = at-step, at+step
+		if lo < minBlockTokens {
+			lo = minBlockTokens
+		}
+		if hi > len(tokens)-minBlockTokens {
+			hi = len(tokens) - minBlockTokens
+		}
+	}
+
+	// Splits that save only a few bits are not worth another block.
+	if best == 0 || whole-bestBits < 64 {
+		return splits
+	}
+
+	leftMax := maxBlocks * best / len(tokens)
+	if leftMax < 1 {
+		leftMax = 1
+	}
+	rightMax := maxBlocks - leftMax
+	if rightMax < 1 {
+		rightMax = 1
+	}
+
+	splits = e.splitTokens(tokens[:best], splits, leftMax)
+	splits = append(splits, best)
+	for _, i := range e.splitTokens(tokens[best:], nil, rightMax) {
+		splits = append(splits, best+i)
+	}
+
+	return splits
+}
+
+// rleHuffmanLengths sets lens to the lengths of a Huffman code for freq, after
+// evening out the frequencies of runs of symbols so that the code lengths can
+// be run-length encoded more compactly, as zopfli does.
+func rleHuffmanLengths(lens []uint8, freq []int) {
+	counts := append([]int(nil), freq...)
+
+	// Trailing zeros are left alone, as they are not coded.
+	length := len(counts)
+	for length > 0 && counts[length-1] == 0 {
+		length--
+	}
+	if length == 0 {
+		huffmanLengths(lens, counts, maxCodeBits)
+		return
+	}
+
+	// Runs that can already be run-length encoded are kept: five or more
+	// zeros, or seven or more of another count.
+	good := make([]bool, length)
+	sym, stride := counts[0], 0
+	for i := 0; i <= length; i++ {
+		if i < length && counts[i] == sym {
+			stride++
+			continue
+		}
+
+		if sym == 0 && stride >= 5 || sym != 0 && stride >= 7 {
+			for k := 0; k < stride; k++ {
+				good[i-k-1] = true
+			}
+		}
+		if i < length {
+			sym, stride = counts[i], 1
+		}
+	}
+
+	// Other runs of similar counts are replaced by their average.
+	stride, sum, limit := 0, 0, counts[0]
+	for i := 0; i <= length; i++ {
+		if i == length || good[i] || absDiff(counts[i], limit) >= 4 {
+			if stride >= 4 || stride >= 3 && sum == 0 {
+				count := (sum + stride/2) / stride
+				if count < 1 {
+					count = 1
+				}
+				if sum == 0 {
+					// A run of zeros must not become a run of ones.
+					count = 0
+				}
+
+				for k := 0; k < stride; k++ {
+					counts[i-k-1] = count
+				}
+			}
+
+			stride, sum = 0, 0
+			switch {
+			case i < length-3:
+				limit = (counts[i] + counts[i+1] + counts[i+2] + counts[i+3] + 2) / 4
+			case i < length:
+				limit = counts[i]
+			default:
+				limit = 0
+			}
+		}
+
+		stride++
+		if i < length {
+			sum += counts[i]
+		}
+	}
+
+	huffmanLengths(lens, counts, maxCodeBits)
+}
+
+func absDiff(a, b int) int {
+	if a < b {
+		return b - a
+	}
+
+	return a - b
+}
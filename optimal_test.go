@@ -0,0 +1,109 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExhaustiveCompression(t *testing.T) {
+	inputs := map[string][]byte{
+		"empty":  nil,
+		"short":  []byte("hello hello hello world"),
+		"text":   spliceTestDocument(200 << 10),
+		"random": randomBytes(100 << 10),
+		"zeros":  make([]byte, 100<<10),
+	}
+
+	for name, data := range inputs {
+		for _, chunk := range []int{1 << 20, 7919} {
+			out := encodeBytes(t, data, ExhaustiveCompression, chunk)
+			assert.Equal(t, string(data), decompressFlateBytes(t, out), "%s: chunks of %d", name, chunk)
+
+			best := encodeBytes(t, data, BestCompression, chunk)
+			assert.True(t, len(out) <= len(best), "%s: chunks of %d: %d bytes, BestCompression %d bytes",
+				name, chunk, len(out), len(best))
+
+			debugLogf(t, "%s: chunks of %d: %d bytes, BestCompression %d bytes", name, chunk, len(out), len(best))
+		}
+	}
+}
+
+func TestExhaustiveCompressionSize(t *testing.T) {
+	data := spliceTestDocument(200 << 10)
+
+	out := encodeBytes(t, data, ExhaustiveCompression, 1<<20)
+	best := encodeBytes(t, data, BestCompression, 1<<20)
+	assert.True(t, float64(len(out)) < 0.97*float64(len(best)),
+		"%d bytes should be at least 3%% smaller than BestCompression's %d bytes", len(out), len(best))
+}
+
+func TestExhaustiveCompressionPrecompressed(t *testing.T) {
+	doc := spliceTestDocument(50 << 10)
+
+	d1, err := PrecompressData(doc[:20<<10], ExhaustiveCompression)
+	require.NoError(t, err)
+	assert.Equal(t, BestCompression, d1.Level())
+
+	w := NewPrecompressedWriter(ExhaustiveCompression)
+	w.Write(doc[:10<<10])
+	f := w.Fork(true)
+	f.Write(doc[30<<10:])
+	d2, err := w.Data()
+	require.NoError(t, err)
+	d3, err := f.Data()
+	require.NoError(t, err)
+	assert.Equal(t, BestCompression, d3.Level())
+
+	var buf bytes.Buffer
+	sw := NewPrecompressedStreamWriter(&buf, ExhaustiveCompression)
+	sw.Write(doc[20<<10 : 30<<10])
+	_, err = sw.Len()
+	require.NoError(t, err)
+	d4, err := sw.Data(bytes.NewReader(buf.Bytes()), 0)
+	require.NoError(t, err)
+	assert.Equal(t, BestCompression, d4.Level())
+
+	b := NewBuilder(BestCompression)
+	b.AddPrecompressedData(d1)
+	b.AddPrecompressedData(d4)
+	b.AddPrecompressedData(d2)
+	b.AddPrecompressedData(d3)
+	assert.Equal(t, string(doc[:30<<10])+string(doc[:10<<10])+string(doc[30<<10:]),
+		decompressBytes(t, b.BytesOrPanic()))
+
+	b = NewBuilder(ExhaustiveCompression)
+	assert.Error(t, b.Err(), "Builder")
+
+	_, err = PrecompressData(nil, ExhaustiveCompression+1)
+	assert.Error(t, err)
+}
+
+func TestRLEHuffmanLengths(t *testing.T) {
+	freq := make([]int, maxLitCodes)
+	for i := range freq[:200] {
+		freq[i] = 100 + i%5
+	}
+	freq[256] = 1
+
+	lens := make([]uint8, len(freq))
+	rleHuffmanLengths(lens, freq)
+
+	var kraft float64
+	for sym, l := range lens {
+		if freq[sym] > 0 {
+			require.NotZero(t, l, "symbol %d", sym)
+		}
+		if l > 0 {
+			assert.True(t, l <= maxCodeBits, "symbol %d has length %d", sym, l)
+			kraft += 1 / float64(uint(1)<<l)
+		}
+	}
+	assert.Equal(t, 1.0, kraft, "code should be complete")
+
+	var plain [maxLitCodes]uint8
+	huffmanLengths(plain[:], freq, maxCodeBits)
+	assert.True(t, newDynamicHeader(lens, make([]uint8, 2)).bits <= newDynamicHeader(plain[:], make([]uint8, 2)).bits)
+}
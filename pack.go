@@ -0,0 +1,414 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A pack file holds many named PrecompressedData entries. It is laid out as:
+//
+//	magic [8]byte
+//	data  [...]byte // the compressed bytes of each entry
+//	index [...]byte // one record for each entry
+//	footer:
+//		index offset uint64
+//		index length uint64
+//		index CRC-32 uint32
+//		entry count  uint32
+//		magic        [8]byte
+//
+// Each index record is:
+//
+//	name length uvarint
+//	name        [name length]byte
+//	offset      uvarint
+//	length      uvarint
+//	CRC-32      uint32
+//	size        uvarint
+//	level       varint
+//
+// All fixed size integers are little endian.
+var packMagic = [8]byte{'G', 'Z', 'B', 'P', 'A', 'C', 'K', 1}
+
+const packFooterLen = 8 + 8 + 4 + 4 + len(packMagic)
+
+var (
+	errInvalidPack = errors.New("gzipbuilder: invalid pack file")
+	errPackClosed  = errors.New("gzipbuilder: pack writer is closed")
+)
+
+// A Pack is a read-only collection of named PrecompressedData entries. The
+// entries alias the underlying pack data and are not copied.
+type Pack struct {
+	entries map[string]*PrecompressedData
+	names   []string
+
+	close func() error
+}
+
+// OpenPack opens the named pack file. Where supported, the file is mapped
+// into memory rather than read.
+//
+// The PrecompressedData returned from Lookup must not be used after Close is
+// called. As with NewPack, the entries are trusted and not checked.
+func OpenPack(name string) (*Pack, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, unmap, err := mmapFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := NewPack(data)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+
+	p.close = unmap
+	return p, nil
+}
+
+// NewPack parses a pack file held in data. data must not be modified while
+// the Pack is in use.
+//
+// Only the index of the pack is checked. The compressed data of the entries is
+// trusted, as checking it would mean decompressing every entry, so corrupt
+// entries produce corrupt output when added to a Builder or Writer. Verify
+// should be called for packs that come from an untrusted source.
+func NewPack(data []byte) (*Pack, error) {
+	if len(data) < len(packMagic)+packFooterLen ||
+		!bytes.Equal(data[:len(packMagic)], packMagic[:]) ||
+		!bytes.Equal(data[len(data)-len(packMagic):], packMagic[:]) {
+		return nil, errInvalidPack
+	}
+
+	footer := data[len(data)-packFooterLen:]
+	indexOff := binary.LittleEndian.Uint64(footer[0:])
+	indexLen := binary.LittleEndian.Uint64(footer[8:])
+	indexCRC := binary.LittleEndian.Uint32(footer[16:])
+	count := binary.LittleEndian.Uint32(footer[20:])
+
+	dataEnd := uint64(len(data) - packFooterLen)
+	if indexOff < uint64(len(packMagic)) || indexOff > dataEnd || indexLen != dataEnd-indexOff {
+		return nil, errInvalidPack
+	}
+
+	index := data[indexOff:dataEnd]
+	if crc32.ChecksumIEEE(index) != indexCRC {
+		return nil, errors.New("gzipbuilder: pack file index checksum mismatch")
+	}
+
+	// Each record is at least eight bytes long, this guards against
+	// allocating a huge map for a corrupt count.
+	if uint64(count) > indexLen/8 {
+		return nil, errInvalidPack
+	}
+
+	p := &Pack{
+		entries: make(map[string]*PrecompressedData, count),
+		names:   make([]string, 0, count),
+	}
+
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(index)
+		if n <= 0 {
+			index = nil
+			return 0
+		}
+		index = index[n:]
+		return v
+	}
+
+	for i := uint32(0); i < count; i++ {
+		nameLen := uvarint()
+		if index == nil || nameLen > uint64(len(index)) {
+			return nil, errInvalidPack
+		}
+		name := string(index[:nameLen])
+		index = index[nameLen:]
+
+		off, length := uvarint(), uvarint()
+		if index == nil || len(index) < 4 ||
+			off < uint64(len(packMagic)) || off > indexOff || length > indexOff-off {
+			return nil, errInvalidPack
+		}
+
+		crc := binary.LittleEndian.Uint32(index)
+		index = index[4:]
+
+		size := uvarint()
+		level, n := binary.Varint(index)
+		if index == nil || n <= 0 {
+			return nil, errInvalidPack
+		}
+		index = index[n:]
+
+		if err := validCompressionLevel(int(level)); err != nil {
+			return nil, err
+		}
+
+		if _, dup := p.entries[name]; dup {
+			return nil, fmt.Errorf("gzipbuilder: duplicate pack file entry %q", name)
+		}
+
+		p.entries[name] = &PrecompressedData{
+			level: int(level),
+
+			bytes: data[off : off+length : off+length],
+			size:  size,
+			crc:   crc,
+		}
+		p.names = append(p.names, name)
+	}
+
+	if len(index) != 0 {
+		return nil, errInvalidPack
+	}
+
+	sort.Strings(p.names)
+	return p, nil
+}
+
+// Lookup returns the PrecompressedData with the given name or nil if the pack
+// does not contain it.
+func (p *Pack) Lookup(name string) *PrecompressedData {
+	return p.entries[name]
+}
+
+// Names returns the sorted names of the entries in the pack.
+func (p *Pack) Names() []string {
+	return append([]string(nil), p.names...)
+}
+
+// Verify checks that every entry in the pack holds a valid DEFLATE stream with
+// the recorded size and CRC-32, as NewPrecompressedData does. This requires
+// decompressing every entry.
+func (p *Pack) Verify() error {
+	for _, name := range p.names {
+		d := p.entries[name]
+		if _, err := NewPrecompressedData(d.bytes, d.crc, d.size, d.level); err != nil {
+			return fmt.Errorf("%v in pack file entry %q", err, name)
+		}
+	}
+
+	return nil
+}
+
+// Close releases the resources associated with the pack. The PrecompressedData
+// returned from Lookup must not be used after Close is called.
+func (p *Pack) Close() error {
+	if p.close == nil {
+		return nil
+	}
+
+	err := p.close()
+	p.close = nil
+	return err
+}
+
+type packEntry struct {
+	name   string
+	off    uint64
+	length uint64
+	size   uint64
+	crc    uint32
+	level  int
+}
+
+// A PackWriter writes a pack file that can be read with OpenPack or NewPack.
+type PackWriter struct {
+	level int
+
+	cw countWriter
+	pw *PrecompressedStreamWriter
+
+	entries []packEntry
+	names   map[string]struct{}
+
+	closed bool
+	err    error
+}
+
+// NewPackWriter creates a PackWriter that writes a pack file to w. Entries
+// added with Add and AddDir are compressed using the given compression level.
+func NewPackWriter(w io.Writer, level int) *PackWriter {
+	p := &PackWriter{
+		level: level,
+
+		cw: countWriter{w: w},
+
+		names: make(map[string]struct{}),
+
+		err: validCompressionLevel(level),
+	}
+	if p.err == nil {
+		_, p.err = p.cw.Write(packMagic[:])
+	}
+	return p
+}
+
+func (p *PackWriter) canAdd(name string) bool {
+	if p.err != nil {
+		return false
+	}
+
+	if _, dup := p.names[name]; dup {
+		p.err = fmt.Errorf("gzipbuilder: duplicate pack file entry %q", name)
+		return false
+	}
+
+	p.names[name] = struct{}{}
+	return true
+}
+
+// Add compresses the data read from r and adds it to the pack with the given
+// name. The data is compressed as it is read and is not held in memory.
+func (p *PackWriter) Add(name string, r io.Reader) error {
+	if !p.canAdd(name) {
+		return p.err
+	}
+
+	if p.pw == nil {
+		p.pw = NewPrecompressedStreamWriter(&p.cw, p.level)
+	} else {
+		p.pw.Reset(&p.cw)
+	}
+
+	off := uint64(p.cw.n)
+	if _, p.err = io.Copy(p.pw, r); p.err != nil {
+		return p.err
+	}
+
+	var n int64
+	if n, p.err = p.pw.Len(); p.err != nil {
+		return p.err
+	}
+
+	p.entries = append(p.entries, packEntry{
+		name:   name,
+		off:    off,
+		length: uint64(n),
+		size:   p.pw.size,
+		crc:    p.pw.crc,
+		level:  p.level,
+	})
+	return nil
+}
+
+// AddPrecompressedData adds data to the pack with the given name. The
+// PrecompressedData may use any compression level.
+func (p *PackWriter) AddPrecompressedData(name string, data *PrecompressedData) error {
+	if !p.canAdd(name) {
+		return p.err
+	}
+	if data.final {
+		p.err = errFinalData
+		return p.err
+	}
+	if data.prefix != nil {
+		p.err = errSuffixData
+		return p.err
+	}
+
+	off := uint64(p.cw.n)
+	if data.src != nil {
+		_, p.err = io.Copy(&p.cw, io.NewSectionReader(data.src, 0, data.src.Size()))
+	} else {
+		_, p.err = p.cw.Write(data.bytes)
+	}
+	if p.err != nil {
+		return p.err
+	}
+
+	p.entries = append(p.entries, packEntry{
+		name:   name,
+		off:    off,
+		length: uint64(p.cw.n) - off,
+		size:   data.size,
+		crc:    data.crc,
+		level:  data.level,
+	})
+	return nil
+}
+
+// AddDir adds every regular file in the directory tree rooted at dir to the
+// pack. Each entry is named by its slash-separated path relative to dir.
+func (p *PackWriter) AddDir(dir string) error {
+	if p.err != nil {
+		return p.err
+	}
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return p.Add(filepath.ToSlash(rel), f)
+	})
+}
+
+// Close writes the pack index and footer. It does not close the underlying
+// io.Writer. Calling Close again after it succeeds does nothing.
+func (p *PackWriter) Close() error {
+	if p.closed {
+		return nil
+	}
+	if p.err != nil {
+		return p.err
+	}
+
+	var index []byte
+	var scratch [binary.MaxVarintLen64]byte
+	for _, e := range p.entries {
+		index = append(index, scratch[:binary.PutUvarint(scratch[:], uint64(len(e.name)))]...)
+		index = append(index, e.name...)
+		index = append(index, scratch[:binary.PutUvarint(scratch[:], e.off)]...)
+		index = append(index, scratch[:binary.PutUvarint(scratch[:], e.length)]...)
+		binary.LittleEndian.PutUint32(scratch[:], e.crc)
+		index = append(index, scratch[:4]...)
+		index = append(index, scratch[:binary.PutUvarint(scratch[:], e.size)]...)
+		index = append(index, scratch[:binary.PutVarint(scratch[:], int64(e.level))]...)
+	}
+
+	var footer [packFooterLen]byte
+	binary.LittleEndian.PutUint64(footer[0:], uint64(p.cw.n))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(len(index)))
+	binary.LittleEndian.PutUint32(footer[16:], crc32.ChecksumIEEE(index))
+	binary.LittleEndian.PutUint32(footer[20:], uint32(len(p.entries)))
+	copy(footer[24:], packMagic[:])
+
+	if _, p.err = p.cw.Write(index); p.err != nil {
+		return p.err
+	}
+
+	if _, p.err = p.cw.Write(footer[:]); p.err != nil {
+		return p.err
+	}
+
+	// Further entries can not be added.
+	p.closed, p.err = true, errPackClosed
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package gzipbuilder
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the contents of f into memory. The returned function unmaps
+// the data.
+func mmapFile(f *os.File) ([]byte, func() error, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size := fi.Size()
+	if size <= 0 || int64(int(size)) != size {
+		return nil, nil, errInvalidPack
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, &os.PathError{Op: "mmap", Path: f.Name(), Err: err}
+	}
+
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
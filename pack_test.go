@@ -0,0 +1,127 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gzipbuilder")
+	require.NoError(t, err, "creating temporary directory")
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "src", "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "src", "a.html"), []byte("<p>a</p>"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "src", "sub", "b.html"), []byte("<p>b</p>"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "src", "empty"), nil, 0644))
+
+	d, err := PrecompressData([]byte("best"), BestCompression)
+	require.NoError(t, err, "failed to precompress data")
+
+	name := filepath.Join(dir, "assets.pack")
+	f, err := os.Create(name)
+	require.NoError(t, err, "creating pack file")
+
+	w := NewPackWriter(f, DefaultCompression)
+	require.NoError(t, w.AddDir(filepath.Join(dir, "src")), "AddDir failed")
+	require.NoError(t, w.Add("reader", strings.NewReader("hello world")), "Add failed")
+	require.NoError(t, w.AddPrecompressedData("best", d), "AddPrecompressedData failed")
+	require.NoError(t, w.Close(), "Close failed")
+	require.NoError(t, f.Close(), "closing pack file")
+
+	p, err := OpenPack(name)
+	require.NoError(t, err, "OpenPack failed")
+	defer p.Close()
+
+	assert.Equal(t, []string{"a.html", "best", "empty", "reader", "sub/b.html"}, p.Names())
+	assert.Nil(t, p.Lookup("missing"), "Lookup of missing entry")
+	assert.Equal(t, BestCompression, p.Lookup("best").level)
+
+	b := NewBuilder(DefaultCompression)
+	b.AddPrecompressedData(p.Lookup("a.html"))
+	b.AddPrecompressedData(p.Lookup("empty"))
+	b.AddPrecompressedData(p.Lookup("sub/b.html"))
+	b.AddPrecompressedData(p.Lookup("reader"))
+
+	bb, err := b.Bytes()
+	require.NoError(t, err, "Bytes returned error")
+
+	debugLogf(t, "%d:%x", len(bb), bb)
+
+	assert.Equal(t, "<p>a</p><p>b</p>hello world", decompressBytes(t, bb))
+	assert.NoError(t, p.Verify(), "Verify failed")
+
+	assert.NoError(t, p.Close(), "Close failed")
+	assert.NoError(t, p.Close(), "second Close failed")
+}
+
+func TestPackWriterClose(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPackWriter(&buf, DefaultCompression)
+	require.NoError(t, w.Add("a", strings.NewReader("a")), "Add failed")
+	require.NoError(t, w.Close(), "Close failed")
+	n := buf.Len()
+
+	assert.NoError(t, w.Close(), "second Close failed")
+	assert.Equal(t, n, buf.Len(), "second Close wrote to pack")
+	assert.Equal(t, errPackClosed, w.Add("b", strings.NewReader("b")))
+
+	_, err := NewPack(buf.Bytes())
+	assert.NoError(t, err, "NewPack failed")
+}
+
+func TestPackDuplicate(t *testing.T) {
+	w := NewPackWriter(ioutil.Discard, DefaultCompression)
+	require.NoError(t, w.Add("a", strings.NewReader("a")), "Add failed")
+
+	assert.EqualError(t, w.Add("a", strings.NewReader("a")), `gzipbuilder: duplicate pack file entry "a"`)
+	assert.EqualError(t, w.Close(), `gzipbuilder: duplicate pack file entry "a"`)
+}
+
+func TestPackWriterInvalidLevel(t *testing.T) {
+	w := NewPackWriter(ioutil.Discard, -100)
+
+	assert.EqualError(t, w.Add("a", strings.NewReader("a")),
+		"flate: invalid compression level -100: want value in range [-2, 9]")
+}
+
+func TestPackCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPackWriter(&buf, DefaultCompression)
+	require.NoError(t, w.Add("a", strings.NewReader("hello world")), "Add failed")
+	require.NoError(t, w.Close(), "Close failed")
+
+	_, err := NewPack(buf.Bytes())
+	require.NoError(t, err, "NewPack failed")
+
+	for i := range buf.Bytes() {
+		data := append([]byte(nil), buf.Bytes()...)
+		data[i] ^= 0x80
+
+		p, err := NewPack(data)
+		if err == nil {
+			// Corrupting the compressed data itself is only detected
+			// by Verify.
+			// Flipping an unused padding bit leaves the data
+			// intact, so it must then still decode.
+			assert.Len(t, p.Names(), 1, "corrupt byte %d", i)
+			if p.Verify() == nil {
+				b := NewBuilder(DefaultCompression)
+				b.AddPrecompressedData(p.Lookup("a"))
+				assert.Equal(t, "hello world", decompressBytes(t, b.BytesOrPanic()), "corrupt byte %d", i)
+			}
+		}
+	}
+
+	for i := 0; i < buf.Len(); i++ {
+		_, err := NewPack(buf.Bytes()[:i])
+		assert.Error(t, err, "truncated to %d bytes", i)
+	}
+}
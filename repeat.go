@@ -0,0 +1,250 @@
+package gzipbuilder
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+var errRepeatCount = errors.New("gzipbuilder: invalid repeat count")
+
+// AddRepeat adds n copies of the byte c to the builder.
+//
+// AddRepeat and AddCopy code runs directly as back-references without
+// compressing them, so even very long runs are added quickly and take about
+// one byte for each 1KiB of data. They are added like the blocks of
+// AddStoredBlock, and may refer back to the same data.
+func (b *builder) AddRepeat(c byte, n int) {
+	if !b.startBlock() {
+		return
+	}
+	if n < 0 {
+		b.err = errRepeatCount
+		return
+	}
+	if n == 0 {
+		return
+	}
+
+	var lits []byte
+	if len(b.window) == 0 || b.window[len(b.window)-1] != c {
+		lits, n = []byte{c}, n-1
+	}
+
+	b.addRun(lits, 1, n)
+}
+
+// AddCopy adds length bytes to the builder copied from distance bytes before
+// them, which may overlap the bytes being added. distance must be between 1
+// and 32768. See AddRepeat and AddStoredBlock for the data that may be copied.
+func (b *builder) AddCopy(distance, length int) {
+	if !b.startBlock() {
+		return
+	}
+
+	switch {
+	case length < 0 || distance < 1 || distance > windowSize:
+		b.err = errInvalidToken
+		return
+	case length == 0:
+		return
+	case distance > len(b.window):
+		b.err = errTokenDist
+		return
+	}
+
+	b.addRun(nil, distance, length)
+}
+
+// addRun adds the literals lits followed by length bytes copied from dist
+// bytes before them. The run is split into blocks where index points are due.
+func (b *builder) addRun(lits []byte, dist, length int) {
+	for b.err == nil {
+		n := b.indexRun(b.window, len(lits)+length) - len(lits)
+		b.writeRun(lits, dist, n)
+
+		if length -= n; length == 0 {
+			return
+		}
+		lits = nil
+	}
+}
+
+// A tokenRun is n repeats of a token.
+type tokenRun struct {
+	t token
+	n int
+}
+
+// writeRun writes the literals lits followed by length bytes copied from dist
+// bytes before them as a single block.
+func (b *builder) writeRun(lits []byte, dist, length int) {
+	b.window = append(b.window, lits...)
+	period := b.window[len(b.window)-dist:]
+	data := repeatBytes(period, length)
+
+	runs := make([]tokenRun, 0, len(lits)+3)
+	for _, c := range lits {
+		runs = append(runs, tokenRun{literal(c), 1})
+	}
+
+	switch full, rest := length/maxMatch, length%maxMatch; {
+	case length < minMatch:
+		for _, c := range data[:length] {
+			runs = append(runs, tokenRun{literal(c), 1})
+		}
+	case rest == 0:
+		runs = append(runs, tokenRun{match(maxMatch, dist), full})
+	case rest >= minMatch:
+		runs = append(runs, tokenRun{match(maxMatch, dist), full}, tokenRun{match(rest, dist), 1})
+	default:
+		// The rest is too short for a match of its own, so it is split
+		// with the last full match.
+		rest += maxMatch
+		runs = append(runs, tokenRun{match(maxMatch, dist), full - 1},
+			tokenRun{match(rest-minMatch, dist), 1}, tokenRun{match(minMatch, dist), 1})
+	}
+
+	if b.err = writeRunBlock(&bitWriter{w: b.w}, runs); b.err != nil {
+		return
+	}
+
+	if !b.rawDeflate {
+		b.size += uint64(len(lits) + length)
+		b.crc = crc32.Update(b.crc, crc32.IEEETable, lits)
+		b.crc = combineCRC32(crc32Mat, b.crc, repeatCRC(data, length), uint64(length))
+	}
+	if b.uncompressedDigest != nil {
+		b.uncompressedDigest.Write(lits)
+		for n := length; n > 0; {
+			p := data
+			if len(p) > n {
+				p = p[:n]
+			}
+			b.uncompressedDigest.Write(p)
+			n -= len(p)
+		}
+	}
+
+	// Only the last windowSize bytes of a long run are kept, which begin
+	// at the same position in the period as in data.
+	if length > windowSize {
+		start := (length - windowSize) % dist
+		b.window = append(b.window[:0], data[start:start+windowSize]...)
+	} else {
+		b.window = append(b.window, data[:length]...)
+	}
+	b.trimWindow()
+}
+
+// writeRunBlock writes runs as a block, with fixed or dynamic codes, whichever
+// is shorter. This leaves the stream byte aligned.
+func writeRunBlock(bw *bitWriter, runs []tokenRun) error {
+	var litFreq [maxLitCodes]int
+	var distFreq [maxDistCodes]int
+	extraBits := 0
+	for _, r := range runs {
+		if r.t&matchToken == 0 {
+			litFreq[r.t] += r.n
+			continue
+		}
+
+		lc, dc := lengthCode(r.t.length()), distCode(r.t.dist())
+		litFreq[257+lc] += r.n
+		distFreq[dc] += r.n
+		extraBits += r.n * (int(lengthExtra[lc]) + int(distExtra[dc]))
+	}
+	litFreq[endBlockSym]++
+
+	var litLens [maxLitCodes]uint8
+	var distLens [maxDistCodes]uint8
+	huffmanLengths(litLens[:], litFreq[:], maxCodeBits)
+	huffmanLengths(distLens[:], distFreq[:], maxCodeBits)
+	hdr := newDynamicHeader(litLens[:], distLens[:])
+
+	dynamicBits, fixedBits := hdr.bits, 0
+	for sym, f := range litFreq {
+		dynamicBits += f * int(litLens[sym])
+		fixedBits += f * int(fixedLitCode[sym].len)
+	}
+	for sym, f := range distFreq {
+		dynamicBits += f * int(distLens[sym])
+		fixedBits += f * int(fixedDistCode[sym].len)
+	}
+
+	lcodes, dcodes := fixedLitCode, fixedDistCode
+	if fixedBits <= dynamicBits {
+		bw.writeBits(1<<1, 3)
+	} else {
+		var lits [maxLitCodes]hcode
+		var dists [maxDistCodes]hcode
+		assignCodes(lits[:], litLens[:])
+		assignCodes(dists[:], distLens[:])
+		lcodes, dcodes = lits[:], dists[:]
+
+		bw.writeBits(2<<1, 3)
+		hdr.write(bw)
+	}
+
+	for _, r := range runs {
+		if r.t&matchToken == 0 {
+			lcodes[r.t].write(bw)
+			continue
+		}
+
+		v, n := matchBits(r.t, lcodes, dcodes)
+		for i := 0; i < r.n; i++ {
+			bw.writeBits(v, n)
+
+			// Long runs are written as they go, rather than
+			// buffering their whole block.
+			if len(bw.buf) >= 64<<10 {
+				if err := bw.flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	lcodes[endBlockSym].write(bw)
+	bw.alignShort()
+	return bw.flush()
+}
+
+// repeatBytes returns period repeated to n bytes. For a longer run, it returns
+// a whole number of periods, more than 2*windowSize bytes long, which are
+// repeated in turn to make up the run.
+func repeatBytes(period []byte, n int) []byte {
+	if max := len(period) * (2*windowSize/len(period) + 1); n > max {
+		n = max
+	}
+
+	p := make([]byte, n)
+	for i := copy(p, period); i < n; {
+		i += copy(p[i:], p[:i])
+	}
+
+	return p
+}
+
+// repeatCRC returns the CRC-32 of the first n bytes of data repeated, where
+// data is as returned by repeatBytes.
+func repeatCRC(data []byte, n int) uint32 {
+	if n == 0 {
+		return 0
+	}
+
+	// The CRC-32 of the whole copies of data is built up by doubling.
+	var crc uint32
+	unit, unitLen := crc32.ChecksumIEEE(data), uint64(len(data))
+	for count := n / len(data); count > 0; count >>= 1 {
+		if count&1 != 0 {
+			crc = combineCRC32(crc32Mat, crc, unit, unitLen)
+		}
+
+		unit = combineCRC32(crc32Mat, unit, unit, unitLen)
+		unitLen *= 2
+	}
+
+	rest := data[:n%len(data)]
+	return combineCRC32(crc32Mat, crc, crc32.ChecksumIEEE(rest), uint64(len(rest)))
+}
@@ -0,0 +1,179 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddRepeat(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 4, 258, 259, 260, 261, 516, 517, 518, 100 << 10} {
+		for _, prev := range []string{"", "a", "b"} {
+			h := sha256.New()
+
+			b := NewBuilder(DefaultCompression)
+			b.UncompressedDigest(h)
+			b.AddStoredBlock([]byte(prev))
+			b.AddRepeat('a', n)
+			b.AddRepeat('c', n)
+			out, err := b.Bytes()
+			require.NoError(t, err, "%d after %q", n, prev)
+
+			expect := prev + string(bytes.Repeat([]byte("a"), n)) + string(bytes.Repeat([]byte("c"), n))
+			assert.Equal(t, expect, decompressBytes(t, out), "%d after %q", n, prev)
+
+			sum := sha256.Sum256([]byte(expect))
+			assert.Equal(t, sum[:], h.Sum(nil), "%d after %q", n, prev)
+		}
+	}
+}
+
+func TestAddCopy(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+
+	for _, dist := range []int{1, 2, 3, 100, 257, 1000, 20000, 32 << 10} {
+		for _, length := range []int{1, 2, 3, 258, 259, 1000, 32 << 10, 200 << 10} {
+			h := sha256.New()
+
+			b := NewBuilder(DefaultCompression)
+			b.UncompressedDigest(h)
+			b.AddStoredBlock(doc[:10])
+			b.AddCompressedData(doc[10 : 40<<10])
+			b.AddCopy(dist, length)
+			b.AddCopy(dist, length)
+			b.AddStoredBlock([]byte("stored"))
+			b.AddCopy(dist, 10)
+			out, err := b.Bytes()
+			require.NoError(t, err, "distance %d, length %d", dist, length)
+
+			expect := append([]byte(nil), doc[:40<<10]...)
+			for _, n := range []int{length, length, -1, 10} {
+				if n < 0 {
+					expect = append(expect, "stored"...)
+					continue
+				}
+
+				for i := 0; i < n; i++ {
+					expect = append(expect, expect[len(expect)-dist])
+				}
+			}
+			assert.Equal(t, string(expect), decompressBytes(t, out), "distance %d, length %d", dist, length)
+
+			sum := sha256.Sum256(expect)
+			assert.Equal(t, sum[:], h.Sum(nil), "distance %d, length %d", dist, length)
+		}
+	}
+}
+
+func TestAddRepeatLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	const size = 1 << 30
+
+	start := time.Now()
+	b := NewBuilder(DefaultCompression)
+	b.AddRepeat(0, size)
+	out, err := b.Bytes()
+	require.NoError(t, err)
+	debugLogf(t, "%d bytes in %s", len(out), time.Since(start))
+
+	assert.True(t, len(out) < size>>10+1<<10, "%d bytes", len(out))
+
+	zr, err := gzip.NewReader(bytes.NewReader(out))
+	require.NoError(t, err)
+	n, err := io.Copy(ioutil.Discard, zr)
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), n)
+}
+
+func TestAddRepeatIndex(t *testing.T) {
+	doc := spliceTestDocument(20 << 10)
+
+	b := NewBuilder(DefaultCompression)
+	b.IndexEvery(8 << 10)
+	b.AddStoredBlock(doc)
+	b.AddRepeat(' ', 50<<10)
+	b.AddCopy(len(doc)-100, 100<<10)
+	b.AddRepeat('x', 20<<10)
+	out := b.BytesOrPanic()
+
+	expect := append([]byte(nil), doc...)
+	expect = append(expect, bytes.Repeat([]byte(" "), 50<<10)...)
+	for i := 0; i < 100<<10; i++ {
+		expect = append(expect, expect[len(expect)-(len(doc)-100)])
+	}
+	expect = append(expect, bytes.Repeat([]byte("x"), 20<<10)...)
+	require.Equal(t, string(expect), decompressBytes(t, out))
+	assert.True(t, len(b.Index().Points) >= len(expect)/(8<<10))
+
+	r := NewIndexedReader(bytes.NewReader(out), b.Index())
+	for off := int64(0); off+100 <= int64(len(expect)); off += 3 << 10 {
+		p := make([]byte, 100)
+		_, err := r.ReadAt(p, off)
+		require.NoError(t, err)
+		assert.Equal(t, expect[off:off+100], p, "at offset %d", off)
+	}
+}
+
+func TestAddRepeatErrors(t *testing.T) {
+	tests := map[string]struct {
+		add func(b *Builder)
+		err error
+	}{
+		"negative repeat": {
+			func(b *Builder) { b.AddRepeat('a', -1) },
+			errRepeatCount,
+		},
+		"negative length": {
+			func(b *Builder) {
+				b.AddStoredBlock([]byte("abc"))
+				b.AddCopy(1, -1)
+			},
+			errInvalidToken,
+		},
+		"zero distance": {
+			func(b *Builder) {
+				b.AddStoredBlock([]byte("abc"))
+				b.AddCopy(0, 10)
+			},
+			errInvalidToken,
+		},
+		"far distance": {
+			func(b *Builder) {
+				b.AddRepeat('a', 64<<10)
+				b.AddCopy(32<<10+1, 10)
+			},
+			errInvalidToken,
+		},
+		"before start": {
+			func(b *Builder) {
+				b.AddRepeat('a', 10)
+				b.AddCopy(11, 10)
+			},
+			errTokenDist,
+		},
+		"uncompressed": {
+			func(b *Builder) {
+				b.AddRepeat('a', 10)
+				b.AddUncompressedData([]byte("secret"))
+				b.AddCopy(3, 10)
+			},
+			errTokenDist,
+		},
+	}
+
+	for name, test := range tests {
+		b := NewBuilder(DefaultCompression)
+		test.add(b)
+		assert.Equal(t, test.err, b.Err(), name)
+	}
+}
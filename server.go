@@ -0,0 +1,399 @@
+//go:build go1.16
+// +build go1.16
+
+package gzipbuilder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An InjectFunc returns the data to insert at the injection point with the
+// given name for the request r. The data is added without compression, so it
+// may contain secrets such as CSRF tokens or CSP nonces.
+type InjectFunc func(r *http.Request, name string) ([]byte, error)
+
+// A FileServer is an http.Handler that serves the files in an fs.FS. Files are
+// precompressed once, either on their first request or by Preload, and are
+// served with GZIP content-encoding to clients that accept it. The file is
+// read only once, and its uncompressed contents are kept as well for clients
+// that do not accept GZIP, so both are always served from the same snapshot.
+//
+// Text files may declare injection points with a marker of the form
+// <!--#name-->, where name consists of letters, digits, '-' and '_'. If the
+// FileServer was created with an InjectFunc, each marker is replaced by the
+// data it returns on every request, without recompressing the rest of the
+// file.
+type FileServer struct {
+	fsys   fs.FS
+	level  int
+	inject InjectFunc
+
+	mu    sync.Mutex
+	files map[string]*serverFile
+}
+
+type serverFile struct {
+	modTime time.Time
+	ctype   string
+
+	// gzip holds the complete GZIP response, and data the uncompressed
+	// response, for files without injection points.
+	gzip []byte
+	data []byte
+	size uint64
+	crc  uint32
+
+	// segments and points hold the precompressed spans between injection
+	// points and the names of those points, and spans the uncompressed
+	// spans.
+	segments []*PrecompressedData
+	spans    [][]byte
+	points   []string
+}
+
+// NewFileServer returns a FileServer that serves the files in fsys compressed
+// at the given compression level. If inject is nil, injection point markers
+// are served as is.
+func NewFileServer(fsys fs.FS, level int, inject InjectFunc) *FileServer {
+	return &FileServer{
+		fsys:   fsys,
+		level:  level,
+		inject: inject,
+
+		files: make(map[string]*serverFile),
+	}
+}
+
+// Preload precompresses every file in the file system so that no compression
+// occurs while serving requests.
+func (s *FileServer) Preload() error {
+	return fs.WalkDir(s.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case d.IsDir():
+			// Directories are served by their index.html, if any.
+			if _, err := s.file(name); err != nil && !isNotExist(err) {
+				return err
+			}
+			return nil
+		case !d.Type().IsRegular():
+			return nil
+		}
+
+		_, err = s.file(name)
+		return err
+	})
+}
+
+func (s *FileServer) file(name string) (*serverFile, error) {
+	s.mu.Lock()
+	f, ok := s.files[name]
+	s.mu.Unlock()
+	if ok {
+		return f, nil
+	}
+
+	f, err := s.load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if cached, ok := s.files[name]; ok {
+		f = cached
+	} else {
+		s.files[name] = f
+	}
+	s.mu.Unlock()
+	return f, nil
+}
+
+// load reads and precompresses the file name. If name is a directory, its
+// index.html is loaded instead.
+func (s *FileServer) load(name string) (*serverFile, error) {
+	data, fi, err := s.read(name, true)
+	if err == errDirectory {
+		name = path.Join(name, "index.html")
+		data, fi, err = s.read(name, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f := &serverFile{
+		modTime: fi.ModTime(),
+		ctype:   mime.TypeByExtension(path.Ext(name)),
+	}
+	if f.ctype == "" {
+		f.ctype = http.DetectContentType(data)
+	}
+
+	if s.inject != nil && strings.HasPrefix(f.ctype, "text/") {
+		f.spans, f.points = splitInjectionPoints(data)
+	}
+
+	if len(f.points) == 0 {
+		b := NewBuilder(s.level)
+		b.AddCompressedData(data)
+		if f.gzip, err = b.Bytes(); err != nil {
+			return nil, err
+		}
+
+		f.data, f.spans = data, nil
+		f.size, f.crc = b.size, b.crc
+		return f, nil
+	}
+
+	for _, span := range f.spans {
+		d, err := PrecompressData(span, s.level)
+		if err != nil {
+			return nil, err
+		}
+
+		f.segments = append(f.segments, d)
+	}
+
+	return f, nil
+}
+
+// errDirectory is returned by read for a directory, if dir is true.
+var errDirectory = errors.New("gzipbuilder: file is a directory")
+
+func (s *FileServer) read(name string, dir bool) ([]byte, fs.FileInfo, error) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	switch {
+	case err != nil:
+		return nil, nil, err
+	case dir && fi.IsDir():
+		return nil, nil, errDirectory
+	case !fi.Mode().IsRegular():
+		return nil, nil, fs.ErrNotExist
+	}
+
+	data, err := io.ReadAll(f)
+	return data, fi, err
+}
+
+// splitInjectionPoints splits data at each <!--#name--> marker. It returns
+// the spans between the markers and the names of the markers.
+func splitInjectionPoints(data []byte) (spans [][]byte, points []string) {
+	const prefix, suffix = "<!--#", "-->"
+
+	for {
+		i := bytes.Index(data, []byte(prefix))
+		if i < 0 {
+			break
+		}
+
+		name := data[i+len(prefix):]
+		n := bytes.Index(name, []byte(suffix))
+		if n <= 0 || !isInjectionName(name[:n]) {
+			// Not a marker, keep searching after the prefix.
+			spans = appendSpan(spans, points, data[:i+len(prefix)])
+			data = data[i+len(prefix):]
+			continue
+		}
+
+		spans = appendSpan(spans, points, data[:i])
+		points = append(points, string(name[:n]))
+		data = name[n+len(suffix):]
+	}
+
+	spans = appendSpan(spans, points, data)
+	return spans, points
+}
+
+// appendSpan appends span to spans, joining it to the last span if no
+// injection point separates them.
+func appendSpan(spans [][]byte, points []string, span []byte) [][]byte {
+	if len(spans) > len(points) {
+		last := spans[len(spans)-1]
+		spans[len(spans)-1] = append(last[:len(last):len(last)], span...)
+		return spans
+	}
+
+	return append(spans, span)
+}
+
+func isInjectionName(name []byte) bool {
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// acceptsGzip reports whether the request accepts the gzip content-coding.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			var params string
+			if i := strings.IndexByte(coding, ';'); i >= 0 {
+				coding, params = coding[:i], coding[i+1:]
+			}
+
+			coding = strings.TrimSpace(coding)
+			if !strings.EqualFold(coding, "gzip") && !strings.EqualFold(coding, "x-gzip") && coding != "*" {
+				continue
+			}
+
+			params = strings.TrimSpace(params)
+			if strings.HasPrefix(params, "q=") {
+				q, err := strconv.ParseFloat(params[len("q="):], 64)
+				if err == nil && q == 0 {
+					continue
+				}
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// ServeHTTP implements http.Handler.
+func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+
+	f, err := s.file(name)
+	switch {
+	case err == nil:
+	case isNotExist(err):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	h.Set("Content-Type", f.ctype)
+
+	if !acceptsGzip(r) {
+		s.serveIdentity(w, r, f)
+		return
+	}
+
+	if f.gzip != nil {
+		h.Set("Content-Encoding", "gzip")
+		h.Set("ETag", fmt.Sprintf(`"gz-%08x-%x"`, f.crc, f.size))
+		http.ServeContent(w, r, name, f.modTime, bytes.NewReader(f.gzip))
+		return
+	}
+
+	inject, err := s.injections(r, f)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	h.Set("Content-Encoding", "gzip")
+	h.Set("Cache-Control", "no-cache")
+	setLastModified(h, f.modTime)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	gw := NewWriter(w, s.level)
+	for i, d := range f.segments {
+		gw.AddPrecompressedData(d)
+		if i < len(inject) {
+			gw.AddUncompressedData(inject[i])
+		}
+	}
+	if err := gw.Close(); err != nil {
+		// The response can't be completed, so abort it rather than
+		// leaving the client with a silently truncated stream.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *FileServer) injections(r *http.Request, f *serverFile) ([][]byte, error) {
+	inject := make([][]byte, len(f.points))
+	for i, name := range f.points {
+		data, err := s.inject(r, name)
+		if err != nil {
+			return nil, err
+		}
+
+		inject[i] = data
+	}
+
+	return inject, nil
+}
+
+func (s *FileServer) serveIdentity(w http.ResponseWriter, r *http.Request, f *serverFile) {
+	if f.gzip != nil {
+		w.Header().Set("ETag", fmt.Sprintf(`"%08x-%x"`, f.crc, f.size))
+		http.ServeContent(w, r, "", f.modTime, bytes.NewReader(f.data))
+		return
+	}
+
+	inject, err := s.injections(r, f)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	for i, span := range f.spans {
+		buf.Write(span)
+		if i < len(inject) {
+			buf.Write(inject[i])
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	setLastModified(w.Header(), f.modTime)
+	if r.Method != http.MethodHead {
+		w.Write(buf.Bytes())
+	}
+}
+
+// setLastModified sets the Last-Modified header of a response that is not
+// served by http.ServeContent, which would otherwise set it. Like
+// http.ServeContent, it ignores a zero or Unix epoch time.
+func setLastModified(h http.Header, modTime time.Time) {
+	if modTime.IsZero() || modTime.Equal(time.Unix(0, 0)) {
+		return
+	}
+
+	h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+}
+
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid)
+}
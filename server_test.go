@@ -0,0 +1,243 @@
+//go:build go1.16
+// +build go1.16
+
+package gzipbuilder
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testFS = fstest.MapFS{
+	"index.html": {
+		Data:    []byte(`<html><script nonce="<!--#nonce-->"></script><!--#user--> <!--# --></html>`),
+		ModTime: time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC),
+	},
+	"style.css": {
+		Data: []byte("body { color: red; } /* <!--#nonce--> */"),
+	},
+	"data.json": {
+		Data:    []byte(`{"a": "<!--#nonce-->"}`),
+		ModTime: time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC),
+	},
+	"dir/index.html": {
+		Data: []byte("<p>dir</p>"),
+	},
+	"image.png": {
+		Data: []byte("\x89PNG\r\n\x1a\n<!--#nonce-->"),
+	},
+}
+
+func testInject(r *http.Request, name string) ([]byte, error) {
+	switch name {
+	case "nonce":
+		return []byte("abc123"), nil
+	case "user":
+		return []byte(r.URL.Query().Get("user")), nil
+	default:
+		return nil, errors.New("unknown injection point")
+	}
+}
+
+func serve(s http.Handler, method, target string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestFileServerStatic(t *testing.T) {
+	s := NewFileServer(testFS, DefaultCompression, testInject)
+	require.NoError(t, s.Preload(), "Preload failed")
+
+	gzip := map[string]string{"Accept-Encoding": "gzip, deflate"}
+
+	w := serve(s, http.MethodGet, "/data.json", gzip)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, "Tue, 01 Oct 2019 00:00:00 GMT", w.Header().Get("Last-Modified"))
+	assert.Equal(t, string(testFS["data.json"].Data), decompressBytes(t, w.Body.Bytes()),
+		"non-text files should not have injection points")
+
+	etag := w.Header().Get("ETag")
+	assert.Regexp(t, `^"gz-[0-9a-f]{8}-[0-9a-f]+"$`, etag)
+
+	w = serve(s, http.MethodGet, "/data.json", map[string]string{
+		"Accept-Encoding": "gzip",
+		"If-None-Match":   etag,
+	})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = serve(s, http.MethodGet, "/data.json", map[string]string{"Accept-Encoding": "gzip;q=0"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	assert.Equal(t, string(testFS["data.json"].Data), w.Body.String())
+
+	w = serve(s, http.MethodGet, "/dir/", gzip)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "<p>dir</p>", decompressBytes(t, w.Body.Bytes()))
+
+	w = serve(s, http.MethodGet, "/image.png", gzip)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, string(testFS["image.png"].Data), decompressBytes(t, w.Body.Bytes()))
+
+	w = serve(s, http.MethodGet, "/missing", gzip)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = serve(s, http.MethodPost, "/style.css", gzip)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestFileServerInject(t *testing.T) {
+	s := NewFileServer(testFS, DefaultCompression, testInject)
+
+	const expect = `<html><script nonce="abc123"></script>alice <!--# --></html>`
+
+	w := serve(s, http.MethodGet, "/?user=alice", map[string]string{"Accept-Encoding": "gzip"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Header().Get("ETag"))
+	assert.Equal(t, "Tue, 01 Oct 2019 00:00:00 GMT", w.Header().Get("Last-Modified"))
+	assert.Equal(t, expect, decompressBytes(t, w.Body.Bytes()))
+
+	w = serve(s, http.MethodGet, "/index.html?user=alice", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Tue, 01 Oct 2019 00:00:00 GMT", w.Header().Get("Last-Modified"))
+	assert.Equal(t, expect, w.Body.String())
+
+	w = serve(s, http.MethodGet, "/style.css", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Last-Modified"), "zero modification time")
+
+	w = serve(s, http.MethodGet, "/style.css", map[string]string{"Accept-Encoding": "gzip"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "body { color: red; } /* abc123 */", decompressBytes(t, w.Body.Bytes()))
+
+	w = serve(s, http.MethodHead, "/index.html", map[string]string{"Accept-Encoding": "gzip"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Zero(t, w.Body.Len())
+
+	s = NewFileServer(testFS, DefaultCompression, nil)
+
+	w = serve(s, http.MethodGet, "/", map[string]string{"Accept-Encoding": "gzip"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(testFS["index.html"].Data), decompressBytes(t, w.Body.Bytes()))
+}
+
+func TestFileServerInjectError(t *testing.T) {
+	s := NewFileServer(fstest.MapFS{
+		"index.html": {Data: []byte("<!--#unknown-->")},
+	}, DefaultCompression, testInject)
+
+	w := serve(s, http.MethodGet, "/", map[string]string{"Accept-Encoding": "gzip"})
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+}
+
+func TestFileServerSnapshot(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.txt":      {Data: []byte("version 1")},
+		"index.html": {Data: []byte("<p>version 1 <!--#nonce--></p>")},
+	}
+	s := NewFileServer(fsys, DefaultCompression, testInject)
+	require.NoError(t, s.Preload(), "Preload failed")
+
+	fsys["a.txt"].Data = []byte("version 2")
+	fsys["index.html"].Data = []byte("<p>version 2 <!--#nonce--></p>")
+
+	w := serve(s, http.MethodGet, "/a.txt", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "version 1", w.Body.String())
+
+	w = serve(s, http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "<p>version 1 abc123</p>", w.Body.String())
+}
+
+type failingResponseWriter struct{ *httptest.ResponseRecorder }
+
+func (failingResponseWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestFileServerDirectoryIndex(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html":     {Data: []byte("root")},
+		"dir/index.html": {Data: []byte("dir")},
+		"empty/file.txt": {Data: []byte("file")},
+	}
+
+	s := NewFileServer(fsys, DefaultCompression, nil)
+	require.NoError(t, s.Preload(), "Preload failed")
+
+	// Directories are resolved to their index.html by Preload and are not
+	// looked up in the file system again.
+	delete(fsys, "index.html")
+	delete(fsys, "dir/index.html")
+
+	for target, expect := range map[string]string{
+		"/":           "root",
+		"/dir":        "dir",
+		"/dir/":       "dir",
+		"/dir/../.":   "root",
+		"/index.html": "root",
+	} {
+		w := serve(s, http.MethodGet, target, nil)
+		require.Equal(t, http.StatusOK, w.Code, target)
+		assert.Equal(t, expect, w.Body.String(), target)
+	}
+
+	w := serve(s, http.MethodGet, "/empty/", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestFileServerInjectAbort(t *testing.T) {
+	s := NewFileServer(testFS, DefaultCompression, testInject)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := failingResponseWriter{httptest.NewRecorder()}
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() { s.ServeHTTP(w, r) })
+}
+
+func TestSplitInjectionPoints(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		spans  []string
+		points []string
+	}{
+		{"", []string{""}, nil},
+		{"abc", []string{"abc"}, nil},
+		{"<!--#a-->", []string{"", ""}, []string{"a"}},
+		{"x<!--#a--><!--#b-->y", []string{"x", "", "y"}, []string{"a", "b"}},
+		{"<!--#-->x<!--#a b-->y<!--#c-->", []string{"<!--#-->x<!--#a b-->y", ""}, []string{"c"}},
+	} {
+		spans, points := splitInjectionPoints([]byte(tc.in))
+
+		var got []string
+		for _, span := range spans {
+			got = append(got, string(span))
+		}
+
+		assert.Equal(t, tc.spans, got, "spans for %q", tc.in)
+		assert.Equal(t, tc.points, points, "points for %q", tc.in)
+	}
+}
@@ -0,0 +1,351 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// Splice copies the GZIP stream gz to dst, inserting snippet immediately
+// before the first occurrence of marker in the decompressed stream. It reports
+// whether marker was found. If it was not, gz is copied to dst unchanged.
+//
+// This is intended for proxies that insert a banner or analytics snippet into
+// compressed upstream responses. Rather than decompressing and recompressing
+// the whole response, gz is only decoded up to and a little beyond the
+// insertion point:
+//
+//   - the blocks before the insertion point are copied as is,
+//   - only the block containing the insertion point is recompressed at the
+//     given compression level,
+//   - the blocks after it are copied at the bit level, unless they refer back
+//     past the insertion point in which case they are also recompressed, and
+//   - once the stream is 32KiB past the insertion point, nothing can refer
+//     back past it, so the remainder is copied byte for byte without being
+//     decoded. The checksum of the remainder is derived from the GZIP trailer.
+//
+// The snippet is added without compression, so it may contain secret data.
+//
+// gz must be a single GZIP member, which is what upstreams almost always send.
+// As gz is only partly decoded, it is not fully validated.
+//
+// The spliced stream is built in memory and only written to dst once it is
+// complete, so nothing is written to dst if an error occurs while splicing.
+func Splice(dst io.Writer, gz, marker, snippet []byte, level int) (bool, error) {
+	if len(marker) == 0 {
+		return false, errors.New("gzipbuilder: empty splice marker")
+	}
+	if err := validCompressionLevel(level); err != nil {
+		return false, err
+	}
+
+	n, err := gzipHeaderSize(gz)
+	if err != nil {
+		return false, err
+	}
+	if len(gz)-n < 8 {
+		return false, io.ErrUnexpectedEOF
+	}
+
+	s := &splicer{
+		in:   gz[n : len(gz)-8],
+		crc:  binary.LittleEndian.Uint32(gz[len(gz)-8:]),
+		size: binary.LittleEndian.Uint32(gz[len(gz)-4:]),
+	}
+	s.f = newInflater(s.in)
+
+	blocks, err := s.find(marker)
+	switch {
+	case err == io.EOF:
+		_, err = dst.Write(gz)
+		return false, err
+	case err != nil:
+		return false, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(gz) + len(snippet) + 64)
+
+	s.b = newBuilder(&buf, level)
+	s.bw = &bitWriter{w: &buf}
+	s.splice(blocks, snippet)
+	if s.b.finish(); s.b.err != nil {
+		return false, s.b.err
+	}
+
+	_, err = dst.Write(buf.Bytes())
+	return true, err
+}
+
+type splicer struct {
+	in []byte
+
+	crc  uint32
+	size uint32
+
+	f  *inflater
+	b  builder
+	bw *bitWriter
+
+	// insert is the offset in the decoded stream of the insertion point.
+	insert int64
+
+	// bits is true if bw holds blocks that have not been terminated.
+	bits bool
+}
+
+// find decodes blocks until marker is found. It returns the blocks that may
+// contain the insertion point and those after it, or io.EOF if marker does
+// not occur.
+func (s *splicer) find(marker []byte) ([]inflateBlock, error) {
+	var blocks []inflateBlock
+	for {
+		blk, err := s.f.next()
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, blk)
+
+		// Search from the first offset not already searched at which
+		// the marker may begin.
+		from := blk.start - int64(len(marker)) + 1
+		if from < blocks[0].start {
+			from = blocks[0].start
+		}
+		if i := bytes.Index(s.f.bytes(from, blk.end), marker); i >= 0 {
+			s.insert = from + int64(i)
+			return blocks, nil
+		}
+
+		// Forget the blocks that end before the next search begins, but
+		// keep the history the remaining blocks may need.
+		next := blk.end - int64(len(marker)) + 1
+		for len(blocks) > 1 && blocks[0].end <= next {
+			blocks = blocks[1:]
+		}
+		s.f.trim(blocks[0].start - windowSize)
+	}
+}
+
+func (s *splicer) splice(blocks []inflateBlock, snippet []byte) {
+	b := &s.b
+
+	// Find the block containing the insertion point.
+	for blocks[0].end <= s.insert {
+		blocks = blocks[1:]
+	}
+	blk := blocks[0]
+
+	b.writeHeader()
+	if b.err != nil {
+		return
+	}
+
+	// The blocks before the insertion point are unchanged, so the prefix of
+	// the stream can be copied without shifting. None of them are final.
+	if blk.startBit > 0 {
+		s.bw.copyBits(s.in, 0, blk.startBit)
+		s.bits = true
+		s.endBits()
+
+		b.size = uint64(blk.start)
+		b.crc = blk.crc
+	}
+
+	// The part of the block before the insertion point is recompressed
+	// with the preceding history as a dictionary, as it may refer to it.
+	if s.insert > blk.start && b.err == nil {
+		dictStart := blk.start - windowSize
+		if dictStart < s.f.base {
+			dictStart = s.f.base
+		}
+
+		s.addCompressedDict(s.f.bytes(blk.start, s.insert), s.f.bytes(dictStart, blk.start))
+	}
+
+	b.AddUncompressedData(snippet)
+
+	// The rest of the block may not refer to anything before the
+	// insertion point, so that the snippet never enters the compression
+	// context. AddCompressedData starts without history.
+	b.AddCompressedData(s.f.bytes(s.insert, blk.end))
+
+	for blocks = blocks[1:]; !blk.final && b.err == nil; {
+		if len(blocks) > 0 {
+			blk, blocks = blocks[0], blocks[1:]
+		} else if blk.end-s.insert >= windowSize {
+			break
+		} else {
+			s.f.trim(s.f.pos())
+
+			var err error
+			if blk, err = s.f.next(); err != nil {
+				b.err = err
+				return
+			}
+		}
+
+		if blk.minRef < s.insert {
+			// Recompress any block that refers back past the
+			// insertion point, as the snippet has changed the
+			// distance of those references.
+			s.endBits()
+			b.AddCompressedData(s.f.bytes(blk.start, blk.end))
+		} else {
+			s.copyBlock(blk)
+		}
+	}
+	if b.err != nil {
+		return
+	}
+
+	if blk.final {
+		s.endBits()
+
+		if s.f.crc != s.crc || uint32(s.f.pos()) != s.size {
+			b.err = errors.New("gzipbuilder: checksum or size mismatch")
+		}
+		return
+	}
+
+	s.copyRemainder(blk)
+}
+
+// addCompressedDict compresses data with dict as the preceding history and
+// adds it to the builder.
+func (s *splicer) addCompressedDict(data, dict []byte) {
+	b := &s.b
+
+	fw := encoderGet(b.w, b.level)
+	defer encoderPut(fw, b.level)
+
+	fw.SetWindow(dict)
+	if _, b.err = fw.Write(data); b.err != nil {
+		return
+	}
+	if b.err = fw.Flush(); b.err != nil {
+		return
+	}
+	b.last = flushed
+
+	b.size += uint64(len(data))
+	b.crc = crc32.Update(b.crc, crc32.IEEETable, data)
+}
+
+// copyBlock copies blk at the bit level, shifting it as needed and clearing
+// the final block flag.
+func (s *splicer) copyBlock(blk inflateBlock) {
+	b := &s.b
+	if !b.flushCompressed() {
+		return
+	}
+	b.last = flushed
+
+	data := s.f.bytes(blk.start, blk.end)
+	if readBits(s.in, blk.startBit+1, 2) == 0 {
+		// The padding of a stored block depends on its alignment, so
+		// it must be rewritten rather than shifted.
+		s.bw.storedBlock(data)
+	} else {
+		s.bw.writeBits(0, 1)
+		s.bw.copyBits(s.in, blk.startBit+1, blk.endBit)
+	}
+	s.bits = true
+
+	b.size += uint64(len(data))
+	b.crc = crc32.Update(b.crc, crc32.IEEETable, data)
+}
+
+// endBits terminates the blocks copied at the bit level with an empty stored
+// block, so that the builder can continue on a byte boundary.
+func (s *splicer) endBits() {
+	if !s.bits || s.b.err != nil {
+		return
+	}
+	s.bits = false
+
+	if s.bw.nbits > 0 {
+		s.bw.alignStored()
+	}
+	s.b.err = s.bw.flush()
+	s.b.last = flushed
+}
+
+// copyRemainder copies the stream after blk byte for byte. Blocks are added
+// first so that the output is at the same bit alignment as the input.
+func (s *splicer) copyRemainder(blk inflateBlock) {
+	b := &s.b
+	if !b.flushCompressed() {
+		return
+	}
+
+	s.bw.alignTo(uint(blk.endBit % 8))
+	if blk.endBit%8 != 0 {
+		// Complete the partial byte with the remaining bits of the
+		// input byte.
+		s.bw.copyBits(s.in, blk.endBit, (blk.endBit+7)&^7)
+	}
+	if b.err = s.bw.flush(); b.err != nil {
+		return
+	}
+	if _, b.err = b.w.Write(s.in[(blk.endBit+7)/8:]); b.err != nil {
+		return
+	}
+	b.last = final
+
+	// The checksum of the remainder is found by removing the checksum of
+	// what was decoded from the checksum in the trailer.
+	n := uint64(s.size - uint32(blk.end))
+	crc := s.crc ^ combineCRC32(crc32Mat, s.f.crc, 0, n)
+
+	b.size += n
+	b.crc = combineCRC32(crc32Mat, b.crc, crc, n)
+}
+
+// The flags of a GZIP header.
+const (
+	flagHdrCrc  = 1 << 1
+	flagExtra   = 1 << 2
+	flagName    = 1 << 3
+	flagComment = 1 << 4
+)
+
+// gzipHeaderSize returns the length of the GZIP header at the start of p.
+func gzipHeaderSize(p []byte) (int, error) {
+	if len(p) < gzipHeaderLen {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if p[0] != 0x1f || p[1] != 0x8b || p[2] != 8 {
+		return 0, errors.New("gzipbuilder: invalid GZIP header")
+	}
+
+	flags, n := p[3], gzipHeaderLen
+	if flags&flagExtra != 0 {
+		if len(p) < n+2 {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		n += 2 + int(binary.LittleEndian.Uint16(p[n:]))
+	}
+	for _, flag := range []byte{flagName, flagComment} {
+		if flags&flag == 0 || n > len(p) {
+			continue
+		}
+
+		i := bytes.IndexByte(p[n:], 0)
+		if i < 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n += i + 1
+	}
+	if flags&flagHdrCrc != 0 {
+		n += 2
+	}
+
+	if n > len(p) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
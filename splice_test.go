@@ -0,0 +1,222 @@
+package gzipbuilder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func spliceTestDocument(size int) []byte {
+	r := rand.New(rand.NewSource(1))
+	words := []string{"lorem ", "ipsum ", "dolor ", "<p>", "</p>\n", "<a href=\"/\">", "</a>"}
+
+	doc := []byte("<html><head><title>test</title></head><body>\n")
+	for len(doc) < size {
+		if r.Intn(8) == 0 {
+			doc = append(doc, fmt.Sprintf("%x ", r.Int63())...)
+		} else {
+			doc = append(doc, words[r.Intn(len(words))]...)
+		}
+	}
+
+	return append(doc, "</body></html>\n"...)
+}
+
+func spliceTestGzip(t *testing.T, doc []byte, level int, flushAt ...int) []byte {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	require.NoError(t, err)
+	zw.Name = "index.html"
+
+	last := 0
+	for _, at := range flushAt {
+		if at <= last || at >= len(doc) {
+			continue
+		}
+
+		zw.Write(doc[last:at])
+		require.NoError(t, zw.Flush())
+		last = at
+	}
+	zw.Write(doc[last:])
+	require.NoError(t, zw.Close())
+
+	return buf.Bytes()
+}
+
+func TestSplice(t *testing.T) {
+	doc := spliceTestDocument(256 << 10)
+	snippet := []byte(`<script nonce="abc123">track()</script>`)
+
+	for _, marker := range []string{"<head>", "<html>", "</body>", "5b2", "lorem ipsum dolor lorem"} {
+		i := bytes.Index(doc, []byte(marker))
+		require.True(t, i >= 0, "marker %q", marker)
+
+		expect := string(doc[:i]) + string(snippet) + string(doc[i:])
+
+		for _, level := range []int{HuffmanOnly, NoCompression, BestSpeed, DefaultCompression, BestCompression} {
+			gz := spliceTestGzip(t, doc, level, i-1, i+2, i+5000)
+
+			var buf bytes.Buffer
+			ok, err := Splice(&buf, gz, []byte(marker), snippet, DefaultCompression)
+			require.NoError(t, err, "Splice failed for %q at level %d", marker, level)
+			assert.True(t, ok, "marker %q not found", marker)
+
+			debugLogf(t, "%q level %d: %d -> %d", marker, level, len(gz), buf.Len())
+
+			if !assert.Equal(t, expect, decompressBytes(t, buf.Bytes()),
+				"for %q at level %d", marker, level) {
+				return
+			}
+
+			// Only the block containing the insertion point, and
+			// those that refer back past it, are recompressed.
+			if level != NoCompression {
+				assert.True(t, buf.Len() < len(gz)+len(snippet)+8<<10,
+					"for %q at level %d: %d >= %d", marker, level, buf.Len(), len(gz)+len(snippet)+8<<10)
+			}
+		}
+	}
+}
+
+func TestSpliceNotFound(t *testing.T) {
+	doc := spliceTestDocument(64 << 10)
+	gz := spliceTestGzip(t, doc, DefaultCompression)
+
+	var buf bytes.Buffer
+	ok, err := Splice(&buf, gz, []byte("<footer>"), []byte("x"), DefaultCompression)
+	require.NoError(t, err, "Splice failed")
+	assert.False(t, ok, "marker should not have been found")
+	assert.Equal(t, gz, buf.Bytes(), "stream should be copied unchanged")
+}
+
+func TestSpliceSmall(t *testing.T) {
+	for _, doc := range []string{"<body>", "a<body>", "<body>b", "ab<body>cd"} {
+		gz := spliceTestGzip(t, []byte(doc), DefaultCompression)
+
+		var buf bytes.Buffer
+		ok, err := Splice(&buf, gz, []byte("<body>"), []byte("!"), BestSpeed)
+		require.NoError(t, err, "Splice failed for %q", doc)
+		assert.True(t, ok, "marker not found in %q", doc)
+
+		i := bytes.Index([]byte(doc), []byte("<body>"))
+		assert.Equal(t, doc[:i]+"!"+doc[i:], decompressBytes(t, buf.Bytes()))
+	}
+}
+
+func TestSpliceErrors(t *testing.T) {
+	gz := spliceTestGzip(t, spliceTestDocument(1<<10), DefaultCompression)
+
+	var buf bytes.Buffer
+	_, err := Splice(&buf, gz, nil, nil, DefaultCompression)
+	assert.EqualError(t, err, "gzipbuilder: empty splice marker")
+
+	_, err = Splice(&buf, gz, []byte("<body>"), nil, 42)
+	assert.Error(t, err, "invalid compression level")
+
+	_, err = Splice(&buf, gz[:5], []byte("<body>"), nil, DefaultCompression)
+	assert.Error(t, err, "truncated header")
+
+	_, err = Splice(&buf, append([]byte{0x1f, 0x8c}, gz[2:]...), []byte("<body>"), nil, DefaultCompression)
+	assert.EqualError(t, err, "gzipbuilder: invalid GZIP header")
+
+	buf.Reset()
+	bad := append([]byte(nil), gz...)
+	bad[len(bad)-1] ^= 0xff
+	_, err = Splice(&buf, bad, []byte("</html>"), nil, DefaultCompression)
+	assert.EqualError(t, err, "gzipbuilder: checksum or size mismatch")
+	assert.Zero(t, buf.Len(), "nothing should be written on error")
+
+	buf.Reset()
+	_, err = Splice(&buf, gz[:len(gz)/2], []byte("</html>"), nil, DefaultCompression)
+	assert.Error(t, err, "truncated stream")
+	assert.Zero(t, buf.Len(), "nothing should be written before the marker is found")
+}
+
+// malformedDeflateStreams returns DEFLATE streams, holding stored, fixed and
+// dynamic blocks, to be truncated and corrupted.
+func malformedDeflateStreams(t *testing.T) [][]byte {
+	doc := spliceTestDocument(1 << 10)
+	return [][]byte{
+		deflateBytes(t, doc, NoCompression),
+		deflateBytes(t, []byte("hello, hello, world"), BestSpeed),
+		deflateBytes(t, doc, DefaultCompression),
+		deflateBytes(t, doc, HuffmanOnly),
+	}
+}
+
+type discardFile struct{ *bytes.Reader }
+
+func (discardFile) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestMalformedInput(t *testing.T) {
+	for i, stream := range malformedDeflateStreams(t) {
+		data := decompressFlateBytes(t, stream)
+		gz := append([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff}, stream...)
+		gz = append(gz, make([]byte, 8)...)
+		binary.LittleEndian.PutUint32(gz[len(gz)-8:], crc32.ChecksumIEEE([]byte(data)))
+		binary.LittleEndian.PutUint32(gz[len(gz)-4:], uint32(len(data)))
+		require.Equal(t, data, decompressBytes(t, gz))
+
+		check := func(name string, n int, corrupt bool, data []byte) {
+			t.Helper()
+
+			var err error
+			require.NotPanics(t, func() {
+				_, err = Splice(ioutil.Discard, data, []byte("</html>"), []byte("!"), DefaultCompression)
+			}, "Splice: %s %d of stream %d", name, n, i)
+			if !corrupt {
+				assert.Error(t, err, "Splice: %s %d of stream %d", name, n, i)
+			}
+
+			require.NotPanics(t, func() {
+				b := NewBuilder(DefaultCompression)
+				b.AddGzipMember(data)
+				_, err = b.Bytes()
+			}, "AddGzipMember: %s %d of stream %d", name, n, i)
+			if !corrupt {
+				assert.Error(t, err, "AddGzipMember: %s %d of stream %d", name, n, i)
+			}
+
+			require.NotPanics(t, func() {
+				_, err = NewAppendWriter(discardFile{bytes.NewReader(data)}, DefaultCompression)
+			}, "NewAppendWriter: %s %d of stream %d", name, n, i)
+			if !corrupt {
+				assert.Error(t, err, "NewAppendWriter: %s %d of stream %d", name, n, i)
+			}
+		}
+
+		for n := 0; n < len(gz); n++ {
+			check("truncated to", n, false, gz[:n])
+
+			bad := append([]byte(nil), gz...)
+			bad[n] ^= 1 << uint(n%8)
+			check("corrupt byte", n, true, bad)
+		}
+
+		for n := 0; n < len(stream); n++ {
+			require.NotPanics(t, func() {
+				b := NewBuilder(DefaultCompression)
+				b.AddDeflateStream(stream[:n])
+				_, err := b.Bytes()
+				assert.Error(t, err, "AddDeflateStream: truncated to %d of stream %d", n, i)
+			}, "AddDeflateStream: truncated to %d of stream %d", n, i)
+
+			bad := append([]byte(nil), stream...)
+			bad[n] ^= 1 << uint(n%8)
+			require.NotPanics(t, func() {
+				b := NewBuilder(DefaultCompression)
+				b.AddDeflateStream(bad)
+				b.Bytes()
+			}, "AddDeflateStream: corrupt byte %d of stream %d", n, i)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package gzipbuilder
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+)
+
+// tarBlockSize is the size of a tar block. Headers and file bodies are padded
+// to a multiple of it.
+const tarBlockSize = 512
+
+// tarZeros holds enough zeros for the padding of a file body followed by the
+// two zero blocks that end an archive.
+var tarZeros [3 * tarBlockSize]byte
+
+// A TarWriter writes a tar archive compressed as a single GZIP member. The tar
+// headers and padding are compressed as they are written, while file bodies may
+// be added from PrecompressedData without being recompressed.
+//
+// As the compressed form of an unchanged file body is the same each time, an
+// archive that is rebuilt from mostly unchanged files, such as a container
+// layer or release tarball, only needs to compress what has changed.
+type TarWriter struct {
+	w *Writer
+
+	buf bytes.Buffer
+
+	// pad is the length of the padding owed after the last file body.
+	pad int64
+
+	closed bool
+
+	err error
+}
+
+// NewTarWriter creates a TarWriter using the given compression level. Data is
+// written to w.
+func NewTarWriter(w io.Writer, level int) *TarWriter {
+	return &TarWriter{w: NewWriter(w, level)}
+}
+
+// CompressedDigest sets the TarWriter to write the compressed output to h. See
+// Writer.CompressedDigest.
+func (t *TarWriter) CompressedDigest(h hash.Hash) {
+	t.w.CompressedDigest(h)
+	t.err = t.w.Err()
+}
+
+// UncompressedDigest sets the TarWriter to write the uncompressed tar archive
+// to h. See Writer.UncompressedDigest.
+func (t *TarWriter) UncompressedDigest(h hash.Hash) {
+	t.w.UncompressedDigest(h)
+	t.err = t.w.Err()
+}
+
+// writeHeader writes the padding of the previous file body and the header for
+// a file with size bytes of data. hdr is not modified.
+func (t *TarWriter) writeHeader(hdr *tar.Header, size int64) bool {
+	if t.closed && t.err == nil {
+		t.err = errors.New("gzipbuilder: cannot add entry to TarWriter after close")
+	}
+	if t.err != nil {
+		return false
+	}
+
+	h := *hdr
+	h.Size = size
+
+	t.buf.Reset()
+	t.buf.Write(tarZeros[:t.pad])
+
+	// Only the header blocks are written with archive/tar, the body is
+	// added by the caller.
+	if t.err = tar.NewWriter(&t.buf).WriteHeader(&h); t.err != nil {
+		return false
+	}
+
+	t.w.AddCompressedData(t.buf.Bytes())
+	t.pad = -size & (tarBlockSize - 1)
+	t.err = t.w.Err()
+	return t.err == nil
+}
+
+// AddPrecompressedData adds a file to the archive whose body is data. The Size
+// field of hdr is ignored and is taken from data instead.
+//
+// The PrecompressedData must have been created with the same compression level
+// as the TarWriter.
+func (t *TarWriter) AddPrecompressedData(hdr *tar.Header, data *PrecompressedData) error {
+	if data.final && t.err == nil {
+		// The archive must be followed by its end marker.
+		t.err = errFinalData
+	}
+	if data.prefix != nil && t.err == nil {
+		// The entry header always comes between the data and its prefix.
+		t.err = errSuffixData
+	}
+	if t.writeHeader(hdr, int64(data.size)) {
+		t.w.AddPrecompressedData(data)
+		t.err = t.w.Err()
+	}
+
+	return t.err
+}
+
+// AddCompressedData adds a file to the archive whose body is data, which is
+// compressed. The Size field of hdr is ignored and is taken from data instead.
+//
+// Note: AddCompressedData is vulnerable to exploits such as BREACH when used
+// with secret data.
+func (t *TarWriter) AddCompressedData(hdr *tar.Header, data []byte) error {
+	if t.writeHeader(hdr, int64(len(data))) {
+		t.w.AddCompressedData(data)
+		t.err = t.w.Err()
+	}
+
+	return t.err
+}
+
+// AddUncompressedData adds a file to the archive whose body is data, without
+// compressing it. The Size field of hdr is ignored and is taken from data
+// instead.
+//
+// Note: AddUncompressedData should be used to add secret data to the archive,
+// such as credentials, as it is immune to exploits such as BREACH.
+func (t *TarWriter) AddUncompressedData(hdr *tar.Header, data []byte) error {
+	if t.writeHeader(hdr, int64(len(data))) {
+		t.w.AddUncompressedData(data)
+		t.err = t.w.Err()
+	}
+
+	return t.err
+}
+
+// Close ends the archive, flushes any unwritten data to the underlying
+// io.Writer and writes the GZIP footer. It returns an error if one has occurred
+// during building. It does not close the underlying io.Writer.
+func (t *TarWriter) Close() error {
+	if t.closed {
+		return t.err
+	}
+	t.closed = true
+
+	if t.err == nil {
+		t.w.AddCompressedData(tarZeros[:t.pad+2*tarBlockSize])
+	}
+	if err := t.w.Close(); t.err == nil {
+		t.err = err
+	}
+
+	return t.err
+}
@@ -0,0 +1,138 @@
+package gzipbuilder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarWriter(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+	longName := strings.Repeat("long/", 40) + "name.txt"
+
+	files := []tarFile{
+		{&tar.Header{Name: "doc.txt", Typeflag: tar.TypeReg, Mode: 0644}, string(doc)},
+		{&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{&tar.Header{Name: "dir/secret.txt", Typeflag: tar.TypeReg, Mode: 0600}, "hunter2"},
+		{&tar.Header{Name: "dir/small.txt", Typeflag: tar.TypeReg, Mode: 0644}, "hello, world"},
+		{&tar.Header{Name: longName, Typeflag: tar.TypeReg, Mode: 0644}, string(doc[:1000])},
+		{&tar.Header{Name: "empty.txt", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+		{&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "doc.txt"}, ""},
+	}
+
+	for _, level := range []int{BestSpeed, DefaultCompression, BestCompression} {
+		var buf bytes.Buffer
+		tw := NewTarWriter(&buf, level)
+
+		pd := func(s string) *PrecompressedData {
+			return MustPrecompressedData(PrecompressData([]byte(s), level))
+		}
+
+		hdr := files[0].hdr
+		require.NoError(t, tw.AddPrecompressedData(hdr, pd(files[0].body)))
+		assert.Equal(t, int64(0), hdr.Size, "header is not modified")
+		require.NoError(t, tw.AddCompressedData(files[1].hdr, nil))
+		require.NoError(t, tw.AddUncompressedData(files[2].hdr, []byte(files[2].body)))
+		require.NoError(t, tw.AddCompressedData(files[3].hdr, []byte(files[3].body)))
+		require.NoError(t, tw.AddPrecompressedData(files[4].hdr, pd(files[4].body)))
+		require.NoError(t, tw.AddPrecompressedData(files[5].hdr, pd(files[5].body)))
+		require.NoError(t, tw.AddCompressedData(files[6].hdr, nil))
+		require.NoError(t, tw.Close())
+		require.NoError(t, tw.Close())
+
+		debugLogf(t, "tar.gz at level %d is %d bytes", level, buf.Len())
+
+		zr, err := gzip.NewReader(&buf)
+		require.NoError(t, err)
+		zr.Multistream(false)
+
+		raw, err := ioutil.ReadAll(zr)
+		require.NoError(t, err)
+		assert.Zero(t, len(raw)%tarBlockSize, "tar is a multiple of the block size")
+
+		assert.Equal(t, io.EOF, zr.Reset(&buf), "single GZIP member")
+
+		tr := readTar(t, raw)
+		for _, f := range files {
+			if !assert.NotEmpty(t, tr) {
+				break
+			}
+
+			assert.Equal(t, f.hdr.Name, tr[0].hdr.Name)
+			assert.Equal(t, f.hdr.Typeflag, tr[0].hdr.Typeflag)
+			assert.Equal(t, f.hdr.Linkname, tr[0].hdr.Linkname)
+			assert.Equal(t, f.body, tr[0].body, f.hdr.Name)
+			tr = tr[1:]
+		}
+		assert.Empty(t, tr)
+	}
+}
+
+type tarFile struct {
+	hdr  *tar.Header
+	body string
+}
+
+func readTar(t *testing.T, p []byte) []tarFile {
+	var files []tarFile
+
+	tr := tar.NewReader(bytes.NewReader(p))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+
+		body, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+
+		files = append(files, tarFile{hdr, string(body)})
+	}
+}
+
+func TestTarWriterErrors(t *testing.T) {
+	tw := NewTarWriter(ioutil.Discard, DefaultCompression)
+	require.NoError(t, tw.Close())
+	assert.EqualError(t, tw.AddCompressedData(&tar.Header{Name: "a"}, nil),
+		"gzipbuilder: cannot add entry to TarWriter after close")
+
+	tw = NewTarWriter(ioutil.Discard, DefaultCompression)
+	pd := MustPrecompressedData(PrecompressData([]byte("a"), BestSpeed))
+	assert.Error(t, tw.AddPrecompressedData(&tar.Header{Name: "a"}, pd))
+	assert.Error(t, tw.Close())
+
+	tw = NewTarWriter(ioutil.Discard, DefaultCompression)
+	assert.Error(t, tw.AddCompressedData(&tar.Header{
+		Name:   strings.Repeat("a", 200),
+		Format: tar.FormatUSTAR,
+	}, nil))
+}
+
+func TestTarWriterDigest(t *testing.T) {
+	compressed, uncompressed := sha256.New(), sha256.New()
+
+	var buf bytes.Buffer
+	tw := NewTarWriter(&buf, DefaultCompression)
+	tw.CompressedDigest(compressed)
+	tw.UncompressedDigest(uncompressed)
+
+	pd := MustPrecompressedData(PrecompressData([]byte("hello, world"), DefaultCompression))
+	require.NoError(t, tw.AddPrecompressedData(&tar.Header{Name: "a.txt"}, pd))
+	require.NoError(t, tw.AddCompressedData(&tar.Header{Name: "b.txt"}, []byte("b")))
+	require.NoError(t, tw.Close())
+
+	expectCompressed := sha256.Sum256(buf.Bytes())
+	assert.Equal(t, expectCompressed[:], compressed.Sum(nil), "compressed digest")
+
+	expectUncompressed := sha256.Sum256([]byte(decompressBytes(t, buf.Bytes())))
+	assert.Equal(t, expectUncompressed[:], uncompressed.Sum(nil), "uncompressed digest")
+}
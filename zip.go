@@ -0,0 +1,496 @@
+package gzipbuilder
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// These constants and the layout of the records written below follow
+// archive/zip and the PKWARE APPNOTE.
+const (
+	zipLocalHeaderSig      = 0x04034b50
+	zipDirHeaderSig        = 0x02014b50
+	zipDirEndSig           = 0x06054b50
+	zipDir64EndSig         = 0x06064b50
+	zipDir64LocSig         = 0x07064b50
+	zipDataDescriptorSig   = 0x08074b50
+	zipLocalHeaderLen      = 30
+	zipDirHeaderLen        = 46
+	zipDirEndLen           = 22
+	zipDir64EndLen         = 56
+	zipDir64LocLen         = 20
+	zipDataDescriptorLen   = 16
+	zipDataDescriptor64Len = 24
+
+	zipVersion20 = 20
+	zipVersion45 = 45
+
+	zipFlagDataDescriptor = 0x8
+	zipFlagUTF8           = 0x800
+
+	zip64ExtraID      = 0x0001
+	zipExtTimeExtraID = 0x5455
+
+	uint16max = 1<<16 - 1
+	uint32max = 1<<32 - 1
+)
+
+// A ZipWriter assembles a zip archive. Entries may be added from
+// PrecompressedData without recompressing it, compressed as they are written
+// or stored without compression. ZIP64 records are written as needed.
+//
+// The archive can be read by archive/zip and tools such as unzip.
+type ZipWriter struct {
+	bw *bufio.Writer
+	cw countWriter
+
+	level int
+
+	dir   []*zip.FileHeader
+	offs  []uint64
+	entry *ZipEntryWriter
+
+	closed bool
+
+	err error
+}
+
+// NewZipWriter creates a ZipWriter using the given compression level for
+// entries created with Create. Data is written to w.
+func NewZipWriter(w io.Writer, level int) *ZipWriter {
+	bw := bufioWriterPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return &ZipWriter{
+		bw: bw,
+		cw: countWriter{w: bw},
+
+		level: level,
+
+		err: validCompressionLevel(level),
+	}
+}
+
+func (z *ZipWriter) canWrite() bool {
+	if z.closed && z.err == nil {
+		z.err = errors.New("gzipbuilder: cannot add entry to ZipWriter after close")
+	}
+	if z.err == nil && z.entry != nil {
+		z.err = z.entry.Close()
+	}
+
+	return z.err == nil
+}
+
+// writeLocalHeader prepares fh for an entry using method and writes its local
+// file header. If the checksum and sizes are not yet known, they are written
+// in a data descriptor after the data instead.
+func (z *ZipWriter) writeLocalHeader(fh *zip.FileHeader, method uint16, known bool) {
+	if len(fh.Name) > uint16max {
+		z.err = errors.New("gzipbuilder: zip entry name too long")
+		return
+	}
+
+	fh.Method = method
+	fh.CreatorVersion = fh.CreatorVersion&0xff00 | zipVersion20
+	fh.ReaderVersion = zipVersion20
+	fh.Flags &^= zipFlagDataDescriptor | zipFlagUTF8
+	if !known {
+		fh.Flags |= zipFlagDataDescriptor
+	}
+	if !fh.NonUTF8 && (needsUTF8(fh.Name) || needsUTF8(fh.Comment)) {
+		fh.Flags |= zipFlagUTF8
+	}
+	if zipIs64(fh) {
+		fh.ReaderVersion = zipVersion45
+	}
+
+	// If Modified is set, it takes precedence over the MS-DOS fields and
+	// is also recorded in an extended timestamp field.
+	if !fh.Modified.IsZero() {
+		fh.ModifiedDate, fh.ModifiedTime = msDosTime(fh.Modified)
+
+		var buf [9]byte
+		binary.LittleEndian.PutUint16(buf[0:], zipExtTimeExtraID)
+		binary.LittleEndian.PutUint16(buf[2:], 5)
+		buf[4] = 1 // modification time is present
+		binary.LittleEndian.PutUint32(buf[5:], uint32(fh.Modified.Unix()))
+		fh.Extra = append(fh.Extra, buf[:]...)
+	}
+	if len(fh.Extra) > uint16max {
+		z.err = errors.New("gzipbuilder: zip entry extra field too long")
+		return
+	}
+
+	z.dir = append(z.dir, fh)
+	z.offs = append(z.offs, uint64(z.cw.n))
+
+	var buf [zipLocalHeaderLen]byte
+	binary.LittleEndian.PutUint32(buf[0:], zipLocalHeaderSig)
+	binary.LittleEndian.PutUint16(buf[4:], fh.ReaderVersion)
+	binary.LittleEndian.PutUint16(buf[6:], fh.Flags)
+	binary.LittleEndian.PutUint16(buf[8:], fh.Method)
+	binary.LittleEndian.PutUint16(buf[10:], fh.ModifiedTime)
+	binary.LittleEndian.PutUint16(buf[12:], fh.ModifiedDate)
+	if known {
+		binary.LittleEndian.PutUint32(buf[14:], fh.CRC32)
+		binary.LittleEndian.PutUint32(buf[18:], uint32(min64(fh.CompressedSize64, uint32max)))
+		binary.LittleEndian.PutUint32(buf[22:], uint32(min64(fh.UncompressedSize64, uint32max)))
+	}
+	binary.LittleEndian.PutUint16(buf[26:], uint16(len(fh.Name)))
+	binary.LittleEndian.PutUint16(buf[28:], uint16(len(fh.Extra)))
+
+	if _, z.err = z.cw.Write(buf[:]); z.err != nil {
+		return
+	}
+	if _, z.err = io.WriteString(&z.cw, fh.Name); z.err != nil {
+		return
+	}
+	_, z.err = z.cw.Write(fh.Extra)
+}
+
+// setSizes records the checksum and sizes of an entry in fh.
+func setSizes(fh *zip.FileHeader, crc uint32, csize, usize uint64) {
+	fh.CRC32 = crc
+	fh.CompressedSize64 = csize
+	fh.UncompressedSize64 = usize
+	fh.CompressedSize = uint32(min64(csize, uint32max))
+	fh.UncompressedSize = uint32(min64(usize, uint32max))
+}
+
+// AddPrecompressedData adds an entry to the archive that holds data, using the
+// DEFLATE method. data is written as is, without being recompressed, and may
+// have been created at any compression level.
+//
+// The ZipWriter takes ownership of fh, which must not be modified afterwards.
+// Its Method, checksum and size fields are set by the ZipWriter.
+func (z *ZipWriter) AddPrecompressedData(fh *zip.FileHeader, data *PrecompressedData) error {
+	if !z.canWrite() {
+		return z.err
+	}
+	if data.prefix != nil {
+		z.err = errSuffixData
+		return z.err
+	}
+
+	n := uint64(len(data.bytes))
+	if data.src != nil {
+		n = uint64(data.src.Size())
+	}
+
+	// Data that ends with a final block needs no footer.
+	footer := closeFooter
+	if data.final {
+		footer = nil
+	}
+	setSizes(fh, data.crc, n+uint64(len(footer)), data.size)
+
+	if z.writeLocalHeader(fh, zip.Deflate, true); z.err != nil {
+		return z.err
+	}
+	if _, z.err = data.WriteTo(&z.cw); z.err != nil {
+		return z.err
+	}
+
+	_, z.err = z.cw.Write(footer)
+	return z.err
+}
+
+// AddUncompressedData adds an entry to the archive that holds data, using the
+// Store method.
+//
+// The ZipWriter takes ownership of fh, which must not be modified afterwards.
+// Its Method, checksum and size fields are set by the ZipWriter.
+//
+// Note: AddUncompressedData should be used to add secret data to the archive,
+// such as credentials, as it is immune to exploits such as BREACH.
+func (z *ZipWriter) AddUncompressedData(fh *zip.FileHeader, data []byte) error {
+	if !z.canWrite() {
+		return z.err
+	}
+
+	n := uint64(len(data))
+	setSizes(fh, crc32.ChecksumIEEE(data), n, n)
+
+	if z.writeLocalHeader(fh, zip.Store, true); z.err != nil {
+		return z.err
+	}
+
+	_, z.err = z.cw.Write(data)
+	return z.err
+}
+
+// Create adds an entry to the archive, using the DEFLATE method, and returns a
+// ZipEntryWriter to which its data is added. The entry may interleave
+// compressed, pre-compressed and uncompressed data, as a Writer does.
+//
+// The entry must be closed before another is added, otherwise it is closed
+// automatically.
+//
+// The ZipWriter takes ownership of fh, which must not be modified afterwards.
+// Its Method, checksum and size fields are set by the ZipWriter.
+func (z *ZipWriter) Create(fh *zip.FileHeader) (*ZipEntryWriter, error) {
+	if !z.canWrite() {
+		return nil, z.err
+	}
+
+	if z.writeLocalHeader(fh, zip.Deflate, false); z.err != nil {
+		return nil, z.err
+	}
+
+	e := &ZipEntryWriter{
+		b: newBuilder(&z.cw, z.level),
+
+		z:     z,
+		fh:    fh,
+		start: z.cw.n,
+	}
+	e.b.noHeader = true
+	z.entry = e
+	return e, nil
+}
+
+// Close writes the central directory, flushes any unwritten data to the
+// underlying io.Writer and closes any open entry. It returns an error if one
+// has occurred during building. It does not close the underlying io.Writer.
+func (z *ZipWriter) Close() error {
+	if z.closed || !z.canWrite() {
+		return z.err
+	}
+	z.closed = true
+
+	start := uint64(z.cw.n)
+	for i, fh := range z.dir {
+		if z.writeDirHeader(fh, z.offs[i]); z.err != nil {
+			return z.err
+		}
+	}
+	end := uint64(z.cw.n)
+
+	records, size, offset := uint64(len(z.dir)), end-start, start
+	if records >= uint16max || size >= uint32max || offset >= uint32max {
+		var buf [zipDir64EndLen + zipDir64LocLen]byte
+		binary.LittleEndian.PutUint32(buf[0:], zipDir64EndSig)
+		binary.LittleEndian.PutUint64(buf[4:], zipDir64EndLen-12)
+		binary.LittleEndian.PutUint16(buf[12:], zipVersion45) // version made by
+		binary.LittleEndian.PutUint16(buf[14:], zipVersion45) // version needed
+		binary.LittleEndian.PutUint64(buf[24:], records)      // entries on this disk
+		binary.LittleEndian.PutUint64(buf[32:], records)      // total entries
+		binary.LittleEndian.PutUint64(buf[40:], size)
+		binary.LittleEndian.PutUint64(buf[48:], offset)
+
+		loc := buf[zipDir64EndLen:]
+		binary.LittleEndian.PutUint32(loc[0:], zipDir64LocSig)
+		binary.LittleEndian.PutUint64(loc[8:], end)
+		binary.LittleEndian.PutUint32(loc[16:], 1) // total number of disks
+
+		if _, z.err = z.cw.Write(buf[:]); z.err != nil {
+			return z.err
+		}
+
+		// The maximum values in the end record signal that the ZIP64
+		// values are to be used instead.
+		records, size, offset = uint16max, uint32max, uint32max
+	}
+
+	var buf [zipDirEndLen]byte
+	binary.LittleEndian.PutUint32(buf[0:], zipDirEndSig)
+	binary.LittleEndian.PutUint16(buf[8:], uint16(records))
+	binary.LittleEndian.PutUint16(buf[10:], uint16(records))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(size))
+	binary.LittleEndian.PutUint32(buf[16:], uint32(offset))
+	if _, z.err = z.cw.Write(buf[:]); z.err != nil {
+		return z.err
+	}
+
+	z.err = z.bw.Flush()
+	bufioWriterPool.Put(z.bw)
+	z.bw = nil
+	return z.err
+}
+
+func (z *ZipWriter) writeDirHeader(fh *zip.FileHeader, off uint64) {
+	extra := fh.Extra
+
+	var buf [zipDirHeaderLen]byte
+	binary.LittleEndian.PutUint32(buf[0:], zipDirHeaderSig)
+	binary.LittleEndian.PutUint16(buf[4:], fh.CreatorVersion)
+	binary.LittleEndian.PutUint16(buf[6:], fh.ReaderVersion)
+	binary.LittleEndian.PutUint16(buf[8:], fh.Flags)
+	binary.LittleEndian.PutUint16(buf[10:], fh.Method)
+	binary.LittleEndian.PutUint16(buf[12:], fh.ModifiedTime)
+	binary.LittleEndian.PutUint16(buf[14:], fh.ModifiedDate)
+	binary.LittleEndian.PutUint32(buf[16:], fh.CRC32)
+	if zipIs64(fh) || off >= uint32max {
+		// The sizes and offset are held in a ZIP64 extra field, which is
+		// signalled by storing the maximum values here.
+		binary.LittleEndian.PutUint32(buf[20:], uint32max)
+		binary.LittleEndian.PutUint32(buf[24:], uint32max)
+		binary.LittleEndian.PutUint32(buf[42:], uint32max)
+
+		var eb [28]byte
+		binary.LittleEndian.PutUint16(eb[0:], zip64ExtraID)
+		binary.LittleEndian.PutUint16(eb[2:], 24)
+		binary.LittleEndian.PutUint64(eb[4:], fh.UncompressedSize64)
+		binary.LittleEndian.PutUint64(eb[12:], fh.CompressedSize64)
+		binary.LittleEndian.PutUint64(eb[20:], off)
+		extra = append(extra[:len(extra):len(extra)], eb[:]...)
+	} else {
+		binary.LittleEndian.PutUint32(buf[20:], uint32(fh.CompressedSize64))
+		binary.LittleEndian.PutUint32(buf[24:], uint32(fh.UncompressedSize64))
+		binary.LittleEndian.PutUint32(buf[42:], uint32(off))
+	}
+	if len(extra) > uint16max || len(fh.Comment) > uint16max {
+		z.err = errors.New("gzipbuilder: zip entry extra field or comment too long")
+		return
+	}
+	binary.LittleEndian.PutUint16(buf[28:], uint16(len(fh.Name)))
+	binary.LittleEndian.PutUint16(buf[30:], uint16(len(extra)))
+	binary.LittleEndian.PutUint16(buf[32:], uint16(len(fh.Comment)))
+	binary.LittleEndian.PutUint32(buf[38:], fh.ExternalAttrs)
+
+	if _, z.err = z.cw.Write(buf[:]); z.err != nil {
+		return
+	}
+	if _, z.err = io.WriteString(&z.cw, fh.Name); z.err != nil {
+		return
+	}
+	if _, z.err = z.cw.Write(extra); z.err != nil {
+		return
+	}
+	_, z.err = io.WriteString(&z.cw, fh.Comment)
+}
+
+// A ZipEntryWriter adds data to an entry of a zip archive created with
+// ZipWriter.Create. It supports interleaving compressed, pre-compressed or
+// uncompressed data into the entry.
+//
+// Unlike a Writer, it does not support the GZIP stream options, such as
+// RawDeflate, Adaptive or IndexEvery, as the entry's checksum and sizes must
+// be tracked and the zip format has no use for them.
+type ZipEntryWriter struct {
+	b builder
+
+	z     *ZipWriter
+	fh    *zip.FileHeader
+	start int64
+}
+
+// Err returns the first error that occurred while adding data to the entry,
+// if any.
+func (e *ZipEntryWriter) Err() error {
+	return e.b.Err()
+}
+
+// AddPrecompressedData adds pre-compressed data to the entry, as
+// Builder.AddPrecompressedData does.
+func (e *ZipEntryWriter) AddPrecompressedData(data *PrecompressedData) {
+	e.b.AddPrecompressedData(data)
+}
+
+// AddCompressedData compresses data and adds it to the entry, as
+// Builder.AddCompressedData does.
+func (e *ZipEntryWriter) AddCompressedData(data []byte) {
+	e.b.AddCompressedData(data)
+}
+
+// AddUncompressedData adds data to the entry without compressing it, as
+// Builder.AddUncompressedData does.
+func (e *ZipEntryWriter) AddUncompressedData(data []byte) {
+	e.b.AddUncompressedData(data)
+}
+
+// Write compresses p and adds it to the entry. It implements io.Writer.
+func (e *ZipEntryWriter) Write(p []byte) (int, error) {
+	return compressedWriter{&e.b}.Write(p)
+}
+
+// CompressedWriter returns an io.Writer that will write compressed data to the
+// entry.
+func (e *ZipEntryWriter) CompressedWriter() io.Writer {
+	return e.b.CompressedWriter()
+}
+
+// UncompressedWriter returns an io.Writer that will write uncompressed data to
+// the entry.
+func (e *ZipEntryWriter) UncompressedWriter() io.Writer {
+	return e.b.UncompressedWriter()
+}
+
+// Close ends the entry and writes its checksum and sizes. It does not close the
+// ZipWriter.
+func (e *ZipEntryWriter) Close() error {
+	b := &e.b
+	if b.last == finished {
+		return b.err
+	}
+	b.finish()
+	e.z.entry = nil
+	if b.err != nil {
+		// The archive is left incomplete.
+		e.z.err = b.err
+		return b.err
+	}
+
+	fh := e.fh
+	setSizes(fh, b.crc, uint64(e.z.cw.n-e.start), b.size)
+
+	var buf [zipDataDescriptor64Len]byte
+	binary.LittleEndian.PutUint32(buf[0:], zipDataDescriptorSig)
+	binary.LittleEndian.PutUint32(buf[4:], fh.CRC32)
+	n := zipDataDescriptorLen
+	if zipIs64(fh) {
+		fh.ReaderVersion = zipVersion45
+		binary.LittleEndian.PutUint64(buf[8:], fh.CompressedSize64)
+		binary.LittleEndian.PutUint64(buf[16:], fh.UncompressedSize64)
+		n = zipDataDescriptor64Len
+	} else {
+		binary.LittleEndian.PutUint32(buf[8:], fh.CompressedSize)
+		binary.LittleEndian.PutUint32(buf[12:], fh.UncompressedSize)
+	}
+
+	_, b.err = e.z.cw.Write(buf[:n])
+	e.z.err = b.err
+	return b.err
+}
+
+func zipIs64(fh *zip.FileHeader) bool {
+	return fh.CompressedSize64 >= uint32max || fh.UncompressedSize64 >= uint32max
+}
+
+// needsUTF8 reports whether s contains non-ASCII characters, which must be
+// flagged as UTF-8.
+func needsUTF8(s string) bool {
+	return utf8.ValidString(s) && strings.IndexFunc(s, func(r rune) bool {
+		return r >= utf8.RuneSelf
+	}) >= 0
+}
+
+// msDosTime converts t to the MS-DOS date and time format. Times outside the
+// range of the format, 1980 to 2107, are clamped to it.
+func msDosTime(t time.Time) (date, tm uint16) {
+	switch {
+	case t.Year() < 1980:
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	case t.Year() > 2107:
+		t = time.Date(2107, 12, 31, 23, 59, 59, 0, time.UTC)
+	}
+
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	tm = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,206 @@
+package gzipbuilder
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readZipEntries(t *testing.T, p []byte) map[string]string {
+	zr, err := zip.NewReader(bytes.NewReader(p), int64(len(p)))
+	require.NoError(t, err)
+
+	entries := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err, f.Name)
+
+		b, err := ioutil.ReadAll(rc)
+		require.NoError(t, err, f.Name)
+		require.NoError(t, rc.Close(), f.Name)
+
+		entries[f.Name] = string(b)
+	}
+
+	return entries
+}
+
+func TestZipWriter(t *testing.T) {
+	doc := spliceTestDocument(100 << 10)
+	pd := MustPrecompressedData(PrecompressData(doc, BestCompression))
+	empty := MustPrecompressedData(PrecompressData(nil, BestSpeed))
+
+	pw := NewPrecompressedWriter(DefaultCompression)
+	pw.Write(doc[:1000])
+	final := MustPrecompressedData(pw.FinalData())
+
+	var buf bytes.Buffer
+	z := NewZipWriter(&buf, DefaultCompression)
+
+	require.NoError(t, z.AddPrecompressedData(&zip.FileHeader{Name: "doc.txt"}, pd))
+	require.NoError(t, z.AddPrecompressedData(&zip.FileHeader{Name: "empty.txt"}, empty))
+	require.NoError(t, z.AddUncompressedData(&zip.FileHeader{Name: "secret.txt"}, []byte("hunter2")))
+	require.NoError(t, z.AddPrecompressedData(&zip.FileHeader{Name: "final.txt"}, final))
+	require.NoError(t, z.AddUncompressedData(&zip.FileHeader{Name: "dir/"}, nil))
+
+	e, err := z.Create(&zip.FileHeader{Name: "dir/mixed.txt"})
+	require.NoError(t, err)
+	e.AddCompressedData([]byte("compressed "))
+	e.AddUncompressedData([]byte("uncompressed "))
+	e.AddPrecompressedData(MustPrecompressedData(PrecompressData(doc[:1000], DefaultCompression)))
+	e.Write([]byte(" written "))
+	e.AddPrecompressedData(final)
+	require.NoError(t, e.Close())
+
+	// This entry is closed by the next call.
+	e, err = z.Create(&zip.FileHeader{Name: "live.txt"})
+	require.NoError(t, err)
+	e.AddCompressedData(doc)
+
+	_, err = z.Create(&zip.FileHeader{Name: "nothing.txt"})
+	require.NoError(t, err)
+
+	modified := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	fh := &zip.FileHeader{
+		Name:     "héllo.txt",
+		Comment:  "a comment",
+		Modified: modified,
+	}
+	require.NoError(t, z.AddPrecompressedData(fh, pd))
+
+	require.NoError(t, z.Close())
+	require.NoError(t, z.Close())
+
+	debugLogf(t, "zip archive is %d bytes", buf.Len())
+
+	assert.Equal(t, map[string]string{
+		"doc.txt":       string(doc),
+		"empty.txt":     "",
+		"secret.txt":    "hunter2",
+		"dir/":          "",
+		"final.txt":     string(doc[:1000]),
+		"dir/mixed.txt": "compressed uncompressed " + string(doc[:1000]) + " written " + string(doc[:1000]),
+		"live.txt":      string(doc),
+		"nothing.txt":   "",
+		"héllo.txt":     string(doc),
+	}, readZipEntries(t, buf.Bytes()))
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	f := zr.File[len(zr.File)-1]
+	assert.Equal(t, "a comment", f.Comment)
+	assert.True(t, f.Modified.Equal(modified), "modified time")
+	assert.False(t, f.NonUTF8)
+
+	assert.Equal(t, uint16(zip.Store), zr.File[2].Method)
+	assert.Contains(t, buf.String(), "hunter2")
+	assert.True(t, zr.File[4].Mode().IsDir(), "dir/ is a directory")
+}
+
+func TestZipWriterZIP64(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	// More than 65535 entries requires the ZIP64 end of central directory
+	// record.
+	const n = uint16max + 10
+
+	var buf bytes.Buffer
+	z := NewZipWriter(&buf, DefaultCompression)
+	for i := 0; i < n; i++ {
+		require.NoError(t, z.AddUncompressedData(&zip.FileHeader{Name: "a"}, nil))
+	}
+	require.NoError(t, z.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	assert.Len(t, zr.File, n)
+}
+
+func TestZipWriterErrors(t *testing.T) {
+	z := NewZipWriter(ioutil.Discard, 42)
+	assert.EqualError(t, z.AddUncompressedData(&zip.FileHeader{Name: "a"}, nil),
+		"flate: invalid compression level 42: want value in range [-2, 9]")
+
+	z = NewZipWriter(ioutil.Discard, DefaultCompression)
+	require.NoError(t, z.Close())
+	assert.EqualError(t, z.AddUncompressedData(&zip.FileHeader{Name: "a"}, nil),
+		"gzipbuilder: cannot add entry to ZipWriter after close")
+
+	z = NewZipWriter(ioutil.Discard, DefaultCompression)
+	_, err := z.Create(&zip.FileHeader{Name: string(make([]byte, 1<<16))})
+	assert.EqualError(t, err, "gzipbuilder: zip entry name too long")
+
+	z = NewZipWriter(ioutil.Discard, DefaultCompression)
+	e, err := z.Create(&zip.FileHeader{Name: "a"})
+	require.NoError(t, err)
+	e.AddPrecompressedData(MustPrecompressedData(PrecompressData([]byte("a"), BestSpeed)))
+	assert.Error(t, e.Close())
+	assert.Equal(t, e.Err(), z.Close())
+
+	z = NewZipWriter(errWriter{}, DefaultCompression)
+	z.AddUncompressedData(&zip.FileHeader{Name: "a"}, make([]byte, 4096))
+	assert.Error(t, z.Close())
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestZipEntryWriterMethods(t *testing.T) {
+	// The GZIP stream options would stop the entry's checksum and sizes
+	// from being tracked, so they must not be reachable from an entry.
+	typ := reflect.TypeOf(&ZipEntryWriter{})
+	for _, name := range []string{
+		"RawDeflate",
+		"Adaptive",
+		"IndexEvery",
+		"Index",
+		"MaxSize",
+		"CompressedDigest",
+		"UncompressedDigest",
+		"AddGzipMember",
+		"AddDeflateStream",
+	} {
+		_, ok := typ.MethodByName(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestMsDosTime(t *testing.T) {
+	for _, tc := range []struct {
+		t      time.Time
+		expect time.Time
+	}{
+		{
+			time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC),
+			time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC),
+		},
+		{
+			time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			time.Date(2200, 6, 15, 12, 0, 0, 0, time.UTC),
+			time.Date(2107, 12, 31, 23, 59, 58, 0, time.UTC),
+		},
+	} {
+		date, tm := msDosTime(tc.t)
+		got := time.Date(
+			int(date>>9)+1980, time.Month(date>>5&0xf), int(date&0x1f),
+			int(tm>>11), int(tm>>5&0x3f), int(tm&0x1f)*2,
+			0, time.UTC)
+		assert.Equal(t, tc.expect, got, "for %s", tc.t)
+	}
+}